@@ -9,17 +9,29 @@ import (
 	"os"
 	"strings"
 
+	"github.com/embiem/book-rag/config"
 	"github.com/embiem/book-rag/eval"
-	"github.com/openai/openai-go/v3"
+	"github.com/embiem/book-rag/rag"
 )
 
 func main() {
 	// Parse command-line flags
 	datasetFile := flag.String("dataset", "testdata/eval_dataset.json", "Path to evaluation dataset")
 	outputFile := flag.String("output", "testdata/results/baseline.json", "Path for results output")
-	ragURL := flag.String("rag-url", "http://localhost:3000", "Base URL of RAG server")
+	ragURL := flag.String("rag-url", "", "Base URL of RAG server (default: eval.rag_url of the config, http://localhost:3000)")
+	configPath := flag.String("config", "", "Path to a JSON config file (default: $CONFIG_FILE)")
 	flag.Parse()
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	rag.Configure(*cfg)
+	eval.Configure(*cfg)
+	if *ragURL == "" {
+		*ragURL = cfg.Eval.RAGURL
+	}
+
 	// Load dataset
 	fmt.Printf("Loading dataset from %s...\n", *datasetFile)
 	file, err := os.Open(*datasetFile)
@@ -39,18 +51,17 @@ func main() {
 		log.Fatal("Dataset is empty")
 	}
 
-	// Initialize OpenAI client for judging
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
+	// Initialize OpenAI client for judging, or the configured OpenAI-compatible backend
+	if cfg.LLM.APIKey == "" && cfg.LLM.BaseURL == "" {
 		log.Fatal("OPENAI_API_KEY environment variable is required")
 	}
-	client := openai.NewClient()
+	client := rag.NewGenerator().Client()
 
 	ctx := context.Background()
 
 	// Run evaluation
 	fmt.Printf("\nStarting evaluation against RAG server at %s...\n\n", *ragURL)
-	run, err := eval.RunEvaluation(ctx, &client, &dataset, *ragURL)
+	run, err := eval.RunEvaluation(ctx, client, &dataset, *ragURL)
 	if err != nil {
 		log.Fatalf("Evaluation failed: %v", err)
 	}
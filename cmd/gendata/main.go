@@ -8,9 +8,10 @@ import (
 	"log"
 	"os"
 
+	"github.com/embiem/book-rag/config"
 	"github.com/embiem/book-rag/db"
 	"github.com/embiem/book-rag/eval"
-	"github.com/openai/openai-go/v3"
+	"github.com/embiem/book-rag/rag"
 )
 
 func main() {
@@ -18,23 +19,33 @@ func main() {
 	bookID := flag.Int64("book-id", 0, "Book ID to generate QA pairs from (0 = use all books)")
 	samples := flag.Int("samples", 50, "Number of QA pairs to generate (before filtering)")
 	output := flag.String("output", "testdata/eval_dataset.json", "Output file path")
+	configPath := flag.String("config", "", "Path to a JSON config file (default: $CONFIG_FILE)")
 	flag.Parse()
 
 	if *samples <= 0 {
 		log.Fatal("samples must be positive")
 	}
 
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	rag.Configure(*cfg)
+	eval.Configure(*cfg)
+
 	// Initialize database
-	if err := db.Init(); err != nil {
+	if err := cfg.RequireDatabase(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := db.Init(cfg.Database); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	// Initialize OpenAI client
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
+	// Initialize OpenAI client, or the configured OpenAI-compatible backend
+	if cfg.LLM.APIKey == "" && cfg.LLM.BaseURL == "" {
 		log.Fatal("OPENAI_API_KEY environment variable is required")
 	}
-	client := openai.NewClient()
+	client := rag.NewGenerator().Client()
 
 	ctx := context.Background()
 
@@ -42,7 +53,6 @@ func main() {
 	fmt.Println("Fetching book passages from database...")
 
 	var chunks []eval.ChunkWithBook
-	var err error
 
 	if *bookID > 0 {
 		passages, err := db.Queries.GetBookPassages(ctx, *bookID)
@@ -80,7 +90,7 @@ func main() {
 
 	// Generate dataset
 	fmt.Printf("\nGenerating evaluation dataset with target of %d samples...\n\n", *samples)
-	dataset, err := eval.GenerateDataset(ctx, &client, chunks, *samples)
+	dataset, err := eval.GenerateDataset(ctx, client, chunks, *samples)
 	if err != nil {
 		log.Fatalf("Failed to generate dataset: %v", err)
 	}
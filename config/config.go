@@ -0,0 +1,394 @@
+// Package config loads the configuration shared by the server and the
+// commands: defaults, overridden by an optional JSON file, overridden by
+// environment variables
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FileEnv names the environment variable with the path of the config file,
+// used if no path is passed explicitly
+const FileEnv = "CONFIG_FILE"
+
+// Redacted replaces secrets when printing the configuration
+const Redacted = "<redacted>"
+
+type Config struct {
+	Server    ServerConfig    `json:"server"`
+	Database  DatabaseConfig  `json:"database"`
+	LLM       LLMConfig       `json:"llm"`
+	Embedding EmbeddingConfig `json:"embedding"`
+	Rerank    RerankConfig    `json:"rerank"`
+	RAG       RAGConfig       `json:"rag"`
+	Eval      EvalConfig      `json:"eval"`
+}
+
+type ServerConfig struct {
+	Addr              string   `json:"addr"`                // Listen address
+	ReadHeaderTimeout Duration `json:"read_header_timeout"` // 0 for none
+	ReadTimeout       Duration `json:"read_timeout"`        // Whole request including the body, e.g. an uploaded book
+	WriteTimeout      Duration `json:"write_timeout"`       // Must cover the slowest LLM requests, like summaries
+	IdleTimeout       Duration `json:"idle_timeout"`        // Keep-alive connections
+	ShutdownTimeout   Duration `json:"shutdown_timeout"`    // How long to wait for requests and ingestions on shutdown
+}
+
+type DatabaseConfig struct {
+	URL             string   `json:"url"` // Secret, may contain a password
+	MigrationsDir   string   `json:"migrations_dir"`
+	MaxConns        int      `json:"max_conns"` // Connections shared by all requests
+	MinConns        int      `json:"min_conns"` // Kept open even when idle
+	MaxConnLifetime Duration `json:"max_conn_lifetime"`
+	MaxConnIdleTime Duration `json:"max_conn_idle_time"`
+}
+
+type LLMConfig struct {
+	BaseURL string `json:"base_url"` // Empty for OpenAI
+	Model   string `json:"model"`
+	APIKey  string `json:"api_key"` // Secret
+}
+
+type EmbeddingConfig struct {
+	BaseURL   string   `json:"base_url"` // Ollama
+	Model     string   `json:"model"`
+	BatchSize int      `json:"batch_size"` // Texts per embedding request
+	Timeout   Duration `json:"timeout"`    // Per embedding request
+}
+
+type RerankConfig struct {
+	BaseURL string `json:"base_url"` // Empty to rerank with the LLM
+	Model   string `json:"model"`
+	APIKey  string `json:"api_key"` // Secret
+}
+
+type RAGConfig struct {
+	ContextTokens      int      `json:"context_tokens"` // Default token budget for retrieved context
+	ChunkSize          int      `json:"chunk_size"`     // Target passage length in characters
+	PromptTemplatesDir string   `json:"prompt_templates_dir"`
+	MinSimilarity      *float32 `json:"min_similarity"` // Default relevance threshold, null for the embedding model's
+}
+
+type EvalConfig struct {
+	Model          string   `json:"model"`           // Generates and judges questions, uses the LLM connection
+	RAGURL         string   `json:"rag_url"`         // Server evaluated by cmd/evaluate
+	RequestTimeout Duration `json:"request_timeout"` // Per request to the server
+}
+
+// Duration is a time.Duration written like "30s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the configuration used when neither a file nor the
+// environment set anything
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:              ":3000",
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(2 * time.Minute),
+			WriteTimeout:      Duration(10 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Database: DatabaseConfig{
+			MigrationsDir:   "db/migrations",
+			MaxConns:        10,
+			MaxConnLifetime: Duration(time.Hour),
+			MaxConnIdleTime: Duration(30 * time.Minute),
+		},
+		LLM: LLMConfig{Model: "gpt-5-mini"},
+		Embedding: EmbeddingConfig{
+			BaseURL:   "http://localhost:11434",
+			Model:     "embeddinggemma",
+			BatchSize: 20,
+			Timeout:   Duration(30 * time.Second),
+		},
+		Rerank: RerankConfig{Model: "bge-reranker-v2-m3"},
+		RAG: RAGConfig{
+			ContextTokens: 8000,
+			ChunkSize:     1000,
+		},
+		Eval: EvalConfig{
+			Model:          "gpt-4o-mini",
+			RAGURL:         "http://localhost:3000",
+			RequestTimeout: Duration(30 * time.Second),
+		},
+	}
+}
+
+// envVar overrides a setting if it is set and not empty
+type envVar struct {
+	name  string
+	apply func(c *Config, value string) error
+}
+
+func stringEnv(name string, field func(c *Config) *string) envVar {
+	return envVar{name, func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intEnv(name string, field func(c *Config) *int) envVar {
+	return envVar{name, func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func durationEnv(name string, field func(c *Config) *Duration) envVar {
+	return envVar{name, func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration like 30s", name)
+		}
+		*field(c) = Duration(d)
+		return nil
+	}}
+}
+
+// envVars are applied in order, so LLM_API_KEY wins over OPENAI_API_KEY
+var envVars = []envVar{
+	stringEnv("LISTEN_ADDR", func(c *Config) *string { return &c.Server.Addr }),
+	durationEnv("READ_HEADER_TIMEOUT", func(c *Config) *Duration { return &c.Server.ReadHeaderTimeout }),
+	durationEnv("READ_TIMEOUT", func(c *Config) *Duration { return &c.Server.ReadTimeout }),
+	durationEnv("WRITE_TIMEOUT", func(c *Config) *Duration { return &c.Server.WriteTimeout }),
+	durationEnv("IDLE_TIMEOUT", func(c *Config) *Duration { return &c.Server.IdleTimeout }),
+	durationEnv("SHUTDOWN_TIMEOUT", func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	stringEnv("DATABASE_URL", func(c *Config) *string { return &c.Database.URL }),
+	stringEnv("MIGRATIONS_DIR", func(c *Config) *string { return &c.Database.MigrationsDir }),
+	intEnv("DB_MAX_CONNS", func(c *Config) *int { return &c.Database.MaxConns }),
+	intEnv("DB_MIN_CONNS", func(c *Config) *int { return &c.Database.MinConns }),
+	durationEnv("DB_MAX_CONN_LIFETIME", func(c *Config) *Duration { return &c.Database.MaxConnLifetime }),
+	durationEnv("DB_MAX_CONN_IDLE_TIME", func(c *Config) *Duration { return &c.Database.MaxConnIdleTime }),
+	stringEnv("LLM_BASE_URL", func(c *Config) *string { return &c.LLM.BaseURL }),
+	stringEnv("LLM_MODEL", func(c *Config) *string { return &c.LLM.Model }),
+	stringEnv("OPENAI_API_KEY", func(c *Config) *string { return &c.LLM.APIKey }),
+	stringEnv("LLM_API_KEY", func(c *Config) *string { return &c.LLM.APIKey }),
+	stringEnv("OLLAMA_BASE_URL", func(c *Config) *string { return &c.Embedding.BaseURL }),
+	stringEnv("EMBEDDING_MODEL", func(c *Config) *string { return &c.Embedding.Model }),
+	intEnv("EMBEDDING_BATCH_SIZE", func(c *Config) *int { return &c.Embedding.BatchSize }),
+	durationEnv("EMBEDDING_TIMEOUT", func(c *Config) *Duration { return &c.Embedding.Timeout }),
+	stringEnv("RERANK_BASE_URL", func(c *Config) *string { return &c.Rerank.BaseURL }),
+	stringEnv("RERANK_MODEL", func(c *Config) *string { return &c.Rerank.Model }),
+	stringEnv("RERANK_API_KEY", func(c *Config) *string { return &c.Rerank.APIKey }),
+	intEnv("CONTEXT_TOKENS", func(c *Config) *int { return &c.RAG.ContextTokens }),
+	intEnv("CHUNK_SIZE", func(c *Config) *int { return &c.RAG.ChunkSize }),
+	{"MIN_SIMILARITY", func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("MIN_SIMILARITY must be a number")
+		}
+		minSimilarity := float32(f)
+		c.RAG.MinSimilarity = &minSimilarity
+		return nil
+	}},
+	stringEnv("PROMPT_TEMPLATES_DIR", func(c *Config) *string { return &c.RAG.PromptTemplatesDir }),
+	stringEnv("EVAL_MODEL", func(c *Config) *string { return &c.Eval.Model }),
+	stringEnv("RAG_URL", func(c *Config) *string { return &c.Eval.RAGURL }),
+	durationEnv("EVAL_REQUEST_TIMEOUT", func(c *Config) *Duration { return &c.Eval.RequestTimeout }),
+}
+
+// Load returns the defaults, overridden by the JSON file at path (or at
+// $CONFIG_FILE if path is empty, no file if both are empty) and then by the
+// environment. The result is validated. If only the environment or the
+// validation fails, the configuration is returned along with the errors, so
+// it can still be printed.
+func Load(path string) (*Config, error) {
+	return load(path, os.Getenv)
+}
+
+func load(path string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+
+	if path == "" {
+		path = getenv(FileEnv)
+	}
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read config file: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	var errs []error
+	for _, env := range envVars {
+		if value := getenv(env.name); value != "" {
+			if err := env.apply(&cfg, value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return &cfg, errors.Join(errs...)
+}
+
+func validateURL(name, raw string, required bool) error {
+	if raw == "" {
+		if required {
+			return fmt.Errorf("%s is required", name)
+		}
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", name)
+	}
+	return nil
+}
+
+// Validate checks every setting and returns all problems at once. It checks
+// that the database URL parses if set, RequireDatabase checks that it is set,
+// as not every command needs it.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, msg string) {
+		if !ok {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout can't be negative")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout can't be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout can't be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout can't be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Database.MigrationsDir != "", "database.migrations_dir is required")
+	check(c.Database.MaxConns > 0, "database.max_conns must be a positive integer")
+	check(c.Database.MinConns >= 0 && c.Database.MinConns <= c.Database.MaxConns, "database.min_conns must be between 0 and database.max_conns")
+	check(c.Database.MaxConnLifetime > 0, "database.max_conn_lifetime must be positive")
+	check(c.Database.MaxConnIdleTime > 0, "database.max_conn_idle_time must be positive")
+	check(c.LLM.Model != "", "llm.model is required")
+	check(c.Embedding.Model != "", "embedding.model is required")
+	check(c.Embedding.BatchSize > 0, "embedding.batch_size must be a positive integer")
+	check(c.Embedding.Timeout > 0, "embedding.timeout must be positive")
+	check(c.Rerank.Model != "", "rerank.model is required")
+	check(c.RAG.ContextTokens > 0, "rag.context_tokens must be a positive integer")
+	check(c.RAG.ChunkSize > 0, "rag.chunk_size must be a positive integer")
+	check(c.RAG.MinSimilarity == nil || (*c.RAG.MinSimilarity >= -1 && *c.RAG.MinSimilarity <= 1), "rag.min_similarity must be between -1 and 1")
+	check(c.Eval.Model != "", "eval.model is required")
+	check(c.Eval.RequestTimeout > 0, "eval.request_timeout must be positive")
+
+	for _, err := range []error{
+		validateURL("llm.base_url", c.LLM.BaseURL, false),
+		validateURL("embedding.base_url", c.Embedding.BaseURL, true),
+		validateURL("rerank.base_url", c.Rerank.BaseURL, false),
+		validateURL("eval.rag_url", c.Eval.RAGURL, true),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Checked like db.Init parses it. The parse error isn't wrapped, it can
+	// quote the connection string.
+	if c.Database.URL != "" {
+		if _, err := pgxpool.ParseConfig(c.Database.URL); err != nil {
+			errs = append(errs, errors.New("database.url must be a postgres:// URL or a key=value connection string"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// RequireDatabase checks that a database URL is configured
+func (c Config) RequireDatabase() error {
+	if c.Database.URL == "" {
+		return errors.New("database.url (or DATABASE_URL) is required")
+	}
+	return nil
+}
+
+// databaseSecrets are the connection settings that hold a password
+var databaseSecrets = []string{"password", "sslpassword"}
+
+var dsnSecretRegex = regexp.MustCompile(`(?i)\b((?:ssl)?password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactDatabaseURL replaces the passwords of a postgres:// URL, in the user
+// info or the query, or of a key=value connection string by "xxxxx"
+func redactDatabaseURL(raw string) string {
+	if !strings.HasPrefix(raw, "postgres://") && !strings.HasPrefix(raw, "postgresql://") {
+		return dsnSecretRegex.ReplaceAllString(raw, "${1}xxxxx")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Redacted
+	}
+	query := u.Query()
+	redacted := false
+	for _, name := range databaseSecrets {
+		if query.Has(name) {
+			query.Set(name, "xxxxx")
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// Redact returns a copy of the configuration without secrets. The database
+// URL keeps everything but the passwords, which are replaced by "xxxxx".
+func (c Config) Redact() Config {
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return Redacted
+	}
+
+	c.LLM.APIKey = redact(c.LLM.APIKey)
+	c.Rerank.APIKey = redact(c.Rerank.APIKey)
+	c.Database.URL = redactDatabaseURL(c.Database.URL)
+	return c
+}
+
+// Print writes the redacted configuration as indented JSON
+func (c Config) Print(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(c.Redact())
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pgvector/pgvector-go"
 )
 
@@ -17,10 +18,82 @@ var (
 	ErrBatchAlreadyClosed = errors.New("batch already closed")
 )
 
+const createBookChapters = `-- name: CreateBookChapters :batchexec
+INSERT INTO rag.book_chapter (
+    book_id, ordinal, title, start_rune, end_rune
+)
+VALUES (
+    $1, $2, $3, $4, $5
+)
+`
+
+type CreateBookChaptersBatchResults struct {
+	br     pgx.BatchResults
+	tot    int
+	closed bool
+}
+
+type CreateBookChaptersParams struct {
+	BookID    int64
+	Ordinal   int32
+	Title     string
+	StartRune int32
+	EndRune   int32
+}
+
+func (q *Queries) CreateBookChapters(ctx context.Context, arg []CreateBookChaptersParams) *CreateBookChaptersBatchResults {
+	batch := &pgx.Batch{}
+	for _, a := range arg {
+		vals := []interface{}{
+			a.BookID,
+			a.Ordinal,
+			a.Title,
+			a.StartRune,
+			a.EndRune,
+		}
+		batch.Queue(createBookChapters, vals...)
+	}
+	br := q.db.SendBatch(ctx, batch)
+	return &CreateBookChaptersBatchResults{br, len(arg), false}
+}
+
+func (b *CreateBookChaptersBatchResults) Exec(f func(int, error)) {
+	defer b.br.Close()
+	for t := 0; t < b.tot; t++ {
+		if b.closed {
+			if f != nil {
+				f(t, ErrBatchAlreadyClosed)
+			}
+			continue
+		}
+		_, err := b.br.Exec()
+		if f != nil {
+			f(t, err)
+		}
+	}
+}
+
+func (b *CreateBookChaptersBatchResults) Close() error {
+	b.closed = true
+	return b.br.Close()
+}
+
 const createBookPassages = `-- name: CreateBookPassages :batchexec
-INSERT INTO rag.book_passage (book_id, passage_text, embedding)
+INSERT INTO rag.book_passage (
+    book_id,
+    passage_text,
+    embedding,
+    ordinal,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    injection_flags
+)
 VALUES (
-    $1, $2, $3
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
 )
 `
 
@@ -31,9 +104,17 @@ type CreateBookPassagesBatchResults struct {
 }
 
 type CreateBookPassagesParams struct {
-	BookID      int64
-	PassageText string
-	Embedding   pgvector.Vector
+	BookID         int64
+	PassageText    string
+	Embedding      pgvector.Vector
+	Ordinal        int32
+	StartByte      pgtype.Int4
+	EndByte        pgtype.Int4
+	StartRune      pgtype.Int4
+	EndRune        pgtype.Int4
+	StartLine      pgtype.Int4
+	EndLine        pgtype.Int4
+	InjectionFlags []string
 }
 
 func (q *Queries) CreateBookPassages(ctx context.Context, arg []CreateBookPassagesParams) *CreateBookPassagesBatchResults {
@@ -43,6 +124,14 @@ func (q *Queries) CreateBookPassages(ctx context.Context, arg []CreateBookPassag
 			a.BookID,
 			a.PassageText,
 			a.Embedding,
+			a.Ordinal,
+			a.StartByte,
+			a.EndByte,
+			a.StartRune,
+			a.EndRune,
+			a.StartLine,
+			a.EndLine,
+			a.InjectionFlags,
 		}
 		batch.Queue(createBookPassages, vals...)
 	}
@@ -70,3 +159,172 @@ func (b *CreateBookPassagesBatchResults) Close() error {
 	b.closed = true
 	return b.br.Close()
 }
+
+const createPassageEntities = `-- name: CreatePassageEntities :batchexec
+INSERT INTO rag.passage_entity (passage_id, entity_id, mention_count)
+VALUES (
+    $1, $2, $3
+)
+`
+
+type CreatePassageEntitiesBatchResults struct {
+	br     pgx.BatchResults
+	tot    int
+	closed bool
+}
+
+type CreatePassageEntitiesParams struct {
+	PassageID    int64
+	EntityID     int64
+	MentionCount int32
+}
+
+func (q *Queries) CreatePassageEntities(ctx context.Context, arg []CreatePassageEntitiesParams) *CreatePassageEntitiesBatchResults {
+	batch := &pgx.Batch{}
+	for _, a := range arg {
+		vals := []interface{}{
+			a.PassageID,
+			a.EntityID,
+			a.MentionCount,
+		}
+		batch.Queue(createPassageEntities, vals...)
+	}
+	br := q.db.SendBatch(ctx, batch)
+	return &CreatePassageEntitiesBatchResults{br, len(arg), false}
+}
+
+func (b *CreatePassageEntitiesBatchResults) Exec(f func(int, error)) {
+	defer b.br.Close()
+	for t := 0; t < b.tot; t++ {
+		if b.closed {
+			if f != nil {
+				f(t, ErrBatchAlreadyClosed)
+			}
+			continue
+		}
+		_, err := b.br.Exec()
+		if f != nil {
+			f(t, err)
+		}
+	}
+}
+
+func (b *CreatePassageEntitiesBatchResults) Close() error {
+	b.closed = true
+	return b.br.Close()
+}
+
+const createTimelineEvents = `-- name: CreateTimelineEvents :batchexec
+INSERT INTO rag.timeline_event (
+    book_id, position, scope, unit_ordinal, unit_title, description, passage_ids
+)
+VALUES (
+    $1, $2, $3, $4, $5, $6, $7
+)
+`
+
+type CreateTimelineEventsBatchResults struct {
+	br     pgx.BatchResults
+	tot    int
+	closed bool
+}
+
+type CreateTimelineEventsParams struct {
+	BookID      int64
+	Position    int32
+	Scope       string
+	UnitOrdinal int32
+	UnitTitle   string
+	Description string
+	PassageIds  []int64
+}
+
+func (q *Queries) CreateTimelineEvents(ctx context.Context, arg []CreateTimelineEventsParams) *CreateTimelineEventsBatchResults {
+	batch := &pgx.Batch{}
+	for _, a := range arg {
+		vals := []interface{}{
+			a.BookID,
+			a.Position,
+			a.Scope,
+			a.UnitOrdinal,
+			a.UnitTitle,
+			a.Description,
+			a.PassageIds,
+		}
+		batch.Queue(createTimelineEvents, vals...)
+	}
+	br := q.db.SendBatch(ctx, batch)
+	return &CreateTimelineEventsBatchResults{br, len(arg), false}
+}
+
+func (b *CreateTimelineEventsBatchResults) Exec(f func(int, error)) {
+	defer b.br.Close()
+	for t := 0; t < b.tot; t++ {
+		if b.closed {
+			if f != nil {
+				f(t, ErrBatchAlreadyClosed)
+			}
+			continue
+		}
+		_, err := b.br.Exec()
+		if f != nil {
+			f(t, err)
+		}
+	}
+}
+
+func (b *CreateTimelineEventsBatchResults) Close() error {
+	b.closed = true
+	return b.br.Close()
+}
+
+const updatePassageInjectionFlags = `-- name: UpdatePassageInjectionFlags :batchexec
+UPDATE rag.book_passage
+SET injection_flags = $2
+WHERE id = $1
+`
+
+type UpdatePassageInjectionFlagsBatchResults struct {
+	br     pgx.BatchResults
+	tot    int
+	closed bool
+}
+
+type UpdatePassageInjectionFlagsParams struct {
+	ID             int64
+	InjectionFlags []string
+}
+
+func (q *Queries) UpdatePassageInjectionFlags(ctx context.Context, arg []UpdatePassageInjectionFlagsParams) *UpdatePassageInjectionFlagsBatchResults {
+	batch := &pgx.Batch{}
+	for _, a := range arg {
+		vals := []interface{}{
+			a.ID,
+			a.InjectionFlags,
+		}
+		batch.Queue(updatePassageInjectionFlags, vals...)
+	}
+	br := q.db.SendBatch(ctx, batch)
+	return &UpdatePassageInjectionFlagsBatchResults{br, len(arg), false}
+}
+
+func (b *UpdatePassageInjectionFlagsBatchResults) Exec(f func(int, error)) {
+	defer b.br.Close()
+	for t := 0; t < b.tot; t++ {
+		if b.closed {
+			if f != nil {
+				f(t, ErrBatchAlreadyClosed)
+			}
+			continue
+		}
+		_, err := b.br.Exec()
+		if f != nil {
+			f(t, err)
+		}
+	}
+}
+
+func (b *UpdatePassageInjectionFlagsBatchResults) Close() error {
+	b.closed = true
+	return b.br.Close()
+}
@@ -5,18 +5,96 @@
 package data
 
 import (
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pgvector/pgvector-go"
 )
 
 type RagBook struct {
-	ID       int64
-	BookName string
-	BookText string
+	ID           int64
+	BookName     string
+	BookText     string
+	Author       string
+	Tags         []string
+	PromptPreset string
+}
+
+type RagBookChapter struct {
+	ID        int64
+	BookID    int64
+	Ordinal   int32
+	Title     string
+	StartRune int32
+	EndRune   int32
 }
 
 type RagBookPassage struct {
+	ID             int64
+	BookID         int64
+	PassageText    string
+	Embedding      pgvector.Vector
+	Ordinal        int32
+	StartByte      pgtype.Int4
+	EndByte        pgtype.Int4
+	StartRune      pgtype.Int4
+	EndRune        pgtype.Int4
+	StartLine      pgtype.Int4
+	EndLine        pgtype.Int4
+	InjectionFlags []string
+}
+
+type RagConversation struct {
+	ID        int64
+	BookID    int64
+	CreatedAt pgtype.Timestamptz
+}
+
+type RagConversationMessage struct {
+	ID              int64
+	ConversationID  int64
+	Role            string
+	Content         string
+	StandaloneQuery string
+	CitedPassageIds []int64
+	CreatedAt       pgtype.Timestamptz
+}
+
+type RagEntity struct {
+	ID           int64
+	BookID       int64
+	Name         string
+	Kind         string
+	Aliases      []string
+	MentionCount int32
+}
+
+type RagPassageEntity struct {
+	PassageID    int64
+	EntityID     int64
+	MentionCount int32
+}
+
+type RagSummary struct {
+	ID           int64
+	BookID       int64
+	Scope        string
+	UnitOrdinal  int32
+	Title        string
+	StartOrdinal int32
+	EndOrdinal   int32
+	Length       string
+	Focus        string
+	Summary      string
+	CreatedAt    pgtype.Timestamptz
+}
+
+type RagTimelineEvent struct {
 	ID          int64
 	BookID      int64
-	PassageText string
-	Embedding   pgvector.Vector
+	Position    int32
+	Scope       string
+	UnitOrdinal int32
+	UnitTitle   string
+	Description string
+	PassageIds  []int64
+	CreatedAt   pgtype.Timestamptz
 }
@@ -8,6 +8,7 @@ package data
 import (
 	"context"
 
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pgvector/pgvector-go"
 )
 
@@ -23,25 +24,190 @@ func (q *Queries) BookExists(ctx context.Context, id int64) (bool, error) {
 }
 
 const createBook = `-- name: CreateBook :one
-INSERT INTO rag.book (book_name, book_text)
+INSERT INTO rag.book (book_name, book_text, author, tags, prompt_preset)
 VALUES (
-    $1, $2
+    $1, $2, $3, $4, $5
 )
-RETURNING id, book_name, book_text
+RETURNING id, book_name, book_text, author, tags, prompt_preset
 `
 
 type CreateBookParams struct {
-	BookName string
-	BookText string
+	BookName     string
+	BookText     string
+	Author       string
+	Tags         []string
+	PromptPreset string
 }
 
 func (q *Queries) CreateBook(ctx context.Context, arg CreateBookParams) (RagBook, error) {
-	row := q.db.QueryRow(ctx, createBook, arg.BookName, arg.BookText)
+	row := q.db.QueryRow(ctx, createBook,
+		arg.BookName,
+		arg.BookText,
+		arg.Author,
+		arg.Tags,
+		arg.PromptPreset,
+	)
 	var i RagBook
-	err := row.Scan(&i.ID, &i.BookName, &i.BookText)
+	err := row.Scan(
+		&i.ID,
+		&i.BookName,
+		&i.BookText,
+		&i.Author,
+		&i.Tags,
+		&i.PromptPreset,
+	)
 	return i, err
 }
 
+const createConversation = `-- name: CreateConversation :one
+INSERT INTO rag.conversation (book_id)
+VALUES ($1)
+RETURNING id, book_id, created_at
+`
+
+func (q *Queries) CreateConversation(ctx context.Context, bookID int64) (RagConversation, error) {
+	row := q.db.QueryRow(ctx, createConversation, bookID)
+	var i RagConversation
+	err := row.Scan(&i.ID, &i.BookID, &i.CreatedAt)
+	return i, err
+}
+
+const createConversationMessage = `-- name: CreateConversationMessage :one
+INSERT INTO rag.conversation_message (
+    conversation_id, role, content, standalone_query, cited_passage_ids
+)
+VALUES (
+    $1, $2, $3, $4, $5
+)
+RETURNING id, conversation_id, role, content, standalone_query, cited_passage_ids, created_at
+`
+
+type CreateConversationMessageParams struct {
+	ConversationID  int64
+	Role            string
+	Content         string
+	StandaloneQuery string
+	CitedPassageIds []int64
+}
+
+func (q *Queries) CreateConversationMessage(ctx context.Context, arg CreateConversationMessageParams) (RagConversationMessage, error) {
+	row := q.db.QueryRow(ctx, createConversationMessage,
+		arg.ConversationID,
+		arg.Role,
+		arg.Content,
+		arg.StandaloneQuery,
+		arg.CitedPassageIds,
+	)
+	var i RagConversationMessage
+	err := row.Scan(
+		&i.ID,
+		&i.ConversationID,
+		&i.Role,
+		&i.Content,
+		&i.StandaloneQuery,
+		&i.CitedPassageIds,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createEntity = `-- name: CreateEntity :one
+INSERT INTO rag.entity (book_id, name, kind, aliases, mention_count)
+VALUES (
+    $1, $2, $3, $4, $5
+)
+RETURNING id
+`
+
+type CreateEntityParams struct {
+	BookID       int64
+	Name         string
+	Kind         string
+	Aliases      []string
+	MentionCount int32
+}
+
+func (q *Queries) CreateEntity(ctx context.Context, arg CreateEntityParams) (int64, error) {
+	row := q.db.QueryRow(ctx, createEntity,
+		arg.BookID,
+		arg.Name,
+		arg.Kind,
+		arg.Aliases,
+		arg.MentionCount,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const deleteBookEntities = `-- name: DeleteBookEntities :exec
+DELETE FROM rag.entity
+WHERE book_id = $1
+`
+
+func (q *Queries) DeleteBookEntities(ctx context.Context, bookID int64) error {
+	_, err := q.db.Exec(ctx, deleteBookEntities, bookID)
+	return err
+}
+
+const deleteTimelineEvents = `-- name: DeleteTimelineEvents :exec
+DELETE FROM rag.timeline_event
+WHERE book_id = $1
+`
+
+func (q *Queries) DeleteTimelineEvents(ctx context.Context, bookID int64) error {
+	_, err := q.db.Exec(ctx, deleteTimelineEvents, bookID)
+	return err
+}
+
+const findEntitiesByName = `-- name: FindEntitiesByName :many
+SELECT
+    id,
+    name,
+    aliases
+FROM rag.entity
+WHERE
+    book_id = $1
+    AND (
+        LOWER(name) = ANY($2::TEXT [])
+        OR EXISTS (
+            SELECT 1 FROM UNNEST(aliases) AS alias
+            WHERE LOWER(alias) = ANY($2::TEXT [])
+        )
+    )
+`
+
+type FindEntitiesByNameParams struct {
+	BookID int64
+	Names  []string
+}
+
+type FindEntitiesByNameRow struct {
+	ID      int64
+	Name    string
+	Aliases []string
+}
+
+func (q *Queries) FindEntitiesByName(ctx context.Context, arg FindEntitiesByNameParams) ([]FindEntitiesByNameRow, error) {
+	rows, err := q.db.Query(ctx, findEntitiesByName, arg.BookID, arg.Names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FindEntitiesByNameRow
+	for rows.Next() {
+		var i FindEntitiesByNameRow
+		if err := rows.Scan(&i.ID, &i.Name, &i.Aliases); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getAllBookPassages = `-- name: GetAllBookPassages :many
 SELECT
     id,
@@ -76,6 +242,164 @@ func (q *Queries) GetAllBookPassages(ctx context.Context) ([]GetAllBookPassagesR
 	return items, nil
 }
 
+const getBook = `-- name: GetBook :one
+SELECT
+    id,
+    book_name,
+    author,
+    tags,
+    prompt_preset
+FROM rag.book
+WHERE id = $1
+`
+
+type GetBookRow struct {
+	ID           int64
+	BookName     string
+	Author       string
+	Tags         []string
+	PromptPreset string
+}
+
+func (q *Queries) GetBook(ctx context.Context, id int64) (GetBookRow, error) {
+	row := q.db.QueryRow(ctx, getBook, id)
+	var i GetBookRow
+	err := row.Scan(
+		&i.ID,
+		&i.BookName,
+		&i.Author,
+		&i.Tags,
+		&i.PromptPreset,
+	)
+	return i, err
+}
+
+const getBookChapter = `-- name: GetBookChapter :one
+SELECT
+    ordinal,
+    title,
+    start_rune,
+    end_rune
+FROM rag.book_chapter
+WHERE book_id = $1 AND ordinal = $2
+`
+
+type GetBookChapterParams struct {
+	BookID  int64
+	Ordinal int32
+}
+
+type GetBookChapterRow struct {
+	Ordinal   int32
+	Title     string
+	StartRune int32
+	EndRune   int32
+}
+
+func (q *Queries) GetBookChapter(ctx context.Context, arg GetBookChapterParams) (GetBookChapterRow, error) {
+	row := q.db.QueryRow(ctx, getBookChapter, arg.BookID, arg.Ordinal)
+	var i GetBookChapterRow
+	err := row.Scan(
+		&i.Ordinal,
+		&i.Title,
+		&i.StartRune,
+		&i.EndRune,
+	)
+	return i, err
+}
+
+const getBookChapters = `-- name: GetBookChapters :many
+SELECT
+    ordinal,
+    title,
+    start_rune,
+    end_rune
+FROM rag.book_chapter
+WHERE book_id = $1
+ORDER BY ordinal
+`
+
+type GetBookChaptersRow struct {
+	Ordinal   int32
+	Title     string
+	StartRune int32
+	EndRune   int32
+}
+
+func (q *Queries) GetBookChapters(ctx context.Context, bookID int64) ([]GetBookChaptersRow, error) {
+	rows, err := q.db.Query(ctx, getBookChapters, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetBookChaptersRow
+	for rows.Next() {
+		var i GetBookChaptersRow
+		if err := rows.Scan(
+			&i.Ordinal,
+			&i.Title,
+			&i.StartRune,
+			&i.EndRune,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getBookPassage = `-- name: GetBookPassage :one
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE book_id = $1 AND id = $2
+`
+
+type GetBookPassageParams struct {
+	BookID int64
+	ID     int64
+}
+
+type GetBookPassageRow struct {
+	ID          int64
+	Ordinal     int32
+	PassageText string
+	StartByte   pgtype.Int4
+	EndByte     pgtype.Int4
+	StartRune   pgtype.Int4
+	EndRune     pgtype.Int4
+	StartLine   pgtype.Int4
+	EndLine     pgtype.Int4
+}
+
+func (q *Queries) GetBookPassage(ctx context.Context, arg GetBookPassageParams) (GetBookPassageRow, error) {
+	row := q.db.QueryRow(ctx, getBookPassage, arg.BookID, arg.ID)
+	var i GetBookPassageRow
+	err := row.Scan(
+		&i.ID,
+		&i.Ordinal,
+		&i.PassageText,
+		&i.StartByte,
+		&i.EndByte,
+		&i.StartRune,
+		&i.EndRune,
+		&i.StartLine,
+		&i.EndLine,
+	)
+	return i, err
+}
+
 const getBookPassages = `-- name: GetBookPassages :many
 SELECT
     id,
@@ -111,16 +435,486 @@ func (q *Queries) GetBookPassages(ctx context.Context, bookID int64) ([]GetBookP
 	return items, nil
 }
 
+const getBookText = `-- name: GetBookText :one
+SELECT book_text
+FROM rag.book
+WHERE id = $1
+`
+
+func (q *Queries) GetBookText(ctx context.Context, id int64) (string, error) {
+	row := q.db.QueryRow(ctx, getBookText, id)
+	var book_text string
+	err := row.Scan(&book_text)
+	return book_text, err
+}
+
+const getBookTextSpan = `-- name: GetBookTextSpan :one
+SELECT
+    CAST(
+        SUBSTRING(
+            book_text
+            FROM $2::INTEGER + 1
+            FOR $3::INTEGER
+        ) AS TEXT
+    ) AS span_text,
+    CAST(LENGTH(book_text) AS INTEGER) AS text_length
+FROM rag.book
+WHERE id = $1
+`
+
+type GetBookTextSpanParams struct {
+	ID         int64
+	StartRune  int32
+	SpanLength int32
+}
+
+type GetBookTextSpanRow struct {
+	SpanText   string
+	TextLength int32
+}
+
+func (q *Queries) GetBookTextSpan(ctx context.Context, arg GetBookTextSpanParams) (GetBookTextSpanRow, error) {
+	row := q.db.QueryRow(ctx, getBookTextSpan, arg.ID, arg.StartRune, arg.SpanLength)
+	var i GetBookTextSpanRow
+	err := row.Scan(&i.SpanText, &i.TextLength)
+	return i, err
+}
+
+const getConversation = `-- name: GetConversation :one
+SELECT id, book_id, created_at
+FROM rag.conversation
+WHERE id = $1
+`
+
+func (q *Queries) GetConversation(ctx context.Context, id int64) (RagConversation, error) {
+	row := q.db.QueryRow(ctx, getConversation, id)
+	var i RagConversation
+	err := row.Scan(&i.ID, &i.BookID, &i.CreatedAt)
+	return i, err
+}
+
+const getEntityCooccurrences = `-- name: GetEntityCooccurrences :many
+SELECT
+    a.entity_id AS source_id,
+    b.entity_id AS target_id,
+    CAST(COUNT(*) AS INTEGER) AS weight,
+    CAST(ARRAY_AGG(a.passage_id ORDER BY a.passage_id) AS BIGINT []) AS passage_ids
+FROM rag.passage_entity AS a
+INNER JOIN rag.passage_entity AS b
+    ON a.passage_id = b.passage_id AND a.entity_id < b.entity_id
+INNER JOIN rag.entity AS ea ON a.entity_id = ea.id
+INNER JOIN rag.entity AS eb ON b.entity_id = eb.id
+WHERE
+    ea.book_id = $1
+    AND ($2::TEXT = '' OR (ea.kind = $2::TEXT AND eb.kind = $2::TEXT))
+GROUP BY a.entity_id, b.entity_id
+HAVING COUNT(*) >= $3::INTEGER
+ORDER BY weight DESC, source_id, target_id
+`
+
+type GetEntityCooccurrencesParams struct {
+	BookID    int64
+	Kind      string
+	MinWeight int32
+}
+
+type GetEntityCooccurrencesRow struct {
+	SourceID   int64
+	TargetID   int64
+	Weight     int32
+	PassageIds []int64
+}
+
+func (q *Queries) GetEntityCooccurrences(ctx context.Context, arg GetEntityCooccurrencesParams) ([]GetEntityCooccurrencesRow, error) {
+	rows, err := q.db.Query(ctx, getEntityCooccurrences, arg.BookID, arg.Kind, arg.MinWeight)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetEntityCooccurrencesRow
+	for rows.Next() {
+		var i GetEntityCooccurrencesRow
+		if err := rows.Scan(
+			&i.SourceID,
+			&i.TargetID,
+			&i.Weight,
+			&i.PassageIds,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getFlaggedPassages = `-- name: GetFlaggedPassages :many
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    injection_flags,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE book_id = $1 AND CARDINALITY(injection_flags) > 0
+ORDER BY ordinal
+`
+
+type GetFlaggedPassagesRow struct {
+	ID             int64
+	Ordinal        int32
+	PassageText    string
+	InjectionFlags []string
+	StartByte      pgtype.Int4
+	EndByte        pgtype.Int4
+	StartRune      pgtype.Int4
+	EndRune        pgtype.Int4
+	StartLine      pgtype.Int4
+	EndLine        pgtype.Int4
+}
+
+func (q *Queries) GetFlaggedPassages(ctx context.Context, bookID int64) ([]GetFlaggedPassagesRow, error) {
+	rows, err := q.db.Query(ctx, getFlaggedPassages, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetFlaggedPassagesRow
+	for rows.Next() {
+		var i GetFlaggedPassagesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Ordinal,
+			&i.PassageText,
+			&i.InjectionFlags,
+			&i.StartByte,
+			&i.EndByte,
+			&i.StartRune,
+			&i.EndRune,
+			&i.StartLine,
+			&i.EndLine,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLastPassageOrdinalBefore = `-- name: GetLastPassageOrdinalBefore :one
+SELECT CAST(COALESCE(MAX(ordinal), -1) AS INTEGER) AS max_ordinal
+FROM rag.book_passage
+WHERE book_id = $1 AND end_rune <= $2::INTEGER
+`
+
+type GetLastPassageOrdinalBeforeParams struct {
+	BookID     int64
+	OffsetRune int32
+}
+
+func (q *Queries) GetLastPassageOrdinalBefore(ctx context.Context, arg GetLastPassageOrdinalBeforeParams) (int32, error) {
+	row := q.db.QueryRow(ctx, getLastPassageOrdinalBefore, arg.BookID, arg.OffsetRune)
+	var max_ordinal int32
+	err := row.Scan(&max_ordinal)
+	return max_ordinal, err
+}
+
+const getPassagesByIDs = `-- name: GetPassagesByIDs :many
+SELECT
+    id,
+    book_id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE id = ANY($1::BIGINT [])
+ORDER BY id
+`
+
+type GetPassagesByIDsRow struct {
+	ID          int64
+	BookID      int64
+	Ordinal     int32
+	PassageText string
+	StartByte   pgtype.Int4
+	EndByte     pgtype.Int4
+	StartRune   pgtype.Int4
+	EndRune     pgtype.Int4
+	StartLine   pgtype.Int4
+	EndLine     pgtype.Int4
+}
+
+func (q *Queries) GetPassagesByIDs(ctx context.Context, ids []int64) ([]GetPassagesByIDsRow, error) {
+	rows, err := q.db.Query(ctx, getPassagesByIDs, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPassagesByIDsRow
+	for rows.Next() {
+		var i GetPassagesByIDsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.BookID,
+			&i.Ordinal,
+			&i.PassageText,
+			&i.StartByte,
+			&i.EndByte,
+			&i.StartRune,
+			&i.EndRune,
+			&i.StartLine,
+			&i.EndLine,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPassagesInRange = `-- name: GetPassagesInRange :many
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    injection_flags
+FROM rag.book_passage
+WHERE
+    book_id = $1
+    AND ordinal BETWEEN $2 AND $3
+ORDER BY ordinal
+`
+
+type GetPassagesInRangeParams struct {
+	BookID       int64
+	StartOrdinal int32
+	EndOrdinal   int32
+}
+
+type GetPassagesInRangeRow struct {
+	ID             int64
+	Ordinal        int32
+	PassageText    string
+	StartByte      pgtype.Int4
+	EndByte        pgtype.Int4
+	StartRune      pgtype.Int4
+	EndRune        pgtype.Int4
+	StartLine      pgtype.Int4
+	EndLine        pgtype.Int4
+	InjectionFlags []string
+}
+
+func (q *Queries) GetPassagesInRange(ctx context.Context, arg GetPassagesInRangeParams) ([]GetPassagesInRangeRow, error) {
+	rows, err := q.db.Query(ctx, getPassagesInRange, arg.BookID, arg.StartOrdinal, arg.EndOrdinal)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPassagesInRangeRow
+	for rows.Next() {
+		var i GetPassagesInRangeRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Ordinal,
+			&i.PassageText,
+			&i.StartByte,
+			&i.EndByte,
+			&i.StartRune,
+			&i.EndRune,
+			&i.StartLine,
+			&i.EndLine,
+			&i.InjectionFlags,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSummaries = `-- name: GetSummaries :many
+SELECT id, book_id, scope, unit_ordinal, title, start_ordinal, end_ordinal, length, focus, summary, created_at
+FROM rag.summary
+WHERE book_id = $1 AND length = $2 AND focus = $3
+ORDER BY scope = 'book', unit_ordinal
+`
+
+type GetSummariesParams struct {
+	BookID int64
+	Length string
+	Focus  string
+}
+
+func (q *Queries) GetSummaries(ctx context.Context, arg GetSummariesParams) ([]RagSummary, error) {
+	rows, err := q.db.Query(ctx, getSummaries, arg.BookID, arg.Length, arg.Focus)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RagSummary
+	for rows.Next() {
+		var i RagSummary
+		if err := rows.Scan(
+			&i.ID,
+			&i.BookID,
+			&i.Scope,
+			&i.UnitOrdinal,
+			&i.Title,
+			&i.StartOrdinal,
+			&i.EndOrdinal,
+			&i.Length,
+			&i.Focus,
+			&i.Summary,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTimelineEvents = `-- name: GetTimelineEvents :many
+SELECT id, book_id, position, scope, unit_ordinal, unit_title, description, passage_ids, created_at
+FROM rag.timeline_event
+WHERE book_id = $1
+ORDER BY position
+`
+
+func (q *Queries) GetTimelineEvents(ctx context.Context, bookID int64) ([]RagTimelineEvent, error) {
+	rows, err := q.db.Query(ctx, getTimelineEvents, bookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RagTimelineEvent
+	for rows.Next() {
+		var i RagTimelineEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.BookID,
+			&i.Position,
+			&i.Scope,
+			&i.UnitOrdinal,
+			&i.UnitTitle,
+			&i.Description,
+			&i.PassageIds,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listBookEntities = `-- name: ListBookEntities :many
+SELECT
+    e.id,
+    e.name,
+    e.kind,
+    e.aliases,
+    e.mention_count,
+    CAST(COUNT(pe.passage_id) AS INTEGER) AS passage_count
+FROM rag.entity AS e
+LEFT JOIN rag.passage_entity AS pe ON e.id = pe.entity_id
+WHERE
+    e.book_id = $1
+    AND ($2::TEXT = '' OR e.kind = $2::TEXT)
+GROUP BY e.id
+ORDER BY e.mention_count DESC, e.name
+`
+
+type ListBookEntitiesParams struct {
+	BookID int64
+	Kind   string
+}
+
+type ListBookEntitiesRow struct {
+	ID           int64
+	Name         string
+	Kind         string
+	Aliases      []string
+	MentionCount int32
+	PassageCount int32
+}
+
+func (q *Queries) ListBookEntities(ctx context.Context, arg ListBookEntitiesParams) ([]ListBookEntitiesRow, error) {
+	rows, err := q.db.Query(ctx, listBookEntities, arg.BookID, arg.Kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListBookEntitiesRow
+	for rows.Next() {
+		var i ListBookEntitiesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Kind,
+			&i.Aliases,
+			&i.MentionCount,
+			&i.PassageCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listBooks = `-- name: ListBooks :many
 SELECT
     id,
-    book_name
+    book_name,
+    author,
+    tags,
+    prompt_preset
 FROM rag.book
 `
 
 type ListBooksRow struct {
-	ID       int64
-	BookName string
+	ID           int64
+	BookName     string
+	Author       string
+	Tags         []string
+	PromptPreset string
 }
 
 func (q *Queries) ListBooks(ctx context.Context) ([]ListBooksRow, error) {
@@ -132,7 +926,48 @@ func (q *Queries) ListBooks(ctx context.Context) ([]ListBooksRow, error) {
 	var items []ListBooksRow
 	for rows.Next() {
 		var i ListBooksRow
-		if err := rows.Scan(&i.ID, &i.BookName); err != nil {
+		if err := rows.Scan(
+			&i.ID,
+			&i.BookName,
+			&i.Author,
+			&i.Tags,
+			&i.PromptPreset,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listConversationMessages = `-- name: ListConversationMessages :many
+SELECT id, conversation_id, role, content, standalone_query, cited_passage_ids, created_at
+FROM rag.conversation_message
+WHERE conversation_id = $1
+ORDER BY id
+`
+
+func (q *Queries) ListConversationMessages(ctx context.Context, conversationID int64) ([]RagConversationMessage, error) {
+	rows, err := q.db.Query(ctx, listConversationMessages, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RagConversationMessage
+	for rows.Next() {
+		var i RagConversationMessage
+		if err := rows.Scan(
+			&i.ID,
+			&i.ConversationID,
+			&i.Role,
+			&i.Content,
+			&i.StandaloneQuery,
+			&i.CitedPassageIds,
+			&i.CreatedAt,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -146,28 +981,73 @@ func (q *Queries) ListBooks(ctx context.Context) ([]ListBooksRow, error) {
 const queryBook = `-- name: QueryBook :many
 SELECT
     id,
+    ordinal,
     passage_text,
-    CAST(1 - (embedding <=> $2) AS REAL) AS similarity
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    embedding,
+    CAST(1 - (embedding <=> $1) AS REAL) AS similarity
 FROM rag.book_passage
-WHERE book_id = $1
-ORDER BY embedding <=> $2
-LIMIT $3
+WHERE
+    book_id = $2
+    -- Reading position, only passages up to this ordinal if set
+    AND (
+        $3::INTEGER IS NULL
+        OR ordinal <= $3::INTEGER
+    )
+    -- Entity filter, only passages mentioning one of the entities if set
+    AND (
+        CARDINALITY($4::BIGINT []) = 0
+        OR id IN (
+            SELECT passage_id FROM rag.passage_entity
+            WHERE entity_id = ANY($4::BIGINT [])
+        )
+    )
+    -- Leave out passages flagged by the prompt-injection scanner if set
+    AND (
+        NOT $5::BOOLEAN
+        OR CARDINALITY(injection_flags) = 0
+    )
+ORDER BY embedding <=> $1
+LIMIT $6
 `
 
 type QueryBookParams struct {
-	BookID    int64
-	Embedding pgvector.Vector
-	Limit     int32
+	Embedding      pgvector.Vector
+	BookID         int64
+	MaxOrdinal     pgtype.Int4
+	EntityIds      []int64
+	ExcludeFlagged bool
+	Limit          int32
 }
 
 type QueryBookRow struct {
 	ID          int64
+	Ordinal     int32
 	PassageText string
+	StartByte   pgtype.Int4
+	EndByte     pgtype.Int4
+	StartRune   pgtype.Int4
+	EndRune     pgtype.Int4
+	StartLine   pgtype.Int4
+	EndLine     pgtype.Int4
+	Embedding   pgvector.Vector
 	Similarity  float32
 }
 
 func (q *Queries) QueryBook(ctx context.Context, arg QueryBookParams) ([]QueryBookRow, error) {
-	rows, err := q.db.Query(ctx, queryBook, arg.BookID, arg.Embedding, arg.Limit)
+	rows, err := q.db.Query(ctx, queryBook,
+		arg.Embedding,
+		arg.BookID,
+		arg.MaxOrdinal,
+		arg.EntityIds,
+		arg.ExcludeFlagged,
+		arg.Limit,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -175,7 +1055,147 @@ func (q *Queries) QueryBook(ctx context.Context, arg QueryBookParams) ([]QueryBo
 	var items []QueryBookRow
 	for rows.Next() {
 		var i QueryBookRow
-		if err := rows.Scan(&i.ID, &i.PassageText, &i.Similarity); err != nil {
+		if err := rows.Scan(
+			&i.ID,
+			&i.Ordinal,
+			&i.PassageText,
+			&i.StartByte,
+			&i.EndByte,
+			&i.StartRune,
+			&i.EndRune,
+			&i.StartLine,
+			&i.EndLine,
+			&i.Embedding,
+			&i.Similarity,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const searchLibrary = `-- name: SearchLibrary :many
+SELECT
+    id,
+    book_id,
+    book_name,
+    author,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    similarity
+FROM (
+    SELECT
+        bp.id,
+        bp.book_id,
+        b.book_name,
+        b.author,
+        bp.ordinal,
+        bp.passage_text,
+        bp.start_byte,
+        bp.end_byte,
+        bp.start_rune,
+        bp.end_rune,
+        bp.start_line,
+        bp.end_line,
+        CAST(1 - (bp.embedding <=> $1) AS REAL) AS similarity,
+        ROW_NUMBER() OVER (
+            PARTITION BY bp.book_id
+            ORDER BY bp.embedding <=> $1
+        ) AS book_rank
+    FROM rag.book_passage AS bp
+    INNER JOIN rag.book AS b ON bp.book_id = b.id
+    WHERE
+        (
+            CARDINALITY($2::BIGINT []) = 0
+            OR bp.book_id = ANY($2::BIGINT [])
+        )
+        AND (
+            CARDINALITY($3::TEXT []) = 0
+            OR b.tags && $3::TEXT []
+        )
+        AND (
+            $4::TEXT = ''
+            OR b.author ILIKE '%' || $4::TEXT || '%'
+        )
+        -- Leave out passages flagged by the prompt-injection scanner if set
+        AND (
+            NOT $5::BOOLEAN
+            OR CARDINALITY(bp.injection_flags) = 0
+        )
+) AS ranked
+WHERE book_rank <= $6::INTEGER
+ORDER BY similarity DESC
+LIMIT $7::INTEGER
+`
+
+type SearchLibraryParams struct {
+	Embedding      pgvector.Vector
+	BookIds        []int64
+	Tags           []string
+	Author         string
+	ExcludeFlagged bool
+	PerBookLimit   int32
+	MaxResults     int32
+}
+
+type SearchLibraryRow struct {
+	ID          int64
+	BookID      int64
+	BookName    string
+	Author      string
+	Ordinal     int32
+	PassageText string
+	StartByte   pgtype.Int4
+	EndByte     pgtype.Int4
+	StartRune   pgtype.Int4
+	EndRune     pgtype.Int4
+	StartLine   pgtype.Int4
+	EndLine     pgtype.Int4
+	Similarity  float32
+}
+
+func (q *Queries) SearchLibrary(ctx context.Context, arg SearchLibraryParams) ([]SearchLibraryRow, error) {
+	rows, err := q.db.Query(ctx, searchLibrary,
+		arg.Embedding,
+		arg.BookIds,
+		arg.Tags,
+		arg.Author,
+		arg.ExcludeFlagged,
+		arg.PerBookLimit,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchLibraryRow
+	for rows.Next() {
+		var i SearchLibraryRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.BookID,
+			&i.BookName,
+			&i.Author,
+			&i.Ordinal,
+			&i.PassageText,
+			&i.StartByte,
+			&i.EndByte,
+			&i.StartRune,
+			&i.EndRune,
+			&i.StartLine,
+			&i.EndLine,
+			&i.Similarity,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -185,3 +1205,85 @@ func (q *Queries) QueryBook(ctx context.Context, arg QueryBookParams) ([]QueryBo
 	}
 	return items, nil
 }
+
+const updateBookPromptPreset = `-- name: UpdateBookPromptPreset :exec
+UPDATE rag.book
+SET prompt_preset = $2
+WHERE id = $1
+`
+
+type UpdateBookPromptPresetParams struct {
+	ID           int64
+	PromptPreset string
+}
+
+func (q *Queries) UpdateBookPromptPreset(ctx context.Context, arg UpdateBookPromptPresetParams) error {
+	_, err := q.db.Exec(ctx, updateBookPromptPreset, arg.ID, arg.PromptPreset)
+	return err
+}
+
+const upsertSummary = `-- name: UpsertSummary :one
+INSERT INTO rag.summary (
+    book_id,
+    scope,
+    unit_ordinal,
+    title,
+    start_ordinal,
+    end_ordinal,
+    length,
+    focus,
+    summary
+)
+VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9
+)
+ON CONFLICT (book_id, scope, unit_ordinal, length, focus) DO UPDATE
+SET
+    title = excluded.title,
+    start_ordinal = excluded.start_ordinal,
+    end_ordinal = excluded.end_ordinal,
+    summary = excluded.summary,
+    created_at = NOW()
+RETURNING id, book_id, scope, unit_ordinal, title, start_ordinal, end_ordinal, length, focus, summary, created_at
+`
+
+type UpsertSummaryParams struct {
+	BookID       int64
+	Scope        string
+	UnitOrdinal  int32
+	Title        string
+	StartOrdinal int32
+	EndOrdinal   int32
+	Length       string
+	Focus        string
+	Summary      string
+}
+
+func (q *Queries) UpsertSummary(ctx context.Context, arg UpsertSummaryParams) (RagSummary, error) {
+	row := q.db.QueryRow(ctx, upsertSummary,
+		arg.BookID,
+		arg.Scope,
+		arg.UnitOrdinal,
+		arg.Title,
+		arg.StartOrdinal,
+		arg.EndOrdinal,
+		arg.Length,
+		arg.Focus,
+		arg.Summary,
+	)
+	var i RagSummary
+	err := row.Scan(
+		&i.ID,
+		&i.BookID,
+		&i.Scope,
+		&i.UnitOrdinal,
+		&i.Title,
+		&i.StartOrdinal,
+		&i.EndOrdinal,
+		&i.Length,
+		&i.Focus,
+		&i.Summary,
+		&i.CreatedAt,
+	)
+	return i, err
+}
@@ -2,10 +2,14 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/embiem/book-rag/config"
 	"github.com/embiem/book-rag/data"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/lib/pq"
@@ -18,19 +22,22 @@ import (
 var (
 	Queries *data.Queries
 	Pool    *pgxpool.Pool
-	Conn    *pgxpool.Conn
 )
 
-func Init() error {
+func Init(cfg config.DatabaseConfig) error {
 	if Queries != nil {
 		// Return error if already initialized
 		return fmt.Errorf("db already initialized")
 	}
 
 	// Run any outstanding migrations
+	migrateURL, err := migrationURL(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid database url: %v", err)
+	}
 	m, err := migrate.New(
-		"file://db/migrations",
-		os.Getenv("DATABASE_URL"))
+		"file://"+cfg.MigrationsDir,
+		migrateURL)
 	if err != nil {
 		return fmt.Errorf("failed opening connection to postgres for migration: %v", err)
 	}
@@ -46,22 +53,98 @@ func Init() error {
 	}
 
 	// Connect to DB & setup Queries
-	Pool, err = pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+	poolConfig, err := pgxpool.ParseConfig(cfg.URL)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("invalid database url: %v", err)
 	}
+	poolConfig.MaxConns = int32(cfg.MaxConns)
+	poolConfig.MinConns = int32(cfg.MinConns)
+	poolConfig.MaxConnLifetime = time.Duration(cfg.MaxConnLifetime)
+	poolConfig.MaxConnIdleTime = time.Duration(cfg.MaxConnIdleTime)
 
-	Conn, err = Pool.Acquire(context.Background())
+	Pool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
+		return fmt.Errorf("failed creating connection pool: %v", err)
+	}
+
+	// Fail early if postgres can't be reached, the pool connects lazily
+	if err := Pool.Ping(context.Background()); err != nil {
+		Pool.Close()
 		return fmt.Errorf("failed opening connection to postgres: %v", err)
 	}
 
-	Queries = data.New(Conn)
+	// Queries and transactions take a connection from the pool for each use,
+	// so concurrent requests never share one. Begin transactions with
+	// Pool.Begin.
+	Queries = data.New(Pool)
 
 	return nil
 }
 
+// Teardown closes the pool, waiting for connections in use to be released
 func Teardown() {
-	Conn.Release()
 	Pool.Close()
 }
+
+// migrationURL returns the database URL for golang-migrate, which only takes
+// postgres:// URLs. A key=value connection string is converted into a URL
+// with every setting as a query parameter, which lib/pq reads like the keys.
+func migrationURL(connString string) (string, error) {
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		return connString, nil
+	}
+
+	settings, err := parseKeywordValues(connString)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	for key, value := range settings {
+		query.Set(key, value)
+	}
+	return "postgres://?" + query.Encode(), nil
+}
+
+// parseKeywordValues reads a key=value connection string like libpq: values
+// are separated by whitespace, may be single-quoted and use backslash escapes
+func parseKeywordValues(connString string) (map[string]string, error) {
+	settings := make(map[string]string)
+	s := strings.TrimSpace(connString)
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsFunc(key, unicode.IsSpace) {
+			return nil, errors.New("expected a key=value connection string")
+		}
+		s = strings.TrimLeftFunc(rest, unicode.IsSpace)
+
+		quoted := strings.HasPrefix(s, "'")
+		if quoted {
+			s = s[1:]
+		}
+		var value strings.Builder
+		i := 0
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) {
+				i++
+				value.WriteByte(s[i])
+				continue
+			}
+			if (quoted && c == '\'') || (!quoted && unicode.IsSpace(rune(c))) {
+				break
+			}
+			value.WriteByte(c)
+		}
+		if quoted {
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quoted value of %s", key)
+			}
+			i++ // Closing quote
+		}
+
+		settings[key] = value.String()
+		s = strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	}
+	return settings, nil
+}
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS rag.book_passage_book_id_ordinal_idx;
+
+ALTER TABLE rag.book_passage DROP COLUMN IF EXISTS ordinal;
+
+COMMIT;
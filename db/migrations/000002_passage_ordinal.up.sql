@@ -0,0 +1,21 @@
+BEGIN;
+
+ALTER TABLE rag.book_passage ADD COLUMN ordinal INTEGER;
+
+-- Passages were inserted in chunk order, so the identity column preserves it
+UPDATE rag.book_passage AS bp
+SET ordinal = numbered.ordinal
+FROM (
+    SELECT
+        id,
+        CAST(ROW_NUMBER() OVER (PARTITION BY book_id ORDER BY id) - 1 AS INTEGER) AS ordinal
+    FROM rag.book_passage
+) AS numbered
+WHERE bp.id = numbered.id;
+
+ALTER TABLE rag.book_passage ALTER COLUMN ordinal SET NOT NULL;
+
+CREATE UNIQUE INDEX book_passage_book_id_ordinal_idx
+ON rag.book_passage (book_id, ordinal);
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE rag.book_passage
+DROP COLUMN IF EXISTS start_byte,
+DROP COLUMN IF EXISTS end_byte,
+DROP COLUMN IF EXISTS start_rune,
+DROP COLUMN IF EXISTS end_rune,
+DROP COLUMN IF EXISTS start_line,
+DROP COLUMN IF EXISTS end_line;
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Spans into rag.book.book_text. Byte and rune ends are exclusive, lines are
+-- 1-based and inclusive. Passages ingested before this migration keep NULLs.
+ALTER TABLE rag.book_passage
+ADD COLUMN start_byte INTEGER,
+ADD COLUMN end_byte INTEGER,
+ADD COLUMN start_rune INTEGER,
+ADD COLUMN end_rune INTEGER,
+ADD COLUMN start_line INTEGER,
+ADD COLUMN end_line INTEGER;
+
+COMMIT;
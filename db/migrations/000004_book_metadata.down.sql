@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS rag.book_tags_idx;
+
+ALTER TABLE rag.book
+DROP COLUMN IF EXISTS author,
+DROP COLUMN IF EXISTS tags;
+
+COMMIT;
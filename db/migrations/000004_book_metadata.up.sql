@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE rag.book
+ADD COLUMN author TEXT NOT NULL DEFAULT '',
+ADD COLUMN tags TEXT [] NOT NULL DEFAULT '{}';
+
+CREATE INDEX book_tags_idx ON rag.book USING gin (tags);
+
+COMMIT;
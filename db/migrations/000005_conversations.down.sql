@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS rag.conversation_message;
+DROP TABLE IF EXISTS rag.conversation;
+
+COMMIT;
@@ -0,0 +1,24 @@
+BEGIN;
+
+CREATE TABLE rag.conversation (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES rag.book (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE rag.conversation_message (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    conversation_id BIGINT NOT NULL REFERENCES rag.conversation (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('user', 'assistant')),
+    content TEXT NOT NULL,
+    -- The condensed query used for retrieval (user turns only)
+    standalone_query TEXT NOT NULL DEFAULT '',
+    -- Passages the answer was generated from (assistant turns only)
+    cited_passage_ids BIGINT [] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX conversation_message_conversation_id_idx
+ON rag.conversation_message (conversation_id, id);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE rag.book
+DROP COLUMN IF EXISTS prompt_preset;
+
+COMMIT;
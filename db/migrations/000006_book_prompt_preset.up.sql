@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE rag.book
+ADD COLUMN prompt_preset TEXT NOT NULL DEFAULT '';
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE IF EXISTS rag.book_chapter;
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+CREATE TABLE rag.book_chapter (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES rag.book (id) ON DELETE CASCADE,
+    -- 1-based position of the chapter in the book
+    ordinal INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    -- Rune offsets into book_text, end exclusive
+    start_rune INTEGER NOT NULL,
+    end_rune INTEGER NOT NULL
+);
+
+CREATE UNIQUE INDEX book_chapter_book_id_ordinal_idx
+ON rag.book_chapter (book_id, ordinal);
+
+COMMIT;
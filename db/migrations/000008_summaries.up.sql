@@ -0,0 +1,24 @@
+BEGIN;
+
+CREATE TABLE rag.summary (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES rag.book (id) ON DELETE CASCADE,
+    -- chapter, section (a group of passages, for books without chapters) or book
+    scope TEXT NOT NULL CHECK (scope IN ('chapter', 'section', 'book')),
+    -- Chapter or section ordinal, 0 for the book
+    unit_ordinal INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    -- Range of passage ordinals the summary covers
+    start_ordinal INTEGER NOT NULL,
+    end_ordinal INTEGER NOT NULL,
+    length TEXT NOT NULL CHECK (length IN ('short', 'detailed')),
+    -- Comma separated focus topics, empty for a general summary
+    focus TEXT NOT NULL DEFAULT '',
+    summary TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX summary_unit_idx
+ON rag.summary (book_id, scope, unit_ordinal, length, focus);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS rag.passage_entity;
+DROP TABLE IF EXISTS rag.entity;
+
+COMMIT;
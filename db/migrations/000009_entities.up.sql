@@ -0,0 +1,28 @@
+BEGIN;
+
+CREATE TABLE rag.entity (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES rag.book (id) ON DELETE CASCADE,
+    -- Canonical name, other names referring to the entity are aliases
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (
+        kind IN ('character', 'place', 'organization', 'other')
+    ),
+    aliases TEXT [] NOT NULL DEFAULT '{}',
+    mention_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX entity_book_id_name_idx
+ON rag.entity (book_id, name);
+
+CREATE TABLE rag.passage_entity (
+    passage_id BIGINT NOT NULL REFERENCES rag.book_passage (id) ON DELETE CASCADE,
+    entity_id BIGINT NOT NULL REFERENCES rag.entity (id) ON DELETE CASCADE,
+    mention_count INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (passage_id, entity_id)
+);
+
+CREATE INDEX passage_entity_entity_id_idx
+ON rag.passage_entity (entity_id);
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+CREATE TABLE rag.timeline_event (
+    id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    book_id BIGINT NOT NULL REFERENCES rag.book (id) ON DELETE CASCADE,
+    -- 1-based position of the event in the timeline
+    position INTEGER NOT NULL,
+    -- Chapter or section the event was extracted from
+    scope TEXT NOT NULL CHECK (scope IN ('chapter', 'section')),
+    unit_ordinal INTEGER NOT NULL,
+    unit_title TEXT NOT NULL,
+    description TEXT NOT NULL,
+    -- Passages supporting the event
+    passage_ids BIGINT [] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX timeline_event_book_id_position_idx
+ON rag.timeline_event (book_id, position);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE rag.book_passage
+DROP COLUMN IF EXISTS injection_flags;
+
+COMMIT;
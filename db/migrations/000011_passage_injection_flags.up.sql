@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Reasons the prompt-injection scanner flagged a passage, empty if it
+-- looks harmless
+ALTER TABLE rag.book_passage
+ADD COLUMN injection_flags TEXT [] NOT NULL DEFAULT '{}';
+
+COMMIT;
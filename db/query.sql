@@ -1,31 +1,88 @@
 -- name: CreateBook :one
-INSERT INTO rag.book (book_name, book_text)
+INSERT INTO rag.book (book_name, book_text, author, tags, prompt_preset)
 VALUES (
-    $1, $2
+    $1, $2, $3, $4, $5
 )
 RETURNING *;
 
 -- name: ListBooks :many
 SELECT
     id,
-    book_name
+    book_name,
+    author,
+    tags,
+    prompt_preset
 FROM rag.book;
 
+-- name: GetBook :one
+SELECT
+    id,
+    book_name,
+    author,
+    tags,
+    prompt_preset
+FROM rag.book
+WHERE id = $1;
+
+-- name: UpdateBookPromptPreset :exec
+UPDATE rag.book
+SET prompt_preset = $2
+WHERE id = $1;
+
 -- name: CreateBookPassages :batchexec
-INSERT INTO rag.book_passage (book_id, passage_text, embedding)
+INSERT INTO rag.book_passage (
+    book_id,
+    passage_text,
+    embedding,
+    ordinal,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    injection_flags
+)
 VALUES (
-    $1, $2, $3
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
 );
 
 -- name: QueryBook :many
 SELECT
     id,
+    ordinal,
     passage_text,
-    CAST(1 - (embedding <=> $2) AS REAL) AS similarity
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    embedding,
+    CAST(1 - (embedding <=> sqlc.arg(embedding)) AS REAL) AS similarity
 FROM rag.book_passage
-WHERE book_id = $1
-ORDER BY embedding <=> $2
-LIMIT $3;
+WHERE
+    book_id = sqlc.arg(book_id)
+    -- Reading position, only passages up to this ordinal if set
+    AND (
+        sqlc.narg(max_ordinal)::INTEGER IS NULL
+        OR ordinal <= sqlc.narg(max_ordinal)::INTEGER
+    )
+    -- Entity filter, only passages mentioning one of the entities if set
+    AND (
+        CARDINALITY(sqlc.arg(entity_ids)::BIGINT []) = 0
+        OR id IN (
+            SELECT passage_id FROM rag.passage_entity
+            WHERE entity_id = ANY(sqlc.arg(entity_ids)::BIGINT [])
+        )
+    )
+    -- Leave out passages flagged by the prompt-injection scanner if set
+    AND (
+        NOT sqlc.arg(exclude_flagged)::BOOLEAN
+        OR CARDINALITY(injection_flags) = 0
+    )
+ORDER BY embedding <=> sqlc.arg(embedding)
+LIMIT sqlc.arg('limit');
 
 -- name: BookExists :one
 SELECT EXISTS(
@@ -47,3 +104,321 @@ SELECT
     book_id,
     passage_text
 FROM rag.book_passage;
+
+-- name: GetBookPassage :one
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE book_id = $1 AND id = $2;
+
+-- name: GetPassagesInRange :many
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    injection_flags
+FROM rag.book_passage
+WHERE
+    book_id = $1
+    AND ordinal BETWEEN sqlc.arg(start_ordinal) AND sqlc.arg(end_ordinal)
+ORDER BY ordinal;
+
+-- name: GetFlaggedPassages :many
+SELECT
+    id,
+    ordinal,
+    passage_text,
+    injection_flags,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE book_id = $1 AND CARDINALITY(injection_flags) > 0
+ORDER BY ordinal;
+
+-- name: UpdatePassageInjectionFlags :batchexec
+UPDATE rag.book_passage
+SET injection_flags = $2
+WHERE id = $1;
+
+-- name: GetBookText :one
+SELECT book_text
+FROM rag.book
+WHERE id = $1;
+
+-- name: GetBookTextSpan :one
+SELECT
+    CAST(
+        SUBSTRING(
+            book_text
+            FROM sqlc.arg(start_rune)::INTEGER + 1
+            FOR sqlc.arg(span_length)::INTEGER
+        ) AS TEXT
+    ) AS span_text,
+    CAST(LENGTH(book_text) AS INTEGER) AS text_length
+FROM rag.book
+WHERE id = $1;
+
+-- name: SearchLibrary :many
+SELECT
+    id,
+    book_id,
+    book_name,
+    author,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line,
+    similarity
+FROM (
+    SELECT
+        bp.id,
+        bp.book_id,
+        b.book_name,
+        b.author,
+        bp.ordinal,
+        bp.passage_text,
+        bp.start_byte,
+        bp.end_byte,
+        bp.start_rune,
+        bp.end_rune,
+        bp.start_line,
+        bp.end_line,
+        CAST(1 - (bp.embedding <=> sqlc.arg(embedding)) AS REAL) AS similarity,
+        ROW_NUMBER() OVER (
+            PARTITION BY bp.book_id
+            ORDER BY bp.embedding <=> sqlc.arg(embedding)
+        ) AS book_rank
+    FROM rag.book_passage AS bp
+    INNER JOIN rag.book AS b ON bp.book_id = b.id
+    WHERE
+        (
+            CARDINALITY(sqlc.arg(book_ids)::BIGINT []) = 0
+            OR bp.book_id = ANY(sqlc.arg(book_ids)::BIGINT [])
+        )
+        AND (
+            CARDINALITY(sqlc.arg(tags)::TEXT []) = 0
+            OR b.tags && sqlc.arg(tags)::TEXT []
+        )
+        AND (
+            sqlc.arg(author)::TEXT = ''
+            OR b.author ILIKE '%' || sqlc.arg(author)::TEXT || '%'
+        )
+        -- Leave out passages flagged by the prompt-injection scanner if set
+        AND (
+            NOT sqlc.arg(exclude_flagged)::BOOLEAN
+            OR CARDINALITY(bp.injection_flags) = 0
+        )
+) AS ranked
+WHERE book_rank <= sqlc.arg(per_book_limit)::INTEGER
+ORDER BY similarity DESC
+LIMIT sqlc.arg(max_results)::INTEGER;
+
+-- name: CreateConversation :one
+INSERT INTO rag.conversation (book_id)
+VALUES ($1)
+RETURNING *;
+
+-- name: GetConversation :one
+SELECT *
+FROM rag.conversation
+WHERE id = $1;
+
+-- name: CreateConversationMessage :one
+INSERT INTO rag.conversation_message (
+    conversation_id, role, content, standalone_query, cited_passage_ids
+)
+VALUES (
+    $1, $2, $3, $4, $5
+)
+RETURNING *;
+
+-- name: ListConversationMessages :many
+SELECT *
+FROM rag.conversation_message
+WHERE conversation_id = $1
+ORDER BY id;
+
+-- name: GetPassagesByIDs :many
+SELECT
+    id,
+    book_id,
+    ordinal,
+    passage_text,
+    start_byte,
+    end_byte,
+    start_rune,
+    end_rune,
+    start_line,
+    end_line
+FROM rag.book_passage
+WHERE id = ANY(sqlc.arg(ids)::BIGINT [])
+ORDER BY id;
+
+-- name: CreateBookChapters :batchexec
+INSERT INTO rag.book_chapter (
+    book_id, ordinal, title, start_rune, end_rune
+)
+VALUES (
+    $1, $2, $3, $4, $5
+);
+
+-- name: GetBookChapters :many
+SELECT
+    ordinal,
+    title,
+    start_rune,
+    end_rune
+FROM rag.book_chapter
+WHERE book_id = $1
+ORDER BY ordinal;
+
+-- name: GetBookChapter :one
+SELECT
+    ordinal,
+    title,
+    start_rune,
+    end_rune
+FROM rag.book_chapter
+WHERE book_id = $1 AND ordinal = $2;
+
+-- name: GetLastPassageOrdinalBefore :one
+SELECT CAST(COALESCE(MAX(ordinal), -1) AS INTEGER) AS max_ordinal
+FROM rag.book_passage
+WHERE book_id = sqlc.arg(book_id) AND end_rune <= sqlc.arg(offset_rune)::INTEGER;
+
+-- name: UpsertSummary :one
+INSERT INTO rag.summary (
+    book_id,
+    scope,
+    unit_ordinal,
+    title,
+    start_ordinal,
+    end_ordinal,
+    length,
+    focus,
+    summary
+)
+VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9
+)
+ON CONFLICT (book_id, scope, unit_ordinal, length, focus) DO UPDATE
+SET
+    title = excluded.title,
+    start_ordinal = excluded.start_ordinal,
+    end_ordinal = excluded.end_ordinal,
+    summary = excluded.summary,
+    created_at = NOW()
+RETURNING *;
+
+-- name: GetSummaries :many
+SELECT *
+FROM rag.summary
+WHERE book_id = $1 AND length = $2 AND focus = $3
+ORDER BY scope = 'book', unit_ordinal;
+
+-- name: DeleteBookEntities :exec
+DELETE FROM rag.entity
+WHERE book_id = $1;
+
+-- name: CreateEntity :one
+INSERT INTO rag.entity (book_id, name, kind, aliases, mention_count)
+VALUES (
+    $1, $2, $3, $4, $5
+)
+RETURNING id;
+
+-- name: CreatePassageEntities :batchexec
+INSERT INTO rag.passage_entity (passage_id, entity_id, mention_count)
+VALUES (
+    $1, $2, $3
+);
+
+-- name: ListBookEntities :many
+SELECT
+    e.id,
+    e.name,
+    e.kind,
+    e.aliases,
+    e.mention_count,
+    CAST(COUNT(pe.passage_id) AS INTEGER) AS passage_count
+FROM rag.entity AS e
+LEFT JOIN rag.passage_entity AS pe ON e.id = pe.entity_id
+WHERE
+    e.book_id = sqlc.arg(book_id)
+    AND (sqlc.arg(kind)::TEXT = '' OR e.kind = sqlc.arg(kind)::TEXT)
+GROUP BY e.id
+ORDER BY e.mention_count DESC, e.name;
+
+-- name: FindEntitiesByName :many
+SELECT
+    id,
+    name,
+    aliases
+FROM rag.entity
+WHERE
+    book_id = sqlc.arg(book_id)
+    AND (
+        LOWER(name) = ANY(sqlc.arg(names)::TEXT [])
+        OR EXISTS (
+            SELECT 1 FROM UNNEST(aliases) AS alias
+            WHERE LOWER(alias) = ANY(sqlc.arg(names)::TEXT [])
+        )
+    );
+
+-- name: GetEntityCooccurrences :many
+SELECT
+    a.entity_id AS source_id,
+    b.entity_id AS target_id,
+    CAST(COUNT(*) AS INTEGER) AS weight,
+    CAST(ARRAY_AGG(a.passage_id ORDER BY a.passage_id) AS BIGINT []) AS passage_ids
+FROM rag.passage_entity AS a
+INNER JOIN rag.passage_entity AS b
+    ON a.passage_id = b.passage_id AND a.entity_id < b.entity_id
+INNER JOIN rag.entity AS ea ON a.entity_id = ea.id
+INNER JOIN rag.entity AS eb ON b.entity_id = eb.id
+WHERE
+    ea.book_id = sqlc.arg(book_id)
+    AND (sqlc.arg(kind)::TEXT = '' OR (ea.kind = sqlc.arg(kind)::TEXT AND eb.kind = sqlc.arg(kind)::TEXT))
+GROUP BY a.entity_id, b.entity_id
+HAVING COUNT(*) >= sqlc.arg(min_weight)::INTEGER
+ORDER BY weight DESC, source_id, target_id;
+
+-- name: DeleteTimelineEvents :exec
+DELETE FROM rag.timeline_event
+WHERE book_id = $1;
+
+-- name: CreateTimelineEvents :batchexec
+INSERT INTO rag.timeline_event (
+    book_id, position, scope, unit_ordinal, unit_title, description, passage_ids
+)
+VALUES (
+    $1, $2, $3, $4, $5, $6, $7
+);
+
+-- name: GetTimelineEvents :many
+SELECT *
+FROM rag.timeline_event
+WHERE book_id = $1
+ORDER BY position;
@@ -0,0 +1,19 @@
+package eval
+
+import (
+	"time"
+
+	"github.com/embiem/book-rag/config"
+)
+
+// Model generates, critiques and judges questions
+var Model = config.Default().Eval.Model
+
+// RequestTimeout limits each request to the evaluated RAG server
+var RequestTimeout = time.Duration(config.Default().Eval.RequestTimeout)
+
+// Configure applies the configuration to the package's settings
+func Configure(cfg config.Config) {
+	Model = cfg.Eval.Model
+	RequestTimeout = time.Duration(cfg.Eval.RequestTimeout)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/embiem/book-rag/rag"
 	"github.com/openai/openai-go/v3"
 )
 
@@ -65,11 +66,13 @@ func CritiqueQAPair(ctx context.Context, client *openai.Client, qa QAPair) (Crit
 	return scores, nil
 }
 
-// critiqueGroundedness checks if the question can be answered from the context
+// critiqueGroundedness checks if the question can be answered from the
+// context, which is delimited as untrusted book text
 func critiqueGroundedness(ctx context.Context, client *openai.Client, qa QAPair) (int, string, error) {
 	prompt := fmt.Sprintf(`Evaluate if the following question can be fully answered using ONLY the provided context.
 
-Context:
+Context: %s
+
 %s
 
 Question: %s
@@ -82,7 +85,7 @@ Score 1-5:
 4: Mostly answerable from context
 5: Fully answerable from context alone
 
-First provide your reasoning, then output "Score: X" where X is 1-5.`, qa.Context, qa.Question, qa.ReferenceAnswer)
+First provide your reasoning, then output "Score: X" where X is 1-5.`, rag.UntrustedPassagesNotice, rag.DelimitPassage(qa.Context), qa.Question, qa.ReferenceAnswer)
 
 	return callLLMForScore(ctx, client, prompt)
 }
@@ -127,7 +130,7 @@ First provide your reasoning, then output "Score: X" where X is 1-5.`, qa.Questi
 // callLLMForScore makes an LLM call and extracts a 1-5 score
 func callLLMForScore(ctx context.Context, client *openai.Client, prompt string) (int, string, error) {
 	completion, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model: openai.ChatModelGPT4oMini,
+		Model: Model,
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		},
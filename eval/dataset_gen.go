@@ -6,16 +6,18 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/embiem/book-rag/rag"
 	"github.com/google/uuid"
 	"github.com/openai/openai-go/v3"
 )
 
-// GenerateQAPair creates a question-answer pair from a text chunk using LLM
+// GenerateQAPair creates a question-answer pair from a text chunk using LLM.
+// The chunk is delimited as untrusted book text in the prompt.
 func GenerateQAPair(ctx context.Context, client *openai.Client, context string, bookID int64) (QAPair, error) {
 	prompt := fmt.Sprintf(`Based on the following text from a book, generate ONE factoid question that can be answered using only this text.
 Then provide a concise answer to that question.
+%s
 
-Text:
 %s
 
 Generate a question that:
@@ -29,10 +31,10 @@ IMPORTANT: The question must be perfectly understandable by someone who hasn't r
 
 Output format:
 Question: [your question]
-Answer: [your answer]`, context)
+Answer: [your answer]`, rag.UntrustedPassagesNotice, rag.DelimitPassage(context))
 
 	completion, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model: openai.ChatModelGPT4oMini,
+		Model: Model,
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(prompt),
 		},
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/embiem/book-rag/rag"
 	"github.com/openai/openai-go/v3"
 )
 
@@ -85,7 +86,8 @@ func judgeFaithfulness(ctx context.Context, client *openai.Client, question, ans
 
 Question: %s
 
-Retrieved Context:
+Retrieved Context: %s
+
 %s
 
 Generated Answer: %s
@@ -97,7 +99,7 @@ Score 1-5:
 4: Answer is mostly grounded with minor unsupported details
 5: Answer is fully grounded - all claims can be verified from context
 
-First provide your detailed reasoning, then output "Score: X" where X is 1-5.`, question, context, answer)
+First provide your detailed reasoning, then output "Score: X" where X is 1-5.`, question, rag.UntrustedPassagesNotice, context, answer)
 
 	return callLLMForScore(ctx, client, prompt)
 }
@@ -154,7 +156,8 @@ func judgeContextRelevance(ctx context.Context, client *openai.Client, question,
 
 Question: %s
 
-Retrieved Context:
+Retrieved Context: %s
+
 %s
 
 Score 1-5:
@@ -164,7 +167,7 @@ Score 1-5:
 4: Context is mostly relevant with good information
 5: Context is highly relevant and contains all needed information
 
-First provide your detailed reasoning, then output "Score: X" where X is 1-5.`, question, context)
+First provide your detailed reasoning, then output "Score: X" where X is 1-5.`, question, rag.UntrustedPassagesNotice, context)
 
 	return callLLMForScore(ctx, client, prompt)
 }
@@ -114,7 +114,7 @@ func queryRAGSystem(ctx context.Context, baseURL string, bookID int64, query str
 	}
 
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout: RequestTimeout,
 	}
 
 	// Create request with context for cancellation support
@@ -0,0 +1,412 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	GenerateModeSingle = "single" // One retrieval, then generation (default)
+	GenerateModeAgent  = "agent"  // The LLM retrieves iteratively using tools
+)
+
+const (
+	// DefaultAgentSearchLimit is the number of passages a search returns
+	// unless the LLM or the request asks for another number
+	DefaultAgentSearchLimit = 5
+	// MaxAgentSearchLimit caps the passages of a single search
+	MaxAgentSearchLimit = 10
+)
+
+// SectionSize is the number of passages summarized together in books
+// without detected chapters
+const SectionSize = 20
+
+const agentSystemPrompt = `You are an assistant in a book publishing company, answering queries about a single book.
+You can't see the book directly. Use the provided tools to search it, read the passages around interesting hits and get summaries of larger sections.
+Search as often as you need, with different queries if the first results aren't sufficient.
+Base your answer only on what the tools returned and say so if the book doesn't seem to contain the answer.
+` + rag.UntrustedPassagesNotice
+
+// agentSession holds the state the tools share during one agent run
+type agentSession struct {
+	bookID    int64
+	generator *rag.Generator
+
+	// Retrieval options of the request, used for every search. The tools
+	// don't return passages after the reading position, or flagged passages
+	// if ExcludeFlagged is set.
+	search     QueryBookRequest
+	maxOrdinal pgtype.Int4
+
+	// Passages the tools returned, in the order they were first seen
+	seenIDs  []int64
+	passages map[int64]PassageResult
+}
+
+func (s *agentSession) remember(passages ...PassageResult) {
+	for _, p := range passages {
+		if _, ok := s.passages[p.ID]; !ok {
+			s.seenIDs = append(s.seenIDs, p.ID)
+			s.passages[p.ID] = p
+		}
+	}
+}
+
+func (s *agentSession) seenPassages() []PassageResult {
+	seen := make([]PassageResult, len(s.seenIDs))
+	for i, id := range s.seenIDs {
+		seen[i] = s.passages[id]
+	}
+	return seen
+}
+
+// formatToolPassages renders passages with the IDs the LLM needs for follow-up calls
+func formatToolPassages(passages []PassageResult) string {
+	if len(passages) == 0 {
+		return "No passages found."
+	}
+
+	var b strings.Builder
+	for _, p := range passages {
+		attributes := []string{fmt.Sprintf(`passage_id="%d"`, p.ID), fmt.Sprintf(`position="%d"`, p.Ordinal)}
+		if p.Similarity != 0 {
+			attributes = append(attributes, fmt.Sprintf(`relevance="%d%%"`, int(math.Round(float64(p.Similarity)*100))))
+		}
+		b.WriteString(rag.DelimitPassage(p.Text, attributes...) + "\n\n")
+	}
+	return b.String()
+}
+
+func (s *agentSession) tools() []rag.Tool {
+	return []rag.Tool{
+		{
+			Name:        "search_book",
+			Description: "Semantic search over the book's passages. Returns the most relevant passages with their passage_id.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string", "description": "What to search for"},
+					"limit": map[string]any{"type": "integer", "description": "Number of passages to return (default 5, max 10)"},
+				},
+				"required": []string{"query"},
+			},
+			Run: s.searchBook,
+		},
+		{
+			Name:        "get_neighbors",
+			Description: "Get the passages right before and after a passage, to read more of its context.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"passage_id": map[string]any{"type": "integer"},
+					"count":      map[string]any{"type": "integer", "description": "Passages on each side (default 1, max 5)"},
+				},
+				"required": []string{"passage_id"},
+			},
+			Run: s.getNeighbors,
+		},
+		{
+			Name:        "get_chapter_summary",
+			Description: "Get a summary of the chapter (or larger section) of the book that contains a passage.",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"passage_id": map[string]any{"type": "integer"},
+				},
+				"required": []string{"passage_id"},
+			},
+			Run: s.getChapterSummary,
+		},
+	}
+}
+
+func (s *agentSession) searchBook(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil || args.Query == "" {
+		return "", errors.New("arguments must contain a query")
+	}
+
+	search := s.search
+	search.Query = args.Query
+	search.Limit = cmp.Or(min(search.Limit, MaxAgentSearchLimit), DefaultAgentSearchLimit)
+	if args.Limit > 0 {
+		search.Limit = min(args.Limit, MaxAgentSearchLimit)
+	}
+
+	res, err := QueryBook(ctx, search, s.bookID)
+	if err != nil {
+		return "", err
+	}
+
+	s.remember(res.Passages...)
+	return formatToolPassages(res.Passages), nil
+}
+
+func (s *agentSession) getPassage(ctx context.Context, passageID int64) (data.GetBookPassageRow, error) {
+	passage, err := db.Queries.GetBookPassage(ctx, data.GetBookPassageParams{
+		BookID: s.bookID,
+		ID:     passageID,
+	})
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && s.maxOrdinal.Valid && passage.Ordinal > s.maxOrdinal.Int32) {
+		return passage, fmt.Errorf("passage %d does not exist in this book", passageID)
+	}
+	return passage, err
+}
+
+// endOrdinal clamps the end of a passage range to the reading position
+func (s *agentSession) endOrdinal(end int32) int32 {
+	if s.maxOrdinal.Valid {
+		return min(end, s.maxOrdinal.Int32)
+	}
+	return end
+}
+
+func (s *agentSession) getNeighbors(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		PassageID int64 `json:"passage_id"`
+		Count     int   `json:"count"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", errors.New("arguments must contain a passage_id")
+	}
+
+	count := 1
+	if args.Count > 0 {
+		count = min(args.Count, MaxWindow)
+	}
+
+	passage, err := s.getPassage(ctx, args.PassageID)
+	if err != nil {
+		return "", err
+	}
+
+	rows, err := db.Queries.GetPassagesInRange(ctx, data.GetPassagesInRangeParams{
+		BookID:       s.bookID,
+		StartOrdinal: passage.Ordinal - int32(count),
+		EndOrdinal:   s.endOrdinal(passage.Ordinal + int32(count)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	neighbors := make([]PassageResult, 0, len(rows))
+	for _, row := range rows {
+		if s.search.ExcludeFlagged && len(row.InjectionFlags) > 0 {
+			continue
+		}
+		neighbors = append(neighbors, PassageResult{ID: row.ID, Ordinal: row.Ordinal, Text: row.PassageText})
+	}
+
+	s.remember(neighbors...)
+	return formatToolPassages(neighbors), nil
+}
+
+// getChapterSummary summarizes the chapter, or section of SectionSize
+// passages, that contains a passage. Summaries are cached like the ones of
+// POST /books/{bookID}/summaries.
+func (s *agentSession) getChapterSummary(ctx context.Context, arguments string) (string, error) {
+	var args struct {
+		PassageID int64 `json:"passage_id"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", errors.New("arguments must contain a passage_id")
+	}
+
+	passage, err := s.getPassage(ctx, args.PassageID)
+	if err != nil {
+		return "", err
+	}
+
+	units, err := summaryUnits(ctx, s.bookID)
+	if err != nil {
+		return "", err
+	}
+
+	idx := slices.IndexFunc(units, func(u summaryUnit) bool {
+		return passage.Ordinal >= u.startOrdinal() && passage.Ordinal <= u.endOrdinal()
+	})
+	if idx < 0 {
+		return "", fmt.Errorf("passage %d is not part of a chapter", args.PassageID)
+	}
+	unit := units[idx]
+
+	// Only summarize what the reader has read, without caching
+	if s.maxOrdinal.Valid && unit.endOrdinal() > s.maxOrdinal.Int32 {
+		unit.passages = slices.DeleteFunc(unit.passages, func(p data.GetPassagesInRangeRow) bool {
+			return p.Ordinal > s.maxOrdinal.Int32
+		})
+		summary, err := s.generator.SummarizeSection(ctx, unit.title+" (up to the reading position)", unit.text(), rag.SummaryLengthShort, nil)
+		if err != nil {
+			return "", err
+		}
+		return delimitSummary(unit.title+" (up to the reading position)", summary), nil
+	}
+
+	cached, err := db.Queries.GetSummaries(ctx, data.GetSummariesParams{
+		BookID: s.bookID,
+		Length: rag.SummaryLengthShort,
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, summary := range cached {
+		if summary.Scope == unit.scope && summary.UnitOrdinal == unit.ordinal {
+			return delimitSummary(unit.title, summary.Summary), nil
+		}
+	}
+
+	summary, err := s.generator.SummarizeSection(ctx, unit.title, unit.text(), rag.SummaryLengthShort, nil)
+	if err != nil {
+		return "", err
+	}
+
+	storeSummary(ctx, s.bookID, SectionSummary{
+		Scope:        unit.scope,
+		Ordinal:      unit.ordinal,
+		Title:        unit.title,
+		StartOrdinal: unit.startOrdinal(),
+		EndOrdinal:   unit.endOrdinal(),
+		Summary:      summary,
+	}, rag.SummaryLengthShort, "")
+
+	return delimitSummary(unit.title, summary), nil
+}
+
+// agentUnsupportedOptions lists the options of a request that agent mode
+// can't honor, as the LLM decides what to retrieve and writes the answer
+// without a prompt preset
+func agentUnsupportedOptions(payload GenerateRequest) []string {
+	var unsupported []string
+	add := func(set bool, name string) {
+		if set {
+			unsupported = append(unsupported, name)
+		}
+	}
+	add(len(payload.Schema) > 0 && string(payload.Schema) != "null", "schema")
+	add(payload.Verify != "", "verify")
+	add(payload.PromptPreset != "", "prompt_preset")
+	add(payload.Window > 0, "window")
+	add(payload.ContextTokens > 0, "context_tokens")
+	add(payload.Summaries || payload.SummaryLength != "", "summaries")
+	return unsupported
+}
+
+// validateSearchOptions checks the retrieval options every search of the
+// agent uses, so mistakes are reported to the client instead of the LLM
+func validateSearchOptions(ctx context.Context, bookID int64, search QueryBookRequest) error {
+	if _, err := resolveMinSimilarity(search.MinSimilarity); err != nil {
+		return err
+	}
+	if search.Lambda != nil && (*search.Lambda < 0 || *search.Lambda > 1) {
+		return HttpError{Msg: "lambda must be between 0 and 1", Status: http.StatusBadRequest}
+	}
+	if search.QueryStrategy != "" && !rag.IsValidQueryStrategy(search.QueryStrategy) {
+		return HttpError{Msg: "query_strategy must be one of raw, rewrite, hyde or multi", Status: http.StatusBadRequest}
+	}
+	_, _, err := resolveEntityFilter(ctx, bookID, search.Entities)
+	return err
+}
+
+// handleAgentGenerate answers the query by letting the LLM retrieve passages
+// with tools over several steps. Errors are plain text, like the ones of
+// HandleGenerate.
+func handleAgentGenerate(w http.ResponseWriter, r *http.Request, payload GenerateRequest, bookID int64) {
+	// Optional budget (default 5 steps & 50k tokens, max 10 steps & 200k tokens)
+	budget := rag.AgentBudget{MaxSteps: rag.DefaultAgentMaxSteps, MaxTokens: rag.DefaultAgentMaxTokens}
+	if payload.MaxSteps > 0 {
+		budget.MaxSteps = min(payload.MaxSteps, rag.MaxAgentSteps)
+	}
+	if payload.MaxTokens > 0 {
+		budget.MaxTokens = min(payload.MaxTokens, rag.MaxAgentTokens)
+	}
+
+	// The request's retrieval options apply to every search of the agent
+	search := QueryBookRequest{
+		Limit:            payload.Limit,
+		Rerank:           payload.Rerank,
+		RerankCandidates: payload.RerankCandidates,
+		MMR:              payload.MMR,
+		Lambda:           payload.Lambda,
+		MinSimilarity:    payload.MinSimilarity,
+		QueryStrategy:    payload.QueryStrategy,
+		ReadingPosition:  payload.ReadingPosition,
+		Entities:         payload.Entities,
+		ExcludeFlagged:   payload.ExcludeFlagged,
+	}
+	if err := validateSearchOptions(r.Context(), bookID, search); err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			w.Write([]byte(httpErr.Msg))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal Server Error"))
+		}
+		return
+	}
+
+	maxOrdinal, readingPosition, err := resolveReadingPosition(r.Context(), bookID, payload.ReadingPosition)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			w.Write([]byte(httpErr.Msg))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal Server Error"))
+		}
+		return
+	}
+
+	systemPrompt := agentSystemPrompt
+	if readingPosition != "" {
+		systemPrompt += fmt.Sprintf("\nThe reader has only read up to %s and the tools only return passages from before that point. Don't reveal or hint at anything that happens later in the book, even if you know the book.", readingPosition)
+	}
+
+	session := &agentSession{
+		bookID:     bookID,
+		generator:  rag.NewGenerator(),
+		maxOrdinal: maxOrdinal,
+		search:     search,
+		passages:   make(map[int64]PassageResult),
+	}
+
+	result, err := session.generator.RunAgent(r.Context(), systemPrompt, payload.Query, session.tools(), budget)
+	if err != nil {
+		slog.Error("Error during agent run", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not generate response"))
+		return
+	}
+
+	seen := session.seenPassages()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"answer":            result.Answer,
+		"mode":              GenerateModeAgent,
+		"tool_calls":        result.Trace,
+		"steps":             result.Steps,
+		"total_tokens":      result.TotalTokens,
+		"stop_reason":       result.StopReason,
+		"retrieved_chunks":  len(seen),
+		"retrieved_context": PrettifyPassages(seen),
+	})
+}
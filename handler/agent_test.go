@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAgentUnsupportedOptions(t *testing.T) {
+	minSimilarity := float32(0.2)
+	supported := GenerateRequest{
+		Query:         "Who is Ishmael?",
+		Mode:          GenerateModeAgent,
+		Limit:         8,
+		Rerank:        true,
+		MMR:           true,
+		MinSimilarity: &minSimilarity,
+		QueryStrategy: "rewrite",
+		Entities:      []string{"Ishmael"},
+		Schema:        json.RawMessage("null"),
+	}
+	if unsupported := agentUnsupportedOptions(supported); len(unsupported) != 0 {
+		t.Errorf("Expected retrieval options to be supported, got %v", unsupported)
+	}
+
+	unsupported := agentUnsupportedOptions(GenerateRequest{
+		Schema:       json.RawMessage(`"list_of_characters"`),
+		Verify:       "flag",
+		PromptPreset: "student",
+		Window:       1,
+		Summaries:    true,
+	})
+	expected := []string{"schema", "verify", "prompt_preset", "window", "summaries"}
+	if !reflect.DeepEqual(unsupported, expected) {
+		t.Errorf("Expected %v, got %v", expected, unsupported)
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type ChapterItem struct {
+	Ordinal   int32  `json:"ordinal"`
+	Title     string `json:"title"`
+	StartRune int32  `json:"start_rune"`
+	EndRune   int32  `json:"end_rune"`
+}
+
+type ListChaptersResponse struct {
+	BookID   int64         `json:"book_id"`
+	Chapters []ChapterItem `json:"chapters"`
+}
+
+// ReadingPosition is how far a reader got in the book. Exactly one of the
+// fields must be set.
+type ReadingPosition struct {
+	Chapter *int32 `json:"chapter"` // The chapter the reader is in (1-based), everything before it has been read
+	Offset  *int32 `json:"offset"`  // Rune offset into the book text
+}
+
+// resolveReadingPosition returns the ordinal of the last passage that ends
+// before the reading position, and a description of the position for the
+// prompt. A nil position returns an invalid ordinal, i.e. no restriction.
+func resolveReadingPosition(ctx context.Context, bookID int64, position *ReadingPosition) (pgtype.Int4, string, error) {
+	if position == nil {
+		return pgtype.Int4{}, "", nil
+	}
+	if (position.Chapter == nil) == (position.Offset == nil) {
+		return pgtype.Int4{}, "", HttpError{Msg: "reading_position needs exactly one of chapter or offset", Status: http.StatusBadRequest}
+	}
+
+	var offset int32
+	var description string
+	if position.Chapter != nil {
+		chapter, err := db.Queries.GetBookChapter(ctx, data.GetBookChapterParams{
+			BookID:  bookID,
+			Ordinal: *position.Chapter,
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pgtype.Int4{}, "", HttpError{Msg: fmt.Sprintf("Chapter %d not found, see GET /books/%d/chapters", *position.Chapter, bookID), Status: http.StatusBadRequest}
+		}
+		if err != nil {
+			slog.Error("Failed to get chapter", "err", err, "book_id", bookID)
+			return pgtype.Int4{}, "", err
+		}
+		offset = chapter.StartRune
+		description = fmt.Sprintf("the beginning of chapter %d (%s)", chapter.Ordinal, chapter.Title)
+	} else {
+		if *position.Offset < 0 {
+			return pgtype.Int4{}, "", HttpError{Msg: "reading_position offset must not be negative", Status: http.StatusBadRequest}
+		}
+		offset = *position.Offset
+		description = fmt.Sprintf("character %d of the book", offset)
+	}
+
+	maxOrdinal, err := db.Queries.GetLastPassageOrdinalBefore(ctx, data.GetLastPassageOrdinalBeforeParams{
+		BookID:     bookID,
+		OffsetRune: offset,
+	})
+	if err != nil {
+		slog.Error("Failed to resolve reading position", "err", err, "book_id", bookID)
+		return pgtype.Int4{}, "", err
+	}
+
+	return pgtype.Int4{Int32: maxOrdinal, Valid: true}, description, nil
+}
+
+func HandleListChapters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	chapters, err := db.Queries.GetBookChapters(r.Context(), bookID)
+	if err != nil {
+		slog.Error("Failed to get chapters", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	items := make([]ChapterItem, len(chapters))
+	for i, c := range chapters {
+		items[i] = ChapterItem{
+			Ordinal:   c.Ordinal,
+			Title:     c.Title,
+			StartRune: c.StartRune,
+			EndRune:   c.EndRune,
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(ListChaptersResponse{
+		BookID:   bookID,
+		Chapters: items,
+	})
+}
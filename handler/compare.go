@@ -0,0 +1,210 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// MaxCompareBooks caps the number of books in one comparison
+	MaxCompareBooks = 5
+	// DefaultComparePassages is the number of passages retrieved per book
+	DefaultComparePassages = 5
+)
+
+type CompareRequest struct {
+	BookIDs        []int64  `json:"book_ids"`
+	Question       string   `json:"question"`
+	Limit          int      `json:"limit"` // Passages per book
+	ContextTokens  int      `json:"context_tokens"`
+	Rerank         bool     `json:"rerank"`
+	MinSimilarity  *float32 `json:"min_similarity"`
+	QueryStrategy  string   `json:"query_strategy"`
+	ExcludeFlagged bool     `json:"exclude_flagged"`
+}
+
+type ComparePassageResult struct {
+	Label int `json:"label"` // Number the answer cites the passage by
+	PassageResult
+	Cited bool `json:"cited"`
+}
+
+type CompareBookResult struct {
+	BookID   int64                  `json:"book_id"`
+	BookName string                 `json:"book_name"`
+	Author   string                 `json:"author,omitempty"`
+	Passages []ComparePassageResult `json:"passages"`
+	Cited    bool                   `json:"cited"` // Whether the answer cites any of its passages
+}
+
+type CompareResponse struct {
+	Question            string                  `json:"question"`
+	Answer              string                  `json:"answer"`
+	Sections            []rag.ComparisonSection `json:"sections"`
+	InsufficientContext bool                    `json:"insufficient_context"`
+	Books               []CompareBookResult     `json:"books"`
+}
+
+// loadCompareBooks checks that every book exists, in request order
+func loadCompareBooks(ctx context.Context, bookIDs []int64) ([]data.GetBookRow, error) {
+	books := make([]data.GetBookRow, len(bookIDs))
+	for i, id := range bookIDs {
+		book, err := db.Queries.GetBook(ctx, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, HttpError{Msg: "Book not found", Status: http.StatusNotFound}
+		}
+		if err != nil {
+			slog.Error("Failed to get book", "err", err, "book_id", id)
+			return nil, err
+		}
+		books[i] = book
+	}
+	return books, nil
+}
+
+// retrieveEvidence queries every book, one after another, and packs each
+// book's passages into an equal share of the context budget, so a book with
+// many relevant passages can't crowd out the others
+func retrieveEvidence(ctx context.Context, books []data.GetBookRow, payload CompareRequest) ([]CompareBookResult, error) {
+	results := make([]*QueryBookResponse, len(books))
+	for i, book := range books {
+		result, err := QueryBook(ctx, QueryBookRequest{
+			Query:          payload.Question,
+			Limit:          cmp.Or(payload.Limit, DefaultComparePassages),
+			Rerank:         payload.Rerank,
+			MinSimilarity:  payload.MinSimilarity,
+			QueryStrategy:  payload.QueryStrategy,
+			ExcludeFlagged: payload.ExcludeFlagged,
+		}, book.ID)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+
+	share := contextBudget(payload.ContextTokens) / len(books)
+	evidence := make([]CompareBookResult, len(books))
+	label := 0
+	for i, book := range books {
+		_, included, _, _ := buildContext(results[i], share)
+
+		evidence[i] = CompareBookResult{BookID: book.ID, BookName: book.BookName, Author: book.Author, Passages: []ComparePassageResult{}}
+		for _, p := range included {
+			label++
+			evidence[i].Passages = append(evidence[i].Passages, ComparePassageResult{Label: label, PassageResult: p})
+		}
+	}
+	return evidence, nil
+}
+
+// HandleCompareBooks answers a question comparing several books, with
+// evidence retrieved from each book and citations per book
+func HandleCompareBooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	var payload CompareRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	payload.Question = strings.TrimSpace(payload.Question)
+	if payload.Question == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "question is required"})
+		return
+	}
+
+	var bookIDs []int64
+	for _, id := range payload.BookIDs {
+		if !slices.Contains(bookIDs, id) {
+			bookIDs = append(bookIDs, id)
+		}
+	}
+	payload.BookIDs = bookIDs
+	if len(payload.BookIDs) < 2 || len(payload.BookIDs) > MaxCompareBooks {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "book_ids must contain between 2 and 5 different books"})
+		return
+	}
+
+	books, err := loadCompareBooks(r.Context(), payload.BookIDs)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	evidence, err := retrieveEvidence(r.Context(), books, payload)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Error querying the books"})
+		}
+		return
+	}
+
+	res := CompareResponse{Question: payload.Question, Sections: []rag.ComparisonSection{}, Books: evidence}
+
+	compareBooks := make([]rag.CompareBook, len(evidence))
+	var labels []int
+	for i, b := range evidence {
+		compareBooks[i] = rag.CompareBook{Name: b.BookName, Author: b.Author}
+		for _, p := range b.Passages {
+			compareBooks[i].Passages = append(compareBooks[i].Passages, rag.ComparePassage{Label: p.Label, Text: p.Text})
+			labels = append(labels, p.Label)
+		}
+	}
+
+	if len(labels) == 0 {
+		res.Answer = "I could not find any passages in these books that are relevant enough to answer this question."
+		res.InsufficientContext = true
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(res)
+		return
+	}
+
+	answer, err := rag.NewGenerator().CompareBooks(r.Context(), payload.Question, compareBooks)
+	if err != nil {
+		slog.Error("Error during LLM generation", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not generate response"})
+		return
+	}
+
+	res.Answer = answer
+	res.Sections = rag.ParseComparison(answer, labels)
+	cited := rag.ParseCitations(answer, labels)
+	for i := range res.Books {
+		for j := range res.Books[i].Passages {
+			if slices.Contains(cited, res.Books[i].Passages[j].Label) {
+				res.Books[i].Passages[j].Cited = true
+				res.Books[i].Cited = true
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/embiem/book-rag/config"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeOllama embeds texts by hashing their words, so passages sharing words
+// with a query are similar to it
+func fakeOllama(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload rag.OllamaPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode embedding request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		res := rag.OllamaResponseEmbeddings{Embeddings: make([][]float32, len(payload.Input))}
+		for i, text := range payload.Input {
+			embedding := make([]float32, 16)
+			embedding[0] = 1 // Never all zeros
+			for _, word := range strings.Fields(strings.ToLower(text)) {
+				h := fnv.New32a()
+				h.Write([]byte(word))
+				embedding[h.Sum32()%16]++
+			}
+			res.Embeddings[i] = embedding
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+}
+
+func ingestTestBook(client *http.Client, baseURL, name string) (int64, error) {
+	var text strings.Builder
+	for i := range 40 {
+		fmt.Fprintf(&text, "Chapter %d\n\nThe whale swam past ship number %d while the captain watched the sea.\n\n", i+1, i)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("name", name)
+	form.WriteField("text", text.String())
+	form.WriteField("entities", rag.EntityMethodNone)
+	form.Close()
+
+	res, err := client.Post(baseURL+"/books", form.FormDataContentType(), &body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("ingest returned status %d", res.StatusCode)
+	}
+
+	var ingested IngestBookSuccessResponse
+	if err := json.NewDecoder(res.Body).Decode(&ingested); err != nil {
+		return 0, err
+	}
+	return ingested.BookID, nil
+}
+
+// TestConcurrentRequests queries, lists and ingests books in parallel with
+// fewer pool connections than requests. It needs a test database at
+// DATABASE_URL, embeddings are faked. Don't point it at a real database: the
+// test books are deleted afterwards, but while it runs their fake embeddings
+// have a different size than real ones and break searches across books.
+func TestConcurrentRequests(t *testing.T) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+
+	ollama := fakeOllama(t)
+	defer ollama.Close()
+	rag.OllamaBaseURL = ollama.URL
+
+	dbConfig := config.Default().Database
+	dbConfig.URL = dbURL
+	dbConfig.MigrationsDir = "../db/migrations"
+	dbConfig.MaxConns = 4
+	if err := db.Init(dbConfig); err != nil {
+		t.Fatalf("Couldn't init db: %v", err)
+	}
+	t.Cleanup(db.Teardown) // Runs after the cleanup deleting the test books
+
+	r := chi.NewRouter()
+	r.Get("/books", HandleListBooks)
+	r.Post("/books", HandleIngestBook)
+	r.Post("/books/{bookID}/query", HandleQueryBook)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	client := &http.Client{Timeout: time.Minute}
+
+	prefix := fmt.Sprintf("concurrency-test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		// Passages, chapters and everything else of a book are deleted with it
+		if _, err := db.Pool.Exec(context.Background(), "DELETE FROM rag.book WHERE book_name LIKE $1", prefix+"%"); err != nil {
+			t.Errorf("Couldn't delete the test books: %v", err)
+		}
+	})
+	bookID, err := ingestTestBook(client, server.URL, prefix)
+	if err != nil {
+		t.Fatalf("Couldn't ingest the test book: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 5 {
+				switch (worker + i) % 4 {
+				case 0:
+					if _, err := ingestTestBook(client, server.URL, fmt.Sprintf("%s-%d-%d", prefix, worker, i)); err != nil {
+						t.Errorf("Ingest failed: %v", err)
+					}
+				case 1:
+					res, err := client.Get(server.URL + "/books")
+					if err != nil {
+						t.Errorf("Listing books failed: %v", err)
+						continue
+					}
+					res.Body.Close()
+					if res.StatusCode != http.StatusOK {
+						t.Errorf("Listing books returned status %d", res.StatusCode)
+					}
+				default:
+					query := fmt.Sprintf(`{"query": "the whale and ship %d", "limit": 5, "window": 1, "min_similarity": 0}`, i)
+					res, err := client.Post(fmt.Sprintf("%s/books/%d/query", server.URL, bookID), "application/json", strings.NewReader(query))
+					if err != nil {
+						t.Errorf("Query failed: %v", err)
+						continue
+					}
+					var queried QueryBookResponse
+					decodeErr := json.NewDecoder(res.Body).Decode(&queried)
+					res.Body.Close()
+					if res.StatusCode != http.StatusOK || decodeErr != nil {
+						t.Errorf("Query returned status %d: %v", res.StatusCode, decodeErr)
+					} else if len(queried.Passages) == 0 {
+						t.Errorf("Query returned no passages")
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stat := db.Pool.Stat(); stat.AcquiredConns() != 0 {
+		t.Errorf("Expected all connections back in the pool, %d still acquired", stat.AcquiredConns())
+	}
+}
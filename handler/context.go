@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/embiem/book-rag/rag"
+)
+
+// DefaultGenerateLimit is the number of passages retrieved for generation.
+// The context budget decides how many of them reach the LLM.
+const DefaultGenerateLimit = 20
+
+// ContextEntry describes a passage, or a window of passages, considered for the context
+type ContextEntry struct {
+	PassageIDs     []int64 `json:"passage_ids"` // For windows, the hits the window was built around
+	StartOrdinal   int32   `json:"start_ordinal"`
+	EndOrdinal     int32   `json:"end_ordinal"`
+	Tokens         int     `json:"tokens"`
+	OriginalTokens int     `json:"original_tokens,omitempty"` // Set if the entry was trimmed
+	Trimmed        bool    `json:"trimmed,omitempty"`
+}
+
+// ContextReport tells which retrieved passages were given to the LLM
+type ContextReport struct {
+	Model      string         `json:"model"`
+	Budget     int            `json:"budget"`
+	UsedTokens int            `json:"used_tokens"`
+	Included   []ContextEntry `json:"included"`
+	Cut        []ContextEntry `json:"cut"`
+}
+
+func contextBudget(requested int) int {
+	return rag.ContextBudget(rag.GenerationModel(), requested)
+}
+
+func formatContextBlock(similarity float32, text string) string {
+	return fmt.Sprintf("Relevance: %d%%\n%s", int(math.Round(float64(similarity)*100)), text)
+}
+
+// buildContext packs the retrieved passages, or their windows if the query
+// expanded them, into the token budget. Every block is sanitized and wrapped
+// in <passage> tags, as book text is untrusted. It returns the context for the
+// prompt, the passages that made it in, a report of what was included and cut
+// and the text of every included block as the LLM sees it, to check the
+// answer against.
+func buildContext(queryResult *QueryBookResponse, budget int) (string, []PassageResult, ContextReport, []rag.GroundingPassage) {
+	model := rag.GenerationModel()
+
+	var blocks []string
+	var entries []ContextEntry
+	if len(queryResult.Windows) > 0 {
+		for _, w := range queryResult.Windows {
+			blocks = append(blocks, formatContextBlock(w.Similarity, w.Text))
+			entries = append(entries, ContextEntry{PassageIDs: w.HitIDs, StartOrdinal: w.StartOrdinal, EndOrdinal: w.EndOrdinal})
+		}
+	} else {
+		for _, p := range queryResult.Passages {
+			blocks = append(blocks, formatContextBlock(p.Similarity, p.Text))
+			entries = append(entries, ContextEntry{PassageIDs: []int64{p.ID}, StartOrdinal: p.Ordinal, EndOrdinal: p.Ordinal})
+		}
+	}
+
+	pack := rag.PackContext(model, blocks, budget)
+
+	report := ContextReport{
+		Model:      model,
+		Budget:     pack.Budget,
+		UsedTokens: pack.UsedTokens,
+		Included:   []ContextEntry{},
+		Cut:        []ContextEntry{},
+	}
+
+	passagesByID := make(map[int64]PassageResult, len(queryResult.Passages))
+	for _, p := range queryResult.Passages {
+		passagesByID[p.ID] = p
+	}
+
+	var b strings.Builder
+	var included []PassageResult
+	var grounding []rag.GroundingPassage
+	for _, block := range pack.Included {
+		entry := entries[block.Index]
+		entry.Tokens = block.Tokens
+		if block.Trimmed {
+			entry.OriginalTokens = rag.CountTokens(model, blocks[block.Index])
+			entry.Trimmed = true
+		}
+		report.Included = append(report.Included, entry)
+
+		b.WriteString(rag.DelimitPassage(block.Text) + "\n\n")
+		_, text, _ := strings.Cut(block.Text, "\n") // Without the relevance line
+		grounding = append(grounding, rag.GroundingPassage{IDs: entry.PassageIDs, Text: text})
+		for _, id := range entry.PassageIDs {
+			p := passagesByID[id]
+			if block.Trimmed && len(queryResult.Windows) == 0 {
+				p.Text = text
+			}
+			included = append(included, p)
+		}
+	}
+
+	for _, i := range pack.Dropped {
+		entry := entries[i]
+		entry.Tokens = rag.CountTokens(model, blocks[i])
+		report.Cut = append(report.Cut, entry)
+	}
+
+	return b.String(), included, report, grounding
+}
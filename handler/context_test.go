@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildContext(t *testing.T) {
+	queryResult := &QueryBookResponse{
+		Passages: []PassageResult{
+			{ID: 1, Ordinal: 4, Text: strings.Repeat("whale ", 60), Similarity: 0.9},
+			{ID: 2, Ordinal: 9, Text: strings.Repeat("ships ", 60), Similarity: 0.8},
+			{ID: 3, Ordinal: 2, Text: strings.Repeat("ocean ", 60), Similarity: 0.7},
+		},
+	}
+
+	// Room for the first two passages only
+	retrievedContext, included, report, grounding := buildContext(queryResult, 250)
+
+	if len(included) != 2 || included[0].ID != 1 || included[1].ID != 2 {
+		t.Fatalf("Expected the two best passages, got %+v", included)
+	}
+	if len(report.Included) != 2 || len(report.Cut) != 1 || report.Cut[0].PassageIDs[0] != 3 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if report.UsedTokens > report.Budget || report.Budget != 250 {
+		t.Errorf("Expected at most 250 tokens, used %d of %d", report.UsedTokens, report.Budget)
+	}
+	if !strings.Contains(retrievedContext, "whale") || strings.Contains(retrievedContext, "ocean") {
+		t.Errorf("Expected only included passages in the context, got %q", retrievedContext)
+	}
+	if strings.Count(retrievedContext, "<passage>") != 2 || strings.Count(retrievedContext, "</passage>") != 2 {
+		t.Errorf("Expected every passage in tags, got %q", retrievedContext)
+	}
+	if len(grounding) != 2 || grounding[0].Text != included[0].Text || grounding[1].IDs[0] != 2 {
+		t.Errorf("Expected the included passages to ground the answer, got %+v", grounding)
+	}
+
+	// Windows replace passages if the query expanded them
+	queryResult.Windows = []PassageWindow{{StartOrdinal: 3, EndOrdinal: 5, HitIDs: []int64{1}, Similarity: 0.9, Text: "before\n\nwindow text\n\nafter"}}
+	retrievedContext, included, report, grounding = buildContext(queryResult, 250)
+	if len(included) != 1 || included[0].ID != 1 || report.Included[0].EndOrdinal != 5 {
+		t.Errorf("Expected the window's hit, got %+v and %+v", included, report)
+	}
+	if !strings.Contains(retrievedContext, "window text") {
+		t.Errorf("Expected the window text in the context, got %q", retrievedContext)
+	}
+
+	// Claims are checked against the whole window, including the neighbors
+	// the LLM saw, not only the hit
+	if len(grounding) != 1 || grounding[0].Text != "before\n\nwindow text\n\nafter" || grounding[0].IDs[0] != 1 {
+		t.Errorf("Expected the window to ground the answer, got %+v", grounding)
+	}
+}
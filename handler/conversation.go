@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// MaxHistoryMessages caps how many previous messages are given to the LLM
+const MaxHistoryMessages = 10
+
+type ConversationResponse struct {
+	ID        int64                 `json:"id"`
+	BookID    int64                 `json:"book_id"`
+	CreatedAt time.Time             `json:"created_at"`
+	Messages  []ConversationMessage `json:"messages"`
+}
+
+type ConversationMessage struct {
+	ID              int64           `json:"id"`
+	Role            string          `json:"role"`
+	Content         string          `json:"content"`
+	StandaloneQuery string          `json:"standalone_query,omitempty"`
+	Citations       []PassageResult `json:"citations,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+type SendMessageRequest struct {
+	Content       string `json:"content"`
+	PromptPreset  string `json:"prompt_preset"`
+	ContextTokens int    `json:"context_tokens"`
+
+	// Retrieval options for the turn, like the ones of /rag
+	Limit            int              `json:"limit"`
+	Window           int              `json:"window"`
+	Rerank           bool             `json:"rerank"`
+	RerankCandidates int              `json:"rerank_candidates"`
+	MMR              bool             `json:"mmr"`
+	Lambda           *float32         `json:"lambda"`
+	MinSimilarity    *float32         `json:"min_similarity"`
+	QueryStrategy    string           `json:"query_strategy"`
+	ReadingPosition  *ReadingPosition `json:"reading_position"`
+	Entities         []string         `json:"entities"`
+	ExcludeFlagged   bool             `json:"exclude_flagged"`
+}
+
+type SendMessageResponse struct {
+	ConversationID      int64               `json:"conversation_id"`
+	StandaloneQuery     string              `json:"standalone_query"`
+	InsufficientContext bool                `json:"insufficient_context"`
+	Context             *ContextReport      `json:"context,omitempty"`
+	UserMessage         ConversationMessage `json:"user_message"`
+	AssistantMessage    ConversationMessage `json:"assistant_message"`
+}
+
+func EnsureConversationExists(r *http.Request) (data.RagConversation, error) {
+	conversationIDStr := chi.URLParam(r, "conversationID")
+	conversationID, err := strconv.ParseInt(conversationIDStr, 10, 64)
+	if err != nil {
+		return data.RagConversation{}, HttpError{Msg: "Invalid or missing conversation ID", Status: http.StatusBadRequest}
+	}
+
+	conversation, err := db.Queries.GetConversation(r.Context(), conversationID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.RagConversation{}, HttpError{Msg: "Conversation not found", Status: http.StatusNotFound}
+	}
+	if err != nil {
+		slog.Error("Failed to get conversation", "err", err, "conversation_id", conversationID)
+		return data.RagConversation{}, HttpError{Msg: "Could not get conversation", Status: http.StatusInternalServerError}
+	}
+
+	return conversation, nil
+}
+
+func newConversationMessage(m data.RagConversationMessage, citations []PassageResult) ConversationMessage {
+	return ConversationMessage{
+		ID:              m.ID,
+		Role:            m.Role,
+		Content:         m.Content,
+		StandaloneQuery: m.StandaloneQuery,
+		Citations:       citations,
+		CreatedAt:       m.CreatedAt.Time,
+	}
+}
+
+func HandleCreateConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	conversation, err := db.Queries.CreateConversation(r.Context(), bookID)
+	if err != nil {
+		slog.Error("Could not create conversation in DB", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(ConversationResponse{
+		ID:        conversation.ID,
+		BookID:    conversation.BookID,
+		CreatedAt: conversation.CreatedAt.Time,
+		Messages:  []ConversationMessage{},
+	})
+}
+
+// HandleSendMessage appends a user turn to the conversation and answers it.
+// The turn is condensed into a standalone query for retrieval, while the
+// answer is generated with the conversation history in mind.
+func HandleSendMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	conversation, err := EnsureConversationExists(r)
+	if err != nil {
+		if convErr, ok := err.(HttpError); ok {
+			w.WriteHeader(convErr.Status)
+			enc.Encode(ErrorResponse{Error: convErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || strings.TrimSpace(payload.Content) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "content is required"})
+		return
+	}
+
+	preset, book, err := resolvePromptPreset(r.Context(), payload.PromptPreset, conversation.BookID)
+	if err != nil {
+		httpErr := err.(HttpError)
+		w.WriteHeader(httpErr.Status)
+		enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		return
+	}
+
+	messages, err := db.Queries.ListConversationMessages(r.Context(), conversation.ID)
+	if err != nil {
+		slog.Error("Failed to list conversation messages", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	history := make([]rag.ChatTurn, 0, MaxHistoryMessages)
+	for _, m := range messages[max(len(messages)-MaxHistoryMessages, 0):] {
+		history = append(history, rag.ChatTurn{Role: m.Role, Content: m.Content})
+	}
+
+	standaloneQuery, err := rag.CondenseQuery(r.Context(), history, payload.Content)
+	if err != nil {
+		slog.Error("Failed to condense query", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not generate response"})
+		return
+	}
+
+	queryResult, err := QueryBook(r.Context(), QueryBookRequest{
+		Query:            standaloneQuery,
+		Limit:            cmp.Or(payload.Limit, DefaultGenerateLimit),
+		Window:           payload.Window,
+		Rerank:           payload.Rerank,
+		RerankCandidates: payload.RerankCandidates,
+		MMR:              payload.MMR,
+		Lambda:           payload.Lambda,
+		MinSimilarity:    payload.MinSimilarity,
+		QueryStrategy:    payload.QueryStrategy,
+		ReadingPosition:  payload.ReadingPosition,
+		Entities:         payload.Entities,
+		ExcludeFlagged:   payload.ExcludeFlagged,
+	}, conversation.BookID)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Error querying the book"})
+		}
+		return
+	}
+
+	answer := InsufficientContextAnswer
+	insufficientContext := len(queryResult.Passages) == 0
+	cited := queryResult.Passages
+	var contextReport *ContextReport
+	if !insufficientContext {
+		retrievedContext, included, report, _ := buildContext(queryResult, contextBudget(payload.ContextTokens))
+		cited, contextReport = included, &report
+
+		prompt, err := buildPrompt(preset, book, included, rag.PromptData{
+			Query:           payload.Content,
+			Context:         retrievedContext,
+			History:         history,
+			ReadingPosition: queryResult.ReadingPosition,
+		})
+		if err != nil {
+			slog.Error("Failed to render prompt", "err", err, "prompt_preset", preset)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not generate response"})
+			return
+		}
+
+		answer, err = rag.GenerateText(r.Context(), prompt)
+		if err != nil {
+			slog.Error("Error during LLM generation", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not generate response"})
+			return
+		}
+	}
+
+	citedIDs := make([]int64, len(cited))
+	for i, p := range cited {
+		citedIDs[i] = p.ID
+	}
+
+	// Only store the turn once it has been answered
+	tx, err := db.Pool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	qtx := db.Queries.WithTx(tx)
+	userMessage, err := qtx.CreateConversationMessage(r.Context(), data.CreateConversationMessageParams{
+		ConversationID:  conversation.ID,
+		Role:            "user",
+		Content:         payload.Content,
+		StandaloneQuery: standaloneQuery,
+		CitedPassageIds: []int64{},
+	})
+	if err != nil {
+		slog.Error("Could not store user message", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	assistantMessage, err := qtx.CreateConversationMessage(r.Context(), data.CreateConversationMessageParams{
+		ConversationID:  conversation.ID,
+		Role:            "assistant",
+		Content:         answer,
+		CitedPassageIds: citedIDs,
+	})
+	if err != nil {
+		slog.Error("Could not store assistant message", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		slog.Error("Failed to commit transaction", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(SendMessageResponse{
+		ConversationID:      conversation.ID,
+		StandaloneQuery:     standaloneQuery,
+		InsufficientContext: insufficientContext,
+		Context:             contextReport,
+		UserMessage:         newConversationMessage(userMessage, nil),
+		AssistantMessage:    newConversationMessage(assistantMessage, cited),
+	})
+}
+
+// HandleGetConversation replays the transcript, including the passages each
+// answer was generated from
+func HandleGetConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	conversation, err := EnsureConversationExists(r)
+	if err != nil {
+		if convErr, ok := err.(HttpError); ok {
+			w.WriteHeader(convErr.Status)
+			enc.Encode(ErrorResponse{Error: convErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	messages, err := db.Queries.ListConversationMessages(r.Context(), conversation.ID)
+	if err != nil {
+		slog.Error("Failed to list conversation messages", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	var citedIDs []int64
+	for _, m := range messages {
+		citedIDs = append(citedIDs, m.CitedPassageIds...)
+	}
+
+	passages, err := db.Queries.GetPassagesByIDs(r.Context(), citedIDs)
+	if err != nil {
+		slog.Error("Failed to get cited passages", "err", err, "conversation_id", conversation.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	passagesByID := make(map[int64]PassageResult, len(passages))
+	for _, p := range passages {
+		passagesByID[p.ID] = PassageResult{
+			ID:      p.ID,
+			Ordinal: p.Ordinal,
+			Text:    p.PassageText,
+			Span:    newSourceSpan(p.StartByte, p.EndByte, p.StartRune, p.EndRune, p.StartLine, p.EndLine),
+		}
+	}
+
+	transcript := make([]ConversationMessage, len(messages))
+	for i, m := range messages {
+		var citations []PassageResult
+		for _, id := range m.CitedPassageIds {
+			if p, ok := passagesByID[id]; ok {
+				citations = append(citations, p)
+			}
+		}
+		transcript[i] = newConversationMessage(m, citations)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(ConversationResponse{
+		ID:        conversation.ID,
+		BookID:    conversation.BookID,
+		CreatedAt: conversation.CreatedAt.Time,
+		Messages:  transcript,
+	})
+}
@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+type EntityItem struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Aliases  []string `json:"aliases"`
+	Mentions int32    `json:"mentions"`
+	Passages int32    `json:"passages"` // Number of passages mentioning the entity
+}
+
+type ListEntitiesResponse struct {
+	BookID   int64        `json:"book_id"`
+	Entities []EntityItem `json:"entities"`
+}
+
+type ExtractEntitiesRequest struct {
+	Method string `json:"method"` // rules (default) or llm
+}
+
+type ExtractEntitiesResponse struct {
+	BookID      int64  `json:"book_id"`
+	Method      string `json:"method"`
+	EntityCount int    `json:"entity_count"`
+}
+
+// extractEntities runs the entity extraction method over a book's passages
+func extractEntities(ctx context.Context, method string, passages []data.GetPassagesInRangeRow) ([]rag.Entity, error) {
+	texts := make([]string, len(passages))
+	for i, p := range passages {
+		texts[i] = p.PassageText
+	}
+
+	switch method {
+	case rag.EntityMethodRules:
+		return rag.ExtractEntitiesRules(texts), nil
+	case rag.EntityMethodLLM:
+		return rag.NewGenerator().ExtractEntitiesLLM(ctx, texts)
+	}
+	return nil, nil
+}
+
+// storeEntities replaces the stored entities of a book and links them to the
+// passages mentioning them
+func storeEntities(ctx context.Context, qtx *data.Queries, bookID int64, entities []rag.Entity, passages []data.GetPassagesInRangeRow) error {
+	if err := qtx.DeleteBookEntities(ctx, bookID); err != nil {
+		slog.Error("Failed to delete entities", "err", err, "book_id", bookID)
+		return err
+	}
+
+	var links []data.CreatePassageEntitiesParams
+	for _, e := range entities {
+		entityID, err := qtx.CreateEntity(ctx, data.CreateEntityParams{
+			BookID:       bookID,
+			Name:         e.Name,
+			Kind:         e.Kind,
+			Aliases:      e.Aliases,
+			MentionCount: int32(e.Mentions()),
+		})
+		if err != nil {
+			slog.Error("Failed to create entity", "err", err, "book_id", bookID, "name", e.Name)
+			return err
+		}
+
+		for i, mentions := range e.Passages {
+			links = append(links, data.CreatePassageEntitiesParams{
+				PassageID:    passages[i].ID,
+				EntityID:     entityID,
+				MentionCount: int32(mentions),
+			})
+		}
+	}
+
+	var batchErr error
+	qtx.CreatePassageEntities(ctx, links).Exec(func(i int, err error) {
+		if err != nil {
+			slog.Error("Failed to link entity to passage", "index", i, "err", err)
+			batchErr = err
+		}
+	})
+	return batchErr
+}
+
+// resolveEntityFilter looks up entities by name or alias, case-insensitively
+func resolveEntityFilter(ctx context.Context, bookID int64, names []string) ([]int64, []string, error) {
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+
+	lowered := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			lowered = append(lowered, name)
+		}
+	}
+
+	rows, err := db.Queries.FindEntitiesByName(ctx, data.FindEntitiesByNameParams{
+		BookID: bookID,
+		Names:  lowered,
+	})
+	if err != nil {
+		slog.Error("Failed to find entities", "err", err, "book_id", bookID)
+		return nil, nil, err
+	}
+
+	found := make(map[string]bool)
+	ids := make([]int64, len(rows))
+	matched := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+		matched[i] = row.Name
+		for _, name := range append([]string{row.Name}, row.Aliases...) {
+			found[strings.ToLower(name)] = true
+		}
+	}
+
+	for _, name := range lowered {
+		if !found[name] {
+			return nil, nil, HttpError{Msg: fmt.Sprintf("Entity %q not found, see GET /books/%d/entities", name, bookID), Status: http.StatusBadRequest}
+		}
+	}
+
+	slices.Sort(matched)
+	return ids, matched, nil
+}
+
+func HandleListEntities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && !rag.IsValidEntityKind(kind) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "kind must be one of character, place, organization or other"})
+		return
+	}
+
+	entities, err := db.Queries.ListBookEntities(r.Context(), data.ListBookEntitiesParams{
+		BookID: bookID,
+		Kind:   kind,
+	})
+	if err != nil {
+		slog.Error("Failed to list entities", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	items := make([]EntityItem, len(entities))
+	for i, e := range entities {
+		items[i] = EntityItem{
+			ID:       e.ID,
+			Name:     e.Name,
+			Kind:     e.Kind,
+			Aliases:  e.Aliases,
+			Mentions: e.MentionCount,
+			Passages: e.PassageCount,
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(ListEntitiesResponse{
+		BookID:   bookID,
+		Entities: items,
+	})
+}
+
+// HandleExtractEntities (re-)extracts the entities of an ingested book, e.g.
+// with the LLM after a fast rule-based pass at ingestion
+func HandleExtractEntities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload ExtractEntitiesRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	method := payload.Method
+	if method == "" {
+		method = rag.EntityMethodRules
+	}
+	if method != rag.EntityMethodRules && method != rag.EntityMethodLLM {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "method must be one of rules or llm"})
+		return
+	}
+
+	passages, err := db.Queries.GetPassagesInRange(r.Context(), data.GetPassagesInRangeParams{
+		BookID:       bookID,
+		StartOrdinal: 0,
+		EndOrdinal:   math.MaxInt32,
+	})
+	if err != nil {
+		slog.Error("Failed to get passages", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	entities, err := extractEntities(r.Context(), method, passages)
+	if err != nil {
+		slog.Error("Failed to extract entities", "err", err, "book_id", bookID, "method", method)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not extract entities"})
+		return
+	}
+
+	tx, err := db.Pool.Begin(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	if err := storeEntities(r.Context(), db.Queries.WithTx(tx), bookID, entities, passages); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Failed to save entities to database"})
+		return
+	}
+
+	if err := tx.Commit(r.Context()); err != nil {
+		slog.Error("Failed to commit transaction", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(ExtractEntitiesResponse{
+		BookID:      bookID,
+		Method:      method,
+		EntityCount: len(entities),
+	})
+}
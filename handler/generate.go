@@ -1,18 +1,45 @@
 package handler
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/embiem/book-rag/rag"
 )
 
 type GenerateRequest struct {
-	Query string `json:"query"`
+	Query            string           `json:"query"`
+	Limit            int              `json:"limit"`
+	ContextTokens    int              `json:"context_tokens"`
+	Window           int              `json:"window"`
+	Rerank           bool             `json:"rerank"`
+	RerankCandidates int              `json:"rerank_candidates"`
+	MMR              bool             `json:"mmr"`
+	Lambda           *float32         `json:"lambda"`
+	MinSimilarity    *float32         `json:"min_similarity"`
+	QueryStrategy    string           `json:"query_strategy"`
+	Mode             string           `json:"mode"`       // single (default) or agent
+	MaxSteps         int              `json:"max_steps"`  // Agent mode only
+	MaxTokens        int64            `json:"max_tokens"` // Agent mode only
+	PromptPreset     string           `json:"prompt_preset"`
+	ReadingPosition  *ReadingPosition `json:"reading_position"`
+	Entities         []string         `json:"entities"`
+	Summaries        bool             `json:"summaries"`      // Add cached summaries to the context
+	SummaryLength    string           `json:"summary_length"` // short (default) or detailed
+	Schema           json.RawMessage  `json:"schema"`         // Built-in schema name or JSON Schema for a structured answer
+	Verify           string           `json:"verify"`         // Check the answer's claims and flag or remove unsupported ones
+	ExcludeFlagged   bool             `json:"exclude_flagged"`
 }
 
+// InsufficientContextAnswer is returned instead of asking the LLM when no
+// passage is relevant enough to ground an answer
+const InsufficientContextAnswer = "I could not find any passages in the book that are relevant enough to answer this query."
+
 func HandleGenerate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
@@ -22,6 +49,7 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) {
 		slog.Error("HandleGenerate: Body Decode error", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Invalid request body"))
+		return
 	}
 
 	bookID, err := EnsureBookExists(r)
@@ -36,41 +64,184 @@ func HandleGenerate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	schemaName, rawSchema, schema, err := resolveOutputSchema(payload.Schema)
+	if err != nil {
+		httpErr := err.(HttpError)
+		w.WriteHeader(httpErr.Status)
+		w.Write([]byte(httpErr.Msg))
+		return
+	}
+
+	if payload.Verify != "" && !rag.IsValidVerifyMode(payload.Verify) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("verify must be one of flag or remove"))
+		return
+	}
+	if payload.Verify != "" && schema != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("verify can't be combined with schema"))
+		return
+	}
+
+	switch payload.Mode {
+	case "", GenerateModeSingle:
+	case GenerateModeAgent:
+		if unsupported := agentUnsupportedOptions(payload); len(unsupported) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(strings.Join(unsupported, ", ") + " can't be used in agent mode"))
+			return
+		}
+		handleAgentGenerate(w, r, payload, bookID)
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("mode must be one of single or agent"))
+		return
+	}
+
+	preset, book, err := resolvePromptPreset(r.Context(), payload.PromptPreset, bookID)
+	if err != nil {
+		httpErr := err.(HttpError)
+		w.WriteHeader(httpErr.Status)
+		w.Write([]byte(httpErr.Msg))
+		return
+	}
+
 	queryResult, err := QueryBook(r.Context(), QueryBookRequest{
-		Query: payload.Query,
-		Limit: 10,
+		Query:            payload.Query,
+		Limit:            cmp.Or(payload.Limit, DefaultGenerateLimit),
+		Window:           payload.Window,
+		Rerank:           payload.Rerank,
+		RerankCandidates: payload.RerankCandidates,
+		MMR:              payload.MMR,
+		Lambda:           payload.Lambda,
+		MinSimilarity:    payload.MinSimilarity,
+		QueryStrategy:    payload.QueryStrategy,
+		ReadingPosition:  payload.ReadingPosition,
+		Entities:         payload.Entities,
+		ExcludeFlagged:   payload.ExcludeFlagged,
 	}, bookID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error querying the book"))
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			w.Write([]byte(httpErr.Msg))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error querying the book"))
+		}
 		return
 	}
 
-	prompt := fmt.Sprintf(`You are an assistant in a book publishing company. Your task is to help with the following query:
-	"%s".
-
-	Here is some context that we pulled from the book:
-	
-	---
+	if len(queryResult.Passages) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"answer":               InsufficientContextAnswer,
+			"insufficient_context": true,
+			"best_similarity":      queryResult.BestSimilarity,
+			"min_similarity":       queryResult.MinSimilarity,
+			"queries_used":         queryResult.QueriesUsed,
+			"reading_position":     queryResult.ReadingPosition,
+			"retrieved_chunks":     0,
+			"retrieved_context":    "",
+		})
+		return
+	}
 
-	%s
+	// Summaries give an overview the passages alone can't, they count
+	// against the context budget
+	budget := contextBudget(payload.ContextTokens)
+	var summaries string
+	summariesUsed := []string{}
+	if payload.Summaries {
+		summaries, summariesUsed, err = summaryContext(r.Context(), bookID, cmp.Or(payload.SummaryLength, rag.SummaryLengthShort), queryResult)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Could not load summaries"))
+			return
+		}
+		budget = max(budget-rag.CountTokens(rag.GenerationModel(), summaries), 0)
+	}
 
-	---
+	retrievedContext, included, contextReport, grounding := buildContext(queryResult, budget)
 
-	Now help answering the following query: "%s"`, payload.Query, PrettifyPassages(queryResult.Passages), payload.Query)
+	prompt, err := buildPrompt(preset, book, included, rag.PromptData{
+		Query:           payload.Query,
+		Context:         retrievedContext,
+		Summaries:       summaries,
+		ReadingPosition: queryResult.ReadingPosition,
+	})
+	if err != nil {
+		slog.Error("Failed to render prompt", "err", err, "prompt_preset", preset)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not generate response"))
+		return
+	}
 
-	response, err := rag.GenerateText(r.Context(), prompt)
+	// A structured answer is JSON validated against the schema
+	var response string
+	var structured any
+	attempts := 1
+	if schema != nil {
+		structured, response, attempts, err = rag.NewGenerator().GenerateStructured(r.Context(), prompt, rawSchema, schema)
+	} else {
+		response, err = rag.GenerateText(r.Context(), prompt)
+	}
 	if err != nil {
+		var structuredErr *rag.StructuredOutputError
+		if errors.As(err, &structuredErr) {
+			slog.Warn("Structured answer did not validate", "errors", structuredErr.Errors, "schema", schemaName)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(StructuredOutputErrorResponse{
+				Error:            fmt.Sprintf("The answer did not validate against the schema after %d attempts", attempts),
+				RawOutput:        structuredErr.Raw,
+				ValidationErrors: structuredErr.Errors,
+			})
+			return
+		}
 		slog.Error("Error during LLM generation", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Could not generate response"))
+		return
+	}
+
+	// Optionally check every claim against the passages before answering
+	originalAnswer := response
+	var verification *VerificationReport
+	if payload.Verify != "" {
+		response, verification, err = verifyAnswer(r.Context(), payload.Query, response, payload.Verify, grounding)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Could not verify the answer"))
+			return
+		}
 	}
 
 	// Return JSON response with answer and metadata
 	jsonResponse := map[string]interface{}{
-		"answer":            response,
-		"retrieved_chunks":  len(queryResult.Passages),
-		"retrieved_context": PrettifyPassages(queryResult.Passages),
+		"answer":               response,
+		"prompt_preset":        cmp.Or(preset, rag.DefaultPromptPreset),
+		"insufficient_context": false,
+		"best_similarity":      queryResult.BestSimilarity,
+		"min_similarity":       queryResult.MinSimilarity,
+		"queries_used":         queryResult.QueriesUsed,
+		"reading_position":     queryResult.ReadingPosition,
+		"retrieved_chunks":     len(included),
+		"retrieved_context":    retrievedContext,
+		"context":              contextReport,
+		"summaries_used":       summariesUsed,
+	}
+	if verification != nil {
+		jsonResponse["verification"] = verification
+		if response != originalAnswer {
+			jsonResponse["original_answer"] = originalAnswer
+		}
+	}
+	if schema != nil {
+		jsonResponse["structured_answer"] = structured
+		jsonResponse["schema"] = schemaName
+		jsonResponse["attempts"] = attempts
 	}
 
 	w.Header().Set("Content-Type", "application/json")
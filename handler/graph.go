@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+// DefaultGraphMinWeight drops pairs mentioned together only once, which are
+// mostly coincidence
+const DefaultGraphMinWeight = 2
+
+// DefaultGraphNodes is the number of most mentioned entities in a graph
+const DefaultGraphNodes = 50
+
+// MaxGraphNodes caps the max_nodes parameter
+const MaxGraphNodes = 500
+
+// MaxLabeledEdges is the number of heaviest edges labeled by the LLM
+const MaxLabeledEdges = 30
+
+// MaxLabelPassages is the number of passages the LLM sees per relationship
+const MaxLabelPassages = 3
+
+type GraphResponse struct {
+	BookID    int64           `json:"book_id"`
+	Kind      string          `json:"kind"`
+	MinWeight int32           `json:"min_weight"`
+	Nodes     []rag.GraphNode `json:"nodes"`
+	Edges     []rag.GraphEdge `json:"edges"`
+}
+
+// buildGraph connects the most mentioned entities of a book by the number of
+// passages mentioning both
+func buildGraph(ctx context.Context, bookID int64, kind string, minWeight int32, maxNodes int) (rag.Graph, error) {
+	entities, err := db.Queries.ListBookEntities(ctx, data.ListBookEntitiesParams{
+		BookID: bookID,
+		Kind:   kind,
+	})
+	if err != nil {
+		slog.Error("Failed to list entities", "err", err, "book_id", bookID)
+		return rag.Graph{}, err
+	}
+
+	cooccurrences, err := db.Queries.GetEntityCooccurrences(ctx, data.GetEntityCooccurrencesParams{
+		BookID:    bookID,
+		Kind:      kind,
+		MinWeight: minWeight,
+	})
+	if err != nil {
+		slog.Error("Failed to get entity co-occurrences", "err", err, "book_id", bookID)
+		return rag.Graph{}, err
+	}
+
+	graph := rag.Graph{Nodes: []rag.GraphNode{}, Edges: []rag.GraphEdge{}}
+	included := make(map[int64]bool)
+	for _, e := range entities[:min(maxNodes, len(entities))] {
+		graph.Nodes = append(graph.Nodes, rag.GraphNode{
+			ID:       e.ID,
+			Name:     e.Name,
+			Kind:     e.Kind,
+			Mentions: e.MentionCount,
+		})
+		included[e.ID] = true
+	}
+
+	for _, c := range cooccurrences {
+		if included[c.SourceID] && included[c.TargetID] {
+			graph.Edges = append(graph.Edges, rag.GraphEdge{
+				Source:     c.SourceID,
+				Target:     c.TargetID,
+				Weight:     c.Weight,
+				PassageIDs: c.PassageIds,
+			})
+		}
+	}
+
+	return graph, nil
+}
+
+// labelGraph lets the LLM label the relationships of the heaviest edges
+func labelGraph(ctx context.Context, graph rag.Graph) error {
+	names := make(map[int64]string, len(graph.Nodes))
+	for _, n := range graph.Nodes {
+		names[n.ID] = n.Name
+	}
+
+	edges := graph.Edges[:min(MaxLabeledEdges, len(graph.Edges))]
+	var passageIDs []int64
+	for _, e := range edges {
+		passageIDs = append(passageIDs, e.PassageIDs[:min(MaxLabelPassages, len(e.PassageIDs))]...)
+	}
+
+	passages, err := db.Queries.GetPassagesByIDs(ctx, passageIDs)
+	if err != nil {
+		slog.Error("Failed to get passages", "err", err)
+		return err
+	}
+	texts := make(map[int64]string, len(passages))
+	for _, p := range passages {
+		texts[p.ID] = p.PassageText
+	}
+
+	samples := make([]rag.RelationshipSample, len(edges))
+	for i, e := range edges {
+		samples[i] = rag.RelationshipSample{Source: names[e.Source], Target: names[e.Target]}
+		for _, id := range e.PassageIDs[:min(MaxLabelPassages, len(e.PassageIDs))] {
+			samples[i].Passages = append(samples[i].Passages, texts[id])
+		}
+	}
+
+	labels, err := rag.NewGenerator().LabelRelationships(ctx, samples)
+	if err != nil {
+		slog.Error("Failed to label relationships", "err", err)
+		return err
+	}
+	for i, label := range labels {
+		graph.Edges[i].Label = label
+	}
+	return nil
+}
+
+// HandleGetGraph returns the co-occurrence graph of a book's characters (or
+// other entities) as JSON, GraphML or DOT
+func HandleGetGraph(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	query := r.URL.Query()
+
+	format := query.Get("format")
+	if format == "" {
+		format = rag.GraphFormatJSON
+	}
+	if !rag.IsValidGraphFormat(format) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "format must be one of json, graphml or dot"})
+		return
+	}
+
+	// Optional entity kind (default character, all for every kind)
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = rag.EntityKindCharacter
+	}
+	if kind == "all" {
+		kind = ""
+	} else if !rag.IsValidEntityKind(kind) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "kind must be one of character, place, organization, other or all"})
+		return
+	}
+
+	minWeight := DefaultGraphMinWeight
+	if raw := query.Get("min_weight"); raw != "" {
+		minWeight, err = strconv.Atoi(raw)
+		if err != nil || minWeight < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrorResponse{Error: "min_weight must be a positive integer"})
+			return
+		}
+	}
+
+	maxNodes := DefaultGraphNodes
+	if raw := query.Get("max_nodes"); raw != "" {
+		maxNodes, err = strconv.Atoi(raw)
+		if err != nil || maxNodes < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrorResponse{Error: "max_nodes must be a positive integer"})
+			return
+		}
+		maxNodes = min(maxNodes, MaxGraphNodes)
+	}
+
+	graph, err := buildGraph(r.Context(), bookID, kind, int32(minWeight), maxNodes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	if labels, _ := strconv.ParseBool(query.Get("labels")); labels && len(graph.Edges) > 0 {
+		if err := labelGraph(r.Context(), graph); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not label relationships"})
+			return
+		}
+	}
+
+	switch format {
+	case rag.GraphFormatGraphML:
+		out, err := rag.FormatGraphML(graph)
+		if err != nil {
+			slog.Error("Failed to render GraphML", "err", err, "book_id", bookID)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/graphml+xml")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(out))
+	case rag.GraphFormatDOT:
+		book, err := db.Queries.GetBook(r.Context(), bookID)
+		if err != nil {
+			slog.Error("Failed to get book", "err", err, "book_id", bookID)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(rag.FormatDOT(book.BookName, graph)))
+	default:
+		w.WriteHeader(http.StatusOK)
+		enc.Encode(GraphResponse{
+			BookID:    bookID,
+			Kind:      cmp.Or(kind, "all"),
+			MinWeight: int32(minWeight),
+			Nodes:     graph.Nodes,
+			Edges:     graph.Edges,
+		})
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"strings"
 
 	"github.com/embiem/book-rag/data"
 	"github.com/embiem/book-rag/db"
 	"github.com/embiem/book-rag/rag"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pgvector/pgvector-go"
 )
 
@@ -20,11 +22,34 @@ type ErrorResponse struct {
 }
 
 type IngestBookSuccessResponse struct {
-	Message    string `json:"message"`
-	BookName   string `json:"book_name"`
-	BookID     int64  `json:"book_id"`
-	TextSize   int    `json:"text_size"`
-	ChunkCount int    `json:"chunk_count"`
+	Message      string   `json:"message"`
+	BookName     string   `json:"book_name"`
+	BookID       int64    `json:"book_id"`
+	Author       string   `json:"author"`
+	Tags         []string `json:"tags"`
+	PromptPreset string   `json:"prompt_preset"`
+	TextSize     int      `json:"text_size"`
+	ChunkCount   int      `json:"chunk_count"`
+	ChapterCount int      `json:"chapter_count"`
+	EntityCount  int      `json:"entity_count"`
+	FlaggedCount int      `json:"flagged_count"` // Passages flagged as possible prompt injections
+}
+
+// parseTags turns a comma separated list into lowercased, unique tags
+func parseTags(raw string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
 }
 
 func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +72,29 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Optional metadata used to filter library searches
+	author := strings.TrimSpace(r.FormValue("author"))
+	tags := parseTags(r.FormValue("tags"))
+
+	// Optional prompt preset used when RAG requests don't select one
+	promptPreset := strings.TrimSpace(r.FormValue("prompt_preset"))
+	if promptPreset != "" && !rag.IsValidPromptPreset(promptPreset) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "prompt_preset must be one of " + strings.Join(rag.PromptPresets(), ", ")})
+		return
+	}
+
+	// Optional entity extraction method (default rules)
+	entityMethod := strings.TrimSpace(r.FormValue("entities"))
+	if entityMethod == "" {
+		entityMethod = rag.EntityMethodRules
+	}
+	if !rag.IsValidEntityMethod(entityMethod) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "entities must be one of rules, llm or none"})
+		return
+	}
+
 	var text string
 
 	// Check if text is provided directly in the form
@@ -87,19 +135,32 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 	// Normalize line endings (convert CRLF to LF) to ensure consistent chunking
 	text = strings.ReplaceAll(text, "\r\n", "\n")
 
-	tx, err := db.Conn.Begin(r.Context())
+	// Ingestion runs as a job: a client disconnecting doesn't abort it halfway
+	// and a shutdown waits for it to finish
+	ctx, done, err := jobs.start(r.Context())
+	if err != nil {
+		w.WriteHeader(errShuttingDown.Status)
+		enc.Encode(ErrorResponse{Error: errShuttingDown.Msg})
+		return
+	}
+	defer done()
+
+	tx, err := db.Pool.Begin(ctx)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
 		return
 	}
-	defer tx.Rollback(r.Context())
+	defer tx.Rollback(ctx)
 
 	// All good, now we can insert to db, chunk & create embeddings
 	qtx := db.Queries.WithTx(tx)
-	book, err := qtx.CreateBook(r.Context(), data.CreateBookParams{
-		BookName: bookName,
-		BookText: text,
+	book, err := qtx.CreateBook(ctx, data.CreateBookParams{
+		BookName:     bookName,
+		BookText:     text,
+		Author:       author,
+		Tags:         tags,
+		PromptPreset: promptPreset,
 	})
 	if err != nil {
 		slog.Error("Could not create book in DB", "err", err)
@@ -109,7 +170,7 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Split text into chunks
-	chunks := rag.ChunkText(text)
+	chunks := rag.ChunkTextWithSpans(text)
 	if len(chunks) == 0 {
 		slog.Error("No chunks generated from text")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -120,7 +181,11 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Generated text chunks", "count", len(chunks), "book_id", book.ID)
 
 	// Generate embeddings for all chunks
-	embeddings, err := rag.GenerateEmbeddings(chunks)
+	chunkTexts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		chunkTexts[i] = chunk.Text
+	}
+	embeddings, err := rag.GenerateEmbeddings(chunkTexts)
 	if err != nil {
 		slog.Error("Failed to generate embeddings", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -135,18 +200,35 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Prepare batch insert parameters
+	// Prepare batch insert parameters, scanning every passage for text aimed
+	// at the LLM
+	flaggedCount := 0
 	passageParams := make([]data.CreateBookPassagesParams, len(chunks))
 	for i, chunk := range chunks {
+		flags := rag.ScanInjection(chunk.Text)
+		if len(flags) > 0 {
+			flaggedCount++
+		} else {
+			flags = []string{}
+		}
+
 		passageParams[i] = data.CreateBookPassagesParams{
-			BookID:      book.ID,
-			PassageText: chunk,
-			Embedding:   pgvector.NewVector(embeddings[i]),
+			BookID:         book.ID,
+			PassageText:    chunk.Text,
+			Embedding:      pgvector.NewVector(embeddings[i]),
+			Ordinal:        int32(i),
+			StartByte:      pgtype.Int4{Int32: int32(chunk.StartByte), Valid: true},
+			EndByte:        pgtype.Int4{Int32: int32(chunk.EndByte), Valid: true},
+			StartRune:      pgtype.Int4{Int32: int32(chunk.StartRune), Valid: true},
+			EndRune:        pgtype.Int4{Int32: int32(chunk.EndRune), Valid: true},
+			StartLine:      pgtype.Int4{Int32: int32(chunk.StartLine), Valid: true},
+			EndLine:        pgtype.Int4{Int32: int32(chunk.EndLine), Valid: true},
+			InjectionFlags: flags,
 		}
 	}
 
 	// Batch insert all passages with embeddings
-	batchResults := qtx.CreateBookPassages(r.Context(), passageParams)
+	batchResults := qtx.CreateBookPassages(ctx, passageParams)
 	var batchErr error
 	batchResults.Exec(func(i int, err error) {
 		if err != nil {
@@ -161,7 +243,60 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := tx.Commit(r.Context()); err != nil {
+	// Chapters are used to resolve reading positions
+	chapters := rag.DetectChapters(text)
+	chapterParams := make([]data.CreateBookChaptersParams, len(chapters))
+	for i, chapter := range chapters {
+		chapterParams[i] = data.CreateBookChaptersParams{
+			BookID:    book.ID,
+			Ordinal:   int32(chapter.Ordinal),
+			Title:     chapter.Title,
+			StartRune: int32(chapter.StartRune),
+			EndRune:   int32(chapter.EndRune),
+		}
+	}
+
+	qtx.CreateBookChapters(ctx, chapterParams).Exec(func(i int, err error) {
+		if err != nil {
+			slog.Error("Failed to insert chapter", "index", i, "err", err)
+			batchErr = err
+		}
+	})
+
+	if batchErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Failed to save chapters to database"})
+		return
+	}
+
+	// Entities are linked to passages by ID, so read the passages back
+	storedPassages, err := qtx.GetPassagesInRange(ctx, data.GetPassagesInRangeParams{
+		BookID:       book.ID,
+		StartOrdinal: 0,
+		EndOrdinal:   math.MaxInt32,
+	})
+	if err != nil {
+		slog.Error("Failed to get passages", "err", err, "book_id", book.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	entities, err := extractEntities(ctx, entityMethod, storedPassages)
+	if err != nil {
+		slog.Error("Failed to extract entities", "err", err, "book_id", book.ID, "method", entityMethod)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not extract entities"})
+		return
+	}
+
+	if err := storeEntities(ctx, qtx, book.ID, entities, storedPassages); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Failed to save entities to database"})
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		slog.Error("Failed to commit transaction", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
@@ -173,6 +308,9 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Book Name: %s\n", bookName)
 	fmt.Printf("Text Size: %d characters\n", len(text))
 	fmt.Printf("Chunks Created: %d\n", len(chunks))
+	fmt.Printf("Chapters Detected: %d\n", len(chapters))
+	fmt.Printf("Entities Extracted: %d (%s)\n", len(entities), entityMethod)
+	fmt.Printf("Passages Flagged: %d\n", flaggedCount)
 	// fmt.Println("Text Content:")
 	// fmt.Println(text)
 	fmt.Println("======================")
@@ -180,10 +318,16 @@ func HandleIngestBook(w http.ResponseWriter, r *http.Request) {
 	// Return success response
 	w.WriteHeader(http.StatusOK)
 	enc.Encode(IngestBookSuccessResponse{
-		Message:    "Book ingested successfully with embeddings",
-		BookName:   bookName,
-		BookID:     book.ID,
-		TextSize:   len(text),
-		ChunkCount: len(chunks),
+		Message:      "Book ingested successfully with embeddings",
+		BookName:     bookName,
+		BookID:       book.ID,
+		Author:       author,
+		Tags:         tags,
+		PromptPreset: promptPreset,
+		TextSize:     len(text),
+		ChunkCount:   len(chunks),
+		ChapterCount: len(chapters),
+		EntityCount:  len(entities),
+		FlaggedCount: flaggedCount,
 	})
 }
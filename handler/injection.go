@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+type FlaggedPassageItem struct {
+	PassageID int64       `json:"passage_id"`
+	Ordinal   int32       `json:"ordinal"`
+	Flags     []string    `json:"flags"`
+	Text      string      `json:"text"`
+	Span      *SourceSpan `json:"span,omitempty"`
+}
+
+type InjectionReportResponse struct {
+	BookID       int64                `json:"book_id"`
+	FlaggedCount int                  `json:"flagged_count"`
+	Passages     []FlaggedPassageItem `json:"passages"`
+}
+
+// loadInjectionReport lists the passages of a book the prompt-injection
+// scanner flagged, in book order
+func loadInjectionReport(ctx context.Context, bookID int64) (*InjectionReportResponse, error) {
+	rows, err := db.Queries.GetFlaggedPassages(ctx, bookID)
+	if err != nil {
+		slog.Error("Failed to get flagged passages", "err", err, "book_id", bookID)
+		return nil, err
+	}
+
+	res := &InjectionReportResponse{BookID: bookID, FlaggedCount: len(rows), Passages: make([]FlaggedPassageItem, len(rows))}
+	for i, row := range rows {
+		res.Passages[i] = FlaggedPassageItem{
+			PassageID: row.ID,
+			Ordinal:   row.Ordinal,
+			Flags:     row.InjectionFlags,
+			Text:      row.PassageText,
+			Span:      newSourceSpan(row.StartByte, row.EndByte, row.StartRune, row.EndRune, row.StartLine, row.EndLine),
+		}
+	}
+	return res, nil
+}
+
+// scanInjections scans all passages of a book again and stores the flags,
+// e.g. for books ingested before the scanner existed or after its rules changed
+func scanInjections(ctx context.Context, bookID int64) error {
+	passages, err := db.Queries.GetPassagesInRange(ctx, data.GetPassagesInRangeParams{
+		BookID:       bookID,
+		StartOrdinal: 0,
+		EndOrdinal:   math.MaxInt32,
+	})
+	if err != nil {
+		slog.Error("Failed to get passages", "err", err, "book_id", bookID)
+		return err
+	}
+
+	params := make([]data.UpdatePassageInjectionFlagsParams, len(passages))
+	for i, p := range passages {
+		flags := rag.ScanInjection(p.PassageText)
+		if flags == nil {
+			flags = []string{}
+		}
+		params[i] = data.UpdatePassageInjectionFlagsParams{ID: p.ID, InjectionFlags: flags}
+	}
+
+	var batchErr error
+	db.Queries.UpdatePassageInjectionFlags(ctx, params).Exec(func(i int, err error) {
+		if err != nil {
+			slog.Error("Failed to update passage flags", "index", i, "err", err)
+			batchErr = err
+		}
+	})
+	return batchErr
+}
+
+// HandleGetInjectionReport returns the passages of a book flagged as
+// possible prompt injections
+func HandleGetInjectionReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	res, err := loadInjectionReport(r.Context(), bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
+
+// HandleScanInjections scans the passages of a book again and returns the
+// new report
+func HandleScanInjections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	if err := scanInjections(r.Context(), bookID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not scan the passages"})
+		return
+	}
+
+	res, err := loadInjectionReport(r.Context(), bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
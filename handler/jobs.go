@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// jobGroup tracks work started by requests that has to run to completion even
+// if the client disconnects, like ingesting a book, so shutdown can wait for it
+type jobGroup struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	ctx     context.Context // Cancelling it aborts all jobs
+	stopped bool            // No new jobs once shutdown started
+}
+
+var jobs = &jobGroup{ctx: context.Background()}
+
+// errShuttingDown is returned for jobs started after shutdown began
+var errShuttingDown = HttpError{Msg: "Server is shutting down", Status: http.StatusServiceUnavailable}
+
+// start registers a job and returns its context, which keeps the values of
+// parent but is only cancelled with the group, not when the request ends.
+// done must be called when the job finished.
+func (g *jobGroup) start(parent context.Context) (ctx context.Context, done func(), err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return nil, nil, errShuttingDown
+	}
+
+	g.wg.Add(1)
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stop := context.AfterFunc(g.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		g.wg.Done()
+	}, nil
+}
+
+// wait rejects new jobs and waits for the running ones until ctx is done
+func (g *jobGroup) wait(ctx context.Context) error {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetJobContext sets the context jobs run in, cancelling it aborts them. It
+// must be called before the server starts.
+func SetJobContext(ctx context.Context) {
+	jobs.ctx = ctx
+}
+
+// WaitJobs stops accepting jobs and waits for the running ones, e.g. books
+// being ingested, until ctx is done
+func WaitJobs(ctx context.Context) error {
+	return jobs.wait(ctx)
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobGroup(t *testing.T) {
+	groupCtx, cancelGroup := context.WithCancel(context.Background())
+	defer cancelGroup()
+	g := &jobGroup{ctx: groupCtx}
+
+	// A job outlives the request that started it
+	requestCtx, cancelRequest := context.WithCancel(context.Background())
+	ctx, done, err := g.start(requestCtx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cancelRequest()
+	if ctx.Err() != nil {
+		t.Fatalf("Expected the job to keep running after the request ended")
+	}
+
+	// Shutdown waits for it and rejects new jobs
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelWait()
+	if err := g.wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+	if _, _, err := g.start(context.Background()); err != errShuttingDown {
+		t.Errorf("Expected new jobs to be rejected, got %v", err)
+	}
+
+	// Cancelling the group cancels the job
+	cancelGroup()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the job to be cancelled with the group")
+	}
+	done()
+	if err := g.wait(context.Background()); err != nil {
+		t.Errorf("Expected the wait to finish, got %v", err)
+	}
+}
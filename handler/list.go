@@ -13,8 +13,11 @@ type ListBooksResponse struct {
 }
 
 type BookItem struct {
-	ID   int64  `json:"id"`
-	Name string `json:"name"`
+	ID           int64    `json:"id"`
+	Name         string   `json:"name"`
+	Author       string   `json:"author"`
+	Tags         []string `json:"tags"`
+	PromptPreset string   `json:"prompt_preset"`
 }
 
 func HandleListBooks(w http.ResponseWriter, r *http.Request) {
@@ -29,8 +32,11 @@ func HandleListBooks(w http.ResponseWriter, r *http.Request) {
 	bookItems := make([]BookItem, len(books))
 	for i, book := range books {
 		bookItems[i] = BookItem{
-			ID:   book.ID,
-			Name: book.BookName,
+			ID:           book.ID,
+			Name:         book.BookName,
+			Author:       book.Author,
+			Tags:         book.Tags,
+			PromptPreset: book.PromptPreset,
 		}
 	}
 
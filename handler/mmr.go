@@ -0,0 +1,26 @@
+package handler
+
+import "github.com/embiem/book-rag/rag"
+
+// diversifyPassages picks limit passages using maximal marginal relevance.
+// Rerank scores are used as relevance when present, similarity otherwise.
+func diversifyPassages(candidates []PassageResult, limit int, lambda float32) []PassageResult {
+	relevance := make([]float32, len(candidates))
+	embeddings := make([][]float32, len(candidates))
+	for i, c := range candidates {
+		relevance[i] = c.Similarity
+		if c.RerankScore != nil {
+			relevance[i] = *c.RerankScore
+		}
+		embeddings[i] = c.Embedding
+	}
+
+	selected := rag.MaximalMarginalRelevance(relevance, embeddings, limit, lambda)
+
+	diversified := make([]PassageResult, len(selected))
+	for i, idx := range selected {
+		diversified[i] = candidates[idx]
+	}
+
+	return diversified
+}
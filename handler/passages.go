@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// MaxWindow caps how many neighboring passages may be included around a hit
+const MaxWindow = 5
+
+// PassageWindow is a contiguous run of passages built around one or more hits
+type PassageWindow struct {
+	StartOrdinal int32   `json:"start_ordinal"`
+	EndOrdinal   int32   `json:"end_ordinal"`
+	HitIDs       []int64 `json:"hit_ids"`
+	Similarity   float32 `json:"similarity"` // Best similarity of the hits in this window
+	Text         string  `json:"text"`
+}
+
+type PassageContextResponse struct {
+	BookID  int64           `json:"book_id"`
+	Passage PassageResult   `json:"passage"`
+	Before  []PassageResult `json:"before"`
+	After   []PassageResult `json:"after"`
+}
+
+// mergeWindows expands every hit by window passages on each side and merges
+// ranges that overlap or touch. Results are ordered by their best hit.
+func mergeWindows(hits []PassageResult, window int) []PassageWindow {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	sorted := make([]PassageResult, len(hits))
+	copy(sorted, hits)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Ordinal < sorted[j].Ordinal })
+
+	var windows []PassageWindow
+	for _, hit := range sorted {
+		start := max(hit.Ordinal-int32(window), 0)
+		end := hit.Ordinal + int32(window)
+
+		if n := len(windows); n > 0 && start <= windows[n-1].EndOrdinal+1 {
+			last := &windows[n-1]
+			last.EndOrdinal = max(last.EndOrdinal, end)
+			last.HitIDs = append(last.HitIDs, hit.ID)
+			last.Similarity = max(last.Similarity, hit.Similarity)
+			continue
+		}
+
+		windows = append(windows, PassageWindow{
+			StartOrdinal: start,
+			EndOrdinal:   end,
+			HitIDs:       []int64{hit.ID},
+			Similarity:   hit.Similarity,
+		})
+	}
+
+	sort.SliceStable(windows, func(i, j int) bool { return windows[i].Similarity > windows[j].Similarity })
+
+	return windows
+}
+
+// ExpandPassages fetches the neighbors of every hit and merges them into
+// windows. If maxOrdinal is set, windows don't extend past it.
+func ExpandPassages(ctx context.Context, bookID int64, hits []PassageResult, window int, maxOrdinal pgtype.Int4, excludeFlagged bool) ([]PassageWindow, error) {
+	windows := mergeWindows(hits, min(window, MaxWindow))
+
+	for i := range windows {
+		if maxOrdinal.Valid {
+			windows[i].EndOrdinal = min(windows[i].EndOrdinal, maxOrdinal.Int32)
+		}
+
+		rows, err := db.Queries.GetPassagesInRange(ctx, data.GetPassagesInRangeParams{
+			BookID:       bookID,
+			StartOrdinal: windows[i].StartOrdinal,
+			EndOrdinal:   windows[i].EndOrdinal,
+		})
+		if err != nil {
+			slog.Error("Failed to fetch neighboring passages", "err", err, "book_id", bookID)
+			return nil, err
+		}
+
+		texts := make([]string, 0, len(rows))
+		for _, row := range rows {
+			if excludeFlagged && len(row.InjectionFlags) > 0 {
+				continue
+			}
+			texts = append(texts, row.PassageText)
+		}
+		windows[i].Text = strings.Join(texts, "\n\n")
+
+		// Clamp to what actually exists at the end of the book
+		if len(rows) > 0 {
+			windows[i].StartOrdinal = rows[0].Ordinal
+			windows[i].EndOrdinal = rows[len(rows)-1].Ordinal
+		}
+	}
+
+	return windows, nil
+}
+
+func PrettifyWindows(windows []PassageWindow) string {
+	pretty := ""
+
+	for _, w := range windows {
+		pretty += fmt.Sprintf("Relevance: %d%%\n", int(math.Round(float64(w.Similarity)*100)))
+		pretty += w.Text + "\n\n\n"
+	}
+
+	return pretty
+}
+
+func HandleGetPassage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	passageID, err := strconv.ParseInt(chi.URLParam(r, "passageID"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid or missing passage ID"})
+		return
+	}
+
+	// Optional context parameter (default 0, max MaxWindow)
+	contextSize := 0
+	if raw := r.URL.Query().Get("context"); raw != "" {
+		contextSize, err = strconv.Atoi(raw)
+		if err != nil || contextSize < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrorResponse{Error: "context must be a non-negative integer"})
+			return
+		}
+		contextSize = min(contextSize, MaxWindow)
+	}
+
+	passage, err := db.Queries.GetBookPassage(r.Context(), data.GetBookPassageParams{
+		BookID: bookID,
+		ID:     passageID,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			enc.Encode(ErrorResponse{Error: "Passage not found"})
+			return
+		}
+		slog.Error("Failed to get passage", "err", err, "book_id", bookID, "passage_id", passageID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	rows, err := db.Queries.GetPassagesInRange(r.Context(), data.GetPassagesInRangeParams{
+		BookID:       bookID,
+		StartOrdinal: passage.Ordinal - int32(contextSize),
+		EndOrdinal:   passage.Ordinal + int32(contextSize),
+	})
+	if err != nil {
+		slog.Error("Failed to fetch neighboring passages", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	res := PassageContextResponse{
+		BookID: bookID,
+		Passage: PassageResult{
+			ID:      passage.ID,
+			Ordinal: passage.Ordinal,
+			Text:    passage.PassageText,
+			Span:    newSourceSpan(passage.StartByte, passage.EndByte, passage.StartRune, passage.EndRune, passage.StartLine, passage.EndLine),
+		},
+		Before: []PassageResult{},
+		After:  []PassageResult{},
+	}
+	for _, row := range rows {
+		neighbor := PassageResult{
+			ID:      row.ID,
+			Ordinal: row.Ordinal,
+			Text:    row.PassageText,
+			Span:    newSourceSpan(row.StartByte, row.EndByte, row.StartRune, row.EndRune, row.StartLine, row.EndLine),
+		}
+		if row.Ordinal < passage.Ordinal {
+			res.Before = append(res.Before, neighbor)
+		} else if row.Ordinal > passage.Ordinal {
+			res.After = append(res.After, neighbor)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		hits     []PassageResult
+		window   int
+		expected []PassageWindow
+	}{
+		{
+			name:     "No hits",
+			hits:     nil,
+			window:   2,
+			expected: nil,
+		},
+		{
+			name:   "Single hit clamps at start of book",
+			hits:   []PassageResult{{ID: 1, Ordinal: 1, Similarity: 0.8}},
+			window: 2,
+			expected: []PassageWindow{
+				{StartOrdinal: 0, EndOrdinal: 3, HitIDs: []int64{1}, Similarity: 0.8},
+			},
+		},
+		{
+			name: "Overlapping hits are merged",
+			hits: []PassageResult{
+				{ID: 2, Ordinal: 12, Similarity: 0.6},
+				{ID: 1, Ordinal: 10, Similarity: 0.9},
+			},
+			window: 1,
+			expected: []PassageWindow{
+				{StartOrdinal: 9, EndOrdinal: 13, HitIDs: []int64{1, 2}, Similarity: 0.9},
+			},
+		},
+		{
+			name: "Adjacent windows are merged",
+			hits: []PassageResult{
+				{ID: 1, Ordinal: 10, Similarity: 0.5},
+				{ID: 2, Ordinal: 13, Similarity: 0.7},
+			},
+			window: 1,
+			expected: []PassageWindow{
+				{StartOrdinal: 9, EndOrdinal: 14, HitIDs: []int64{1, 2}, Similarity: 0.7},
+			},
+		},
+		{
+			name: "Distant hits stay separate and are ordered by similarity",
+			hits: []PassageResult{
+				{ID: 1, Ordinal: 10, Similarity: 0.5},
+				{ID: 2, Ordinal: 40, Similarity: 0.7},
+			},
+			window: 1,
+			expected: []PassageWindow{
+				{StartOrdinal: 39, EndOrdinal: 41, HitIDs: []int64{2}, Similarity: 0.7},
+				{StartOrdinal: 9, EndOrdinal: 11, HitIDs: []int64{1}, Similarity: 0.5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := mergeWindows(tt.hits, tt.window)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+type PromptPresetsResponse struct {
+	Presets []string `json:"presets"`
+	Default string   `json:"default"`
+}
+
+type SetPromptPresetRequest struct {
+	PromptPreset string `json:"prompt_preset"` // Empty resets to the default preset
+}
+
+// resolvePromptPreset loads the book and picks the requested preset, falling
+// back to the book's preset
+func resolvePromptPreset(ctx context.Context, requested string, bookID int64) (string, data.GetBookRow, error) {
+	book, err := db.Queries.GetBook(ctx, bookID)
+	if err != nil {
+		slog.Error("Failed to get book", "err", err, "book_id", bookID)
+		return "", book, HttpError{Msg: "Could not get book", Status: http.StatusInternalServerError}
+	}
+
+	if requested == "" {
+		// The book's preset may be gone if the templates directory changed
+		if book.PromptPreset != "" && !rag.IsValidPromptPreset(book.PromptPreset) {
+			slog.Warn("Unknown prompt preset for book, using default", "prompt_preset", book.PromptPreset, "book_id", bookID)
+			return "", book, nil
+		}
+		return book.PromptPreset, book, nil
+	}
+	if !rag.IsValidPromptPreset(requested) {
+		return "", book, HttpError{Msg: "prompt_preset must be one of " + strings.Join(rag.PromptPresets(), ", "), Status: http.StatusBadRequest}
+	}
+	return requested, book, nil
+}
+
+// buildPrompt renders the prompt preset. It fills in the book metadata and
+// the passages, the caller sets everything else on promptData.
+func buildPrompt(preset string, book data.GetBookRow, passages []PassageResult, promptData rag.PromptData) (string, error) {
+	promptData.Book = rag.PromptBook{Name: book.BookName, Author: book.Author, Tags: book.Tags}
+	promptData.Passages = make([]rag.PromptPassage, len(passages))
+	for i, p := range passages {
+		promptData.Passages[i] = rag.PromptPassage{
+			ID:        p.ID,
+			Ordinal:   p.Ordinal,
+			Relevance: int(math.Round(float64(p.Similarity) * 100)),
+			Text:      p.Text,
+		}
+	}
+
+	return rag.RenderPrompt(preset, promptData)
+}
+
+func HandleListPromptPresets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(PromptPresetsResponse{
+		Presets: rag.PromptPresets(),
+		Default: rag.DefaultPromptPreset,
+	})
+}
+
+// HandleSetBookPromptPreset changes the preset used for a book when requests
+// don't select one
+func HandleSetBookPromptPreset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload SetPromptPresetRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	if payload.PromptPreset != "" && !rag.IsValidPromptPreset(payload.PromptPreset) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "prompt_preset must be one of " + strings.Join(rag.PromptPresets(), ", ")})
+		return
+	}
+
+	if err := db.Queries.UpdateBookPromptPreset(r.Context(), data.UpdateBookPromptPresetParams{
+		ID:           bookID,
+		PromptPreset: payload.PromptPreset,
+	}); err != nil {
+		slog.Error("Failed to update prompt preset", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(map[string]interface{}{
+		"book_id":       bookID,
+		"prompt_preset": payload.PromptPreset,
+	})
+}
@@ -12,25 +12,53 @@ import (
 	"github.com/embiem/book-rag/data"
 	"github.com/embiem/book-rag/db"
 	"github.com/embiem/book-rag/rag"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/pgvector/pgvector-go"
 )
 
 type QueryBookRequest struct {
-	Query string `json:"query"`
-	Limit int    `json:"limit"`
+	Query            string           `json:"query"`
+	Limit            int              `json:"limit"`
+	Window           int              `json:"window"` // Neighboring passages to include around each hit
+	Rerank           bool             `json:"rerank"`
+	RerankCandidates int              `json:"rerank_candidates"` // Candidate pool size for reranking and MMR
+	MMR              bool             `json:"mmr"`
+	Lambda           *float32         `json:"lambda"` // MMR trade-off between relevance (1) and diversity (0)
+	MinSimilarity    *float32         `json:"min_similarity"`
+	QueryStrategy    string           `json:"query_strategy"` // raw (default), rewrite, hyde or multi
+	ReadingPosition  *ReadingPosition `json:"reading_position"`
+	Entities         []string         `json:"entities"`        // Only passages mentioning one of these entities, by name or alias
+	ExcludeFlagged   bool             `json:"exclude_flagged"` // Leave out passages flagged as possible prompt injections
 }
 
 type QueryBookResponse struct {
-	BookID   int64           `json:"book_id"`
-	Query    string          `json:"query"`
-	Limit    int             `json:"limit"`
-	Passages []PassageResult `json:"results"`
+	BookID         int64           `json:"book_id"`
+	Query          string          `json:"query"`
+	QueryStrategy  string          `json:"query_strategy"`
+	QueriesUsed    []string        `json:"queries_used"` // Texts that were actually embedded
+	Limit          int             `json:"limit"`
+	Candidates     int             `json:"candidates,omitempty"` // Candidates considered when reranking
+	MinSimilarity  float32         `json:"min_similarity"`
+	BestSimilarity float32         `json:"best_similarity"` // Best similarity seen, even if below MinSimilarity
+	Passages       []PassageResult `json:"results"`
+	Windows        []PassageWindow `json:"windows,omitempty"`
+
+	// Set if results were restricted to passages before a reading position
+	ReadingPosition string `json:"reading_position,omitempty"`
+	MaxOrdinal      *int32 `json:"max_ordinal,omitempty"`
+
+	// Canonical names of the entities the results were filtered by
+	Entities []string `json:"entities,omitempty"`
 }
 
 type PassageResult struct {
-	ID         int64   `json:"id"`
-	Text       string  `json:"text"`
-	Similarity float32 `json:"similarity"`
+	ID          int64       `json:"id"`
+	Ordinal     int32       `json:"ordinal"`
+	Text        string      `json:"text"`
+	Similarity  float32     `json:"similarity"`
+	RerankScore *float32    `json:"rerank_score,omitempty"`
+	Span        *SourceSpan `json:"span,omitempty"`
+	Embedding   []float32   `json:"-"`
 }
 
 func PrettifyPassages(passageResults []PassageResult) string {
@@ -44,6 +72,112 @@ func PrettifyPassages(passageResults []PassageResult) string {
 	return pretty
 }
 
+// embedQuery generates the embedding vector used to search for a query
+func embedQuery(query string) (pgvector.Vector, error) {
+	embeddings, err := rag.GenerateEmbeddings([]string{query})
+	if err != nil {
+		slog.Error("Failed to generate embedding for query", "err", err, "query", query)
+		return pgvector.Vector{}, err
+	}
+
+	if len(embeddings) == 0 {
+		slog.Error("No embeddings returned for query", "query", query)
+		return pgvector.Vector{}, errors.New("No embeddings returned for query")
+	}
+
+	return pgvector.NewVector(embeddings[0]), nil
+}
+
+// retrieveCandidates searches the book for every query. Results of several
+// queries are fused with reciprocal rank fusion, keeping the best similarity
+// each passage reached for any of the queries. Passages can be restricted to
+// those mentioning one of entityIDs, and passages flagged by the
+// prompt-injection scanner can be left out.
+func retrieveCandidates(ctx context.Context, bookID int64, queries []string, limit int32, maxOrdinal pgtype.Int4, entityIDs []int64, excludeFlagged bool) ([]data.QueryBookRow, error) {
+	rankings := make([][]int64, 0, len(queries))
+	rowsByID := make(map[int64]data.QueryBookRow)
+
+	for _, query := range queries {
+		queryEmbedding, err := embedQuery(query)
+		if err != nil {
+			return nil, err
+		}
+
+		results, err := db.Queries.QueryBook(ctx, data.QueryBookParams{
+			Embedding:      queryEmbedding,
+			BookID:         bookID,
+			MaxOrdinal:     maxOrdinal,
+			EntityIds:      entityIDs,
+			ExcludeFlagged: excludeFlagged,
+			Limit:          limit,
+		})
+		if err != nil {
+			slog.Error("Failed to query book passages", "err", err, "book_id", bookID)
+			return nil, err
+		}
+
+		if len(queries) == 1 {
+			return results, nil
+		}
+
+		ranking := make([]int64, len(results))
+		for i, result := range results {
+			ranking[i] = result.ID
+			if seen, ok := rowsByID[result.ID]; !ok || result.Similarity > seen.Similarity {
+				rowsByID[result.ID] = result
+			}
+		}
+		rankings = append(rankings, ranking)
+	}
+
+	fused := rag.ReciprocalRankFusion(rankings)
+	results := make([]data.QueryBookRow, 0, min(len(fused), int(limit)))
+	for _, id := range fused[:min(len(fused), int(limit))] {
+		results = append(results, rowsByID[id])
+	}
+
+	return results, nil
+}
+
+// resolveMinSimilarity returns the requested relevance threshold, or the
+// default of the embedding model
+func resolveMinSimilarity(requested *float32) (float32, error) {
+	if requested == nil {
+		return rag.DefaultMinSimilarity(rag.EmbeddingModel), nil
+	}
+	if *requested < -1 || *requested > 1 {
+		return 0, HttpError{Msg: "min_similarity must be between -1 and 1", Status: http.StatusBadRequest}
+	}
+	return *requested, nil
+}
+
+// filterBySimilarity drops the results below the relevance threshold, keeping
+// their order. It also returns the best similarity seen, even if it was dropped.
+func filterBySimilarity(results []data.QueryBookRow, minSimilarity float32) ([]PassageResult, float32) {
+	var bestSimilarity float32
+	for i, result := range results {
+		if i == 0 || result.Similarity > bestSimilarity {
+			bestSimilarity = result.Similarity
+		}
+	}
+
+	passages := make([]PassageResult, 0, len(results))
+	for _, result := range results {
+		if result.Similarity < minSimilarity {
+			continue
+		}
+		passages = append(passages, PassageResult{
+			ID:         result.ID,
+			Ordinal:    result.Ordinal,
+			Text:       result.PassageText,
+			Similarity: result.Similarity,
+			Span:       newSourceSpan(result.StartByte, result.EndByte, result.StartRune, result.EndRune, result.StartLine, result.EndLine),
+			Embedding:  result.Embedding.Slice(),
+		})
+	}
+	return passages, bestSimilarity
+}
+
 func QueryBook(ctx context.Context, payload QueryBookRequest, bookID int64) (*QueryBookResponse, error) {
 	// Optional limit parameter (default 20, max 100)
 	limit := int32(20)
@@ -51,44 +185,105 @@ func QueryBook(ctx context.Context, payload QueryBookRequest, bookID int64) (*Qu
 		limit = min(int32(payload.Limit), 100)
 	}
 
-	embeddings, err := rag.GenerateEmbeddings([]string{payload.Query})
+	// Optional MMR lambda (default 0.5, between 0 and 1)
+	lambda := float32(rag.DefaultMMRLambda)
+	if payload.Lambda != nil {
+		if *payload.Lambda < 0 || *payload.Lambda > 1 {
+			return nil, HttpError{Msg: "lambda must be between 0 and 1", Status: http.StatusBadRequest}
+		}
+		lambda = *payload.Lambda
+	}
+
+	minSimilarity, err := resolveMinSimilarity(payload.MinSimilarity)
 	if err != nil {
-		slog.Error("Failed to generate embedding for query", "err", err, "query", payload.Query)
 		return nil, err
 	}
 
-	if len(embeddings) == 0 {
-		slog.Error("No embeddings returned for query", "query", payload.Query)
-		return nil, errors.New("No embeddings returned for query")
+	// Optional query strategy (default raw)
+	strategy := payload.QueryStrategy
+	if strategy == "" {
+		strategy = rag.QueryStrategyRaw
+	}
+	if !rag.IsValidQueryStrategy(strategy) {
+		return nil, HttpError{Msg: "query_strategy must be one of raw, rewrite, hyde or multi", Status: http.StatusBadRequest}
 	}
 
-	queryEmbedding := pgvector.NewVector(embeddings[0])
+	// Reranking and MMR start from a larger candidate pool (default 50, max 200)
+	candidates := limit
+	if payload.Rerank || payload.MMR {
+		candidates = max(limit, DefaultRerankCandidates)
+		if payload.RerankCandidates > 0 {
+			candidates = max(limit, min(int32(payload.RerankCandidates), MaxRerankCandidates))
+		}
+	}
 
-	results, err := db.Queries.QueryBook(ctx, data.QueryBookParams{
-		BookID:    bookID,
-		Embedding: queryEmbedding,
-		Limit:     limit,
-	})
+	// Optional reading position, nothing after it may be retrieved
+	maxOrdinal, readingPosition, err := resolveReadingPosition(ctx, bookID, payload.ReadingPosition)
 	if err != nil {
-		slog.Error("Failed to query book passages", "err", err, "book_id", bookID)
 		return nil, err
 	}
 
-	passages := make([]PassageResult, len(results))
-	for i, result := range results {
-		passages[i] = PassageResult{
-			ID:         result.ID,
-			Text:       result.PassageText,
-			Similarity: result.Similarity,
+	// Optional entity filter
+	entityIDs, entityNames, err := resolveEntityFilter(ctx, bookID, payload.Entities)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := rag.RetrievalQueries(ctx, payload.Query, strategy)
+	if err != nil {
+		slog.Error("Failed to prepare retrieval queries", "err", err, "query_strategy", strategy)
+		return nil, err
+	}
+
+	results, err := retrieveCandidates(ctx, bookID, queries, candidates, maxOrdinal, entityIDs, payload.ExcludeFlagged)
+	if err != nil {
+		return nil, err
+	}
+
+	passages, bestSimilarity := filterBySimilarity(results, minSimilarity)
+
+	if payload.Rerank {
+		passages, err = rerankPassages(ctx, payload.Query, passages)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return &QueryBookResponse{
-		BookID:   bookID,
-		Query:    payload.Query,
-		Limit:    int(limit),
-		Passages: passages,
-	}, nil
+	if payload.MMR {
+		passages = diversifyPassages(passages, int(limit), lambda)
+	} else {
+		passages = passages[:min(int(limit), len(passages))]
+	}
+
+	var windows []PassageWindow
+	if payload.Window > 0 {
+		windows, err = ExpandPassages(ctx, bookID, passages, payload.Window, maxOrdinal, payload.ExcludeFlagged)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &QueryBookResponse{
+		BookID:         bookID,
+		Query:          payload.Query,
+		QueryStrategy:  strategy,
+		QueriesUsed:    queries,
+		Limit:          int(limit),
+		MinSimilarity:  minSimilarity,
+		BestSimilarity: bestSimilarity,
+		Passages:       passages,
+		Windows:        windows,
+		Entities:       entityNames,
+	}
+	if payload.Rerank || payload.MMR {
+		res.Candidates = len(results)
+	}
+	if maxOrdinal.Valid {
+		res.ReadingPosition = readingPosition
+		res.MaxOrdinal = &maxOrdinal.Int32
+	}
+
+	return res, nil
 }
 
 func HandleQueryBook(w http.ResponseWriter, r *http.Request) {
@@ -118,8 +313,13 @@ func HandleQueryBook(w http.ResponseWriter, r *http.Request) {
 
 	res, err := QueryBook(r.Context(), payload, bookID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
 		return
 	}
 
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/rag"
+)
+
+func TestResolveMinSimilarity(t *testing.T) {
+	originalModel := rag.EmbeddingModel
+	rag.EmbeddingModel = "embeddinggemma"
+	defer func() { rag.EmbeddingModel = originalModel }()
+
+	if got, err := resolveMinSimilarity(nil); err != nil || got != 0.3 {
+		t.Errorf("Expected the model's default 0.3, got %v (%v)", got, err)
+	}
+
+	requested := float32(0)
+	if got, err := resolveMinSimilarity(&requested); err != nil || got != 0 {
+		t.Errorf("Expected the requested threshold, got %v (%v)", got, err)
+	}
+
+	requested = 1.5
+	if _, err := resolveMinSimilarity(&requested); err == nil {
+		t.Errorf("Expected an error for a threshold above 1")
+	}
+}
+
+func TestFilterBySimilarity(t *testing.T) {
+	results := []data.QueryBookRow{
+		{ID: 1, Similarity: 0.5},
+		{ID: 2, Similarity: 0.2},
+		{ID: 3, Similarity: 0.35},
+	}
+
+	passages, best := filterBySimilarity(results, 0.3)
+	if len(passages) != 2 || passages[0].ID != 1 || passages[1].ID != 3 {
+		t.Errorf("Expected passages 1 and 3 in order, got %+v", passages)
+	}
+	if best != 0.5 {
+		t.Errorf("Expected best similarity 0.5, got %v", best)
+	}
+
+	// The best similarity is reported even if nothing clears the threshold
+	passages, best = filterBySimilarity(results, 0.9)
+	if len(passages) != 0 || best != 0.5 {
+		t.Errorf("Expected no passages and best similarity 0.5, got %+v and %v", passages, best)
+	}
+
+	// Negative similarities are kept without a threshold
+	passages, best = filterBySimilarity([]data.QueryBookRow{{ID: 4, Similarity: -0.2}}, -1)
+	if len(passages) != 1 || best != -0.2 {
+		t.Errorf("Expected the passage and best similarity -0.2, got %+v and %v", passages, best)
+	}
+}
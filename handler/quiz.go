@@ -0,0 +1,348 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/eval"
+	"github.com/embiem/book-rag/rag"
+)
+
+const (
+	// DefaultQuizQuestions is the number of questions per chapter by default
+	DefaultQuizQuestions = 2
+	// MaxQuizQuestions caps the questions_per_chapter parameter
+	MaxQuizQuestions = 10
+	// MaxQuizTotal caps the questions of a whole quiz, select chapters for more
+	MaxQuizTotal = 100
+	// MinQuizPassageRunes skips passages too short to ask about, like headings
+	MinQuizPassageRunes = 300
+	// QuizConcurrency is the number of questions generated in parallel
+	QuizConcurrency = 4
+)
+
+// Quiz export formats
+const (
+	QuizFormatJSON = "json"
+	QuizFormatAnki = "anki" // CSV for importing into Anki
+)
+
+type QuizRequest struct {
+	Type                string  `json:"type"` // multiple_choice, short_answer or mixed (default)
+	QuestionsPerChapter int     `json:"questions_per_chapter"`
+	Chapters            []int32 `json:"chapters"`        // Ordinals, all chapters if empty
+	Critique            *bool   `json:"critique"`        // Drop low-quality questions (default true)
+	Format              string  `json:"format"`          // json (default) or anki
+	ExcludeFlagged      *bool   `json:"exclude_flagged"` // Skip passages flagged as possible prompt injections (default true)
+}
+
+type QuizCitation struct {
+	PassageID int64       `json:"passage_id"`
+	Ordinal   int32       `json:"ordinal"`
+	Span      *SourceSpan `json:"span,omitempty"`
+}
+
+type QuizQuestion struct {
+	Type        string               `json:"type"`
+	Question    string               `json:"question"`
+	Options     []string             `json:"options,omitempty"`
+	AnswerIndex *int                 `json:"answer_index,omitempty"` // Index of the answer in options
+	Answer      string               `json:"answer"`
+	Difficulty  string               `json:"difficulty"` // easy, medium or hard
+	Scope       string               `json:"scope"`      // chapter or section
+	UnitOrdinal int32                `json:"unit_ordinal"`
+	UnitTitle   string               `json:"unit_title"`
+	Citation    QuizCitation         `json:"citation"`
+	Critique    *eval.CritiqueScores `json:"critique,omitempty"`
+}
+
+type QuizResponse struct {
+	BookID    int64          `json:"book_id"`
+	Type      string         `json:"type"`
+	Questions []QuizQuestion `json:"questions"`
+}
+
+// quizCandidate is a passage a question may be generated from
+type quizCandidate struct {
+	unit    int
+	passage data.GetPassagesInRangeRow
+}
+
+// pickQuizPassages spreads n passages evenly over a chapter, preferring
+// passages long enough to ask about. With excludeFlagged, passages flagged
+// as possible prompt injections are never picked.
+func pickQuizPassages(passages []data.GetPassagesInRangeRow, n int, excludeFlagged bool) []data.GetPassagesInRangeRow {
+	if excludeFlagged {
+		passages = slices.DeleteFunc(slices.Clone(passages), func(p data.GetPassagesInRangeRow) bool {
+			return len(p.InjectionFlags) > 0
+		})
+	}
+
+	var long []data.GetPassagesInRangeRow
+	for _, p := range passages {
+		if utf8.RuneCountInString(p.PassageText) >= MinQuizPassageRunes {
+			long = append(long, p)
+		}
+	}
+	if len(long) == 0 {
+		long = passages
+	}
+	if n >= len(long) {
+		return long
+	}
+
+	picked := make([]data.GetPassagesInRangeRow, n)
+	for i := range n {
+		picked[i] = long[(2*i+1)*len(long)/(2*n)]
+	}
+	return picked
+}
+
+// generateQuizQuestion writes a question about a passage with the eval
+// package, critiques it and adds the difficulty and wrong answers. It returns
+// nil if the critique rejects the question.
+func generateQuizQuestion(ctx context.Context, g *rag.Generator, bookID int64, passage string, critique, distractors bool) (*QuizQuestion, []string, error) {
+	qa, err := eval.GenerateQAPair(ctx, g.Client(), passage, bookID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var scores *eval.CritiqueScores
+	if critique {
+		s, err := eval.CritiqueQAPair(ctx, g.Client(), qa)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !s.PassesQualityFilter() {
+			return nil, nil, nil
+		}
+		scores = &s
+	}
+
+	difficulty, wrong, err := g.QuizDetails(ctx, qa.Question, qa.ReferenceAnswer, passage, distractors)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &QuizQuestion{
+		Question:   qa.Question,
+		Answer:     qa.ReferenceAnswer,
+		Difficulty: difficulty,
+		Critique:   scores,
+	}, wrong, nil
+}
+
+// createQuiz generates questions for every selected chapter in parallel.
+// With critique, twice as many candidates are generated and the first
+// accepted ones of each chapter are kept.
+func createQuiz(ctx context.Context, bookID int64, quizType string, perChapter int, chapters []int32, critique, excludeFlagged bool) ([]QuizQuestion, error) {
+	units, err := summaryUnits(ctx, bookID)
+	if err != nil {
+		slog.Error("Failed to split book for quiz", "err", err, "book_id", bookID)
+		return nil, err
+	}
+	if len(chapters) > 0 {
+		units = slices.DeleteFunc(units, func(u summaryUnit) bool { return !slices.Contains(chapters, u.ordinal) })
+	}
+	if len(units) == 0 {
+		return nil, HttpError{Msg: "No passages to ask about in the selected chapters", Status: http.StatusUnprocessableEntity}
+	}
+	if len(units)*perChapter > MaxQuizTotal {
+		return nil, HttpError{Msg: fmt.Sprintf("A quiz can have at most %d questions, select fewer chapters", MaxQuizTotal), Status: http.StatusBadRequest}
+	}
+
+	candidatesPerChapter := perChapter
+	if critique {
+		candidatesPerChapter *= 2
+	}
+	var candidates []quizCandidate
+	for i, unit := range units {
+		for _, p := range pickQuizPassages(unit.passages, candidatesPerChapter, excludeFlagged) {
+			candidates = append(candidates, quizCandidate{unit: i, passage: p})
+		}
+	}
+
+	g := rag.NewGenerator()
+	results := make([]*QuizQuestion, len(candidates))
+	distractors := make([][]string, len(candidates))
+	errs := make([]error, len(candidates))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, QuizConcurrency)
+	for i, c := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i], distractors[i], errs[i] = generateQuizQuestion(ctx, g, bookID, c.passage.PassageText, critique, quizType != rag.QuizTypeShortAnswer)
+		}()
+	}
+	wg.Wait()
+
+	// A failed question is skipped like a rejected one, unless all failed
+	questions := []QuizQuestion{}
+	perUnit := make(map[int]int)
+	for i, c := range candidates {
+		if errs[i] != nil {
+			slog.Warn("Failed to generate quiz question", "err", errs[i], "book_id", bookID, "passage_id", c.passage.ID)
+			continue
+		}
+		if results[i] == nil || perUnit[c.unit] == perChapter {
+			continue
+		}
+		perUnit[c.unit]++
+
+		q := *results[i]
+		unit := units[c.unit]
+		q.Scope, q.UnitOrdinal, q.UnitTitle = unit.scope, unit.ordinal, unit.title
+		q.Citation = QuizCitation{
+			PassageID: c.passage.ID,
+			Ordinal:   c.passage.Ordinal,
+			Span:      newSourceSpan(c.passage.StartByte, c.passage.EndByte, c.passage.StartRune, c.passage.EndRune, c.passage.StartLine, c.passage.EndLine),
+		}
+
+		// Mixed quizzes alternate, questions without enough distractors are
+		// asked as short answers
+		q.Type = quizType
+		if quizType == rag.QuizTypeMixed {
+			q.Type = rag.QuizTypeMultipleChoice
+			if len(questions)%2 == 1 {
+				q.Type = rag.QuizTypeShortAnswer
+			}
+		}
+		if q.Type == rag.QuizTypeMultipleChoice && len(distractors[i]) < 2 {
+			q.Type = rag.QuizTypeShortAnswer
+		}
+		if q.Type == rag.QuizTypeMultipleChoice {
+			options, answer := rag.QuizOptions(q.Question, q.Answer, distractors[i])
+			q.Options, q.AnswerIndex = options, &answer
+		}
+
+		questions = append(questions, q)
+	}
+
+	if len(questions) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+	}
+	return questions, nil
+}
+
+// quizCards converts questions into flashcards tagged with the book and chapter
+func quizCards(bookID int64, questions []QuizQuestion) []rag.QuizCard {
+	cards := make([]rag.QuizCard, len(questions))
+	for i, q := range questions {
+		cards[i] = rag.QuizCard{
+			Type:       q.Type,
+			Question:   q.Question,
+			Options:    q.Options,
+			Answer:     q.Answer,
+			Difficulty: q.Difficulty,
+			Source:     fmt.Sprintf("%s (passage %d)", q.UnitTitle, q.Citation.Ordinal),
+			Tags:       []string{fmt.Sprintf("book_%d", bookID), fmt.Sprintf("%s_%d", q.Scope, q.UnitOrdinal)},
+		}
+	}
+	return cards
+}
+
+// HandleCreateQuiz generates multiple-choice and short-answer questions per
+// chapter, as JSON or as CSV for Anki
+func HandleCreateQuiz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload QuizRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	quizType := payload.Type
+	if quizType == "" {
+		quizType = rag.QuizTypeMixed
+	}
+	if !rag.IsValidQuizType(quizType) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "type must be one of multiple_choice, short_answer or mixed"})
+		return
+	}
+
+	format := payload.Format
+	if format == "" {
+		format = QuizFormatJSON
+	}
+	if format != QuizFormatJSON && format != QuizFormatAnki {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "format must be one of json or anki"})
+		return
+	}
+
+	// Optional questions per chapter (default 2, max 10)
+	perChapter := DefaultQuizQuestions
+	if payload.QuestionsPerChapter < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "questions_per_chapter must be a positive integer"})
+		return
+	}
+	if payload.QuestionsPerChapter > 0 {
+		perChapter = min(payload.QuestionsPerChapter, MaxQuizQuestions)
+	}
+
+	critique := payload.Critique == nil || *payload.Critique
+	excludeFlagged := payload.ExcludeFlagged == nil || *payload.ExcludeFlagged
+
+	questions, err := createQuiz(r.Context(), bookID, quizType, perChapter, payload.Chapters, critique, excludeFlagged)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			slog.Error("Failed to create quiz", "err", err, "book_id", bookID)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not create the quiz"})
+		}
+		return
+	}
+
+	if format == QuizFormatAnki {
+		out, err := rag.FormatAnkiCSV(quizCards(bookID, questions))
+		if err != nil {
+			slog.Error("Failed to render Anki CSV", "err", err, "book_id", bookID)
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="book_%d_quiz.csv"`, bookID))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(out))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(QuizResponse{BookID: bookID, Type: quizType, Questions: questions})
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/embiem/book-rag/data"
+)
+
+func TestPickQuizPassages(t *testing.T) {
+	var passages []data.GetPassagesInRangeRow
+	for i := range 10 {
+		text := strings.Repeat("word ", MinQuizPassageRunes/5)
+		if i%2 == 0 {
+			text = "CHAPTER"
+		}
+		passages = append(passages, data.GetPassagesInRangeRow{ID: int64(i), PassageText: text})
+	}
+
+	picked := pickQuizPassages(passages, 2, false)
+	if len(picked) != 2 || picked[0].ID != 3 || picked[1].ID != 7 {
+		t.Errorf("Expected long passages 3 and 7, got %+v", picked)
+	}
+
+	if picked := pickQuizPassages(passages, 8, false); len(picked) != 5 {
+		t.Errorf("Expected all 5 long passages, got %d", len(picked))
+	}
+
+	if picked := pickQuizPassages(passages[:1], 2, false); len(picked) != 1 || picked[0].ID != 0 {
+		t.Errorf("Expected short passages if there are no long ones, got %+v", picked)
+	}
+	passages[3].InjectionFlags = []string{"ignore_instructions"}
+	picked = pickQuizPassages(passages, 8, true)
+	if len(picked) != 4 || slices.ContainsFunc(picked, func(p data.GetPassagesInRangeRow) bool { return p.ID == 3 }) {
+		t.Errorf("Expected the 4 unflagged long passages, got %+v", picked)
+	}
+	if len(passages[3].InjectionFlags) == 0 || len(pickQuizPassages(passages, 8, false)) != 5 {
+		t.Errorf("Expected flagged passages to be kept without excludeFlagged")
+	}
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// DefaultQuoteMatches is the number of matches returned by default
+	DefaultQuoteMatches = 5
+	// MaxQuoteMatches caps the limit parameter
+	MaxQuoteMatches = 20
+	// DefaultQuoteContext is the number of runes shown before and after a match
+	DefaultQuoteContext = 200
+	// MaxQuoteContext caps the context parameter
+	MaxQuoteContext = 2000
+)
+
+type FindQuoteRequest struct {
+	Quote   string `json:"quote"`
+	Limit   int    `json:"limit"`
+	Context int    `json:"context"` // Runes of surrounding text before and after each match
+}
+
+type QuoteMatchItem struct {
+	Method     string     `json:"method"` // exact, normalized, fuzzy or semantic
+	Confidence float64    `json:"confidence"`
+	Text       string     `json:"text"` // The matched text as it appears in the book
+	Before     string     `json:"before"`
+	After      string     `json:"after"`
+	Span       SourceSpan `json:"span"`
+	PassageID  int64      `json:"passage_id,omitempty"` // The passage found by a semantic match
+}
+
+type FindQuoteResponse struct {
+	BookID  int64            `json:"book_id"`
+	Quote   string           `json:"quote"`
+	Method  string           `json:"method,omitempty"` // How the matches were found, empty without matches
+	Matches []QuoteMatchItem `json:"matches"`
+}
+
+// quoteSpan converts rune offsets in text into a source span
+func quoteSpan(text string, startRune, endRune int) SourceSpan {
+	span := SourceSpan{StartLine: 1}
+	runes, line := 0, 1
+	for i, r := range text {
+		if runes == startRune {
+			span.StartByte, span.StartRune, span.StartLine = int32(i), int32(runes), int32(line)
+		}
+		if runes == endRune {
+			span.EndByte, span.EndRune = int32(i), int32(runes)
+			return span
+		}
+		if r == '\n' {
+			line++
+		}
+		span.EndLine = int32(line) // Line of the last rune before the end
+		runes++
+	}
+	span.EndByte, span.EndRune = int32(len(text)), int32(runes)
+	return span
+}
+
+// quoteMatchItem cuts the match and its context out of the book text
+func quoteMatchItem(text string, runes []rune, match rag.QuoteMatch, contextRunes int) QuoteMatchItem {
+	start, end := min(match.StartRune, len(runes)), min(match.EndRune, len(runes))
+	return QuoteMatchItem{
+		Method:     match.Method,
+		Confidence: match.Confidence,
+		Text:       string(runes[start:end]),
+		Before:     string(runes[max(0, start-contextRunes):start]),
+		After:      string(runes[end:min(len(runes), end+contextRunes)]),
+		Span:       quoteSpan(text, start, end),
+	}
+}
+
+// findQuoteSemantic falls back to the passages most similar to the quote
+func findQuoteSemantic(ctx context.Context, bookID int64, quote string, limit int) ([]rag.QuoteMatch, []int64, error) {
+	results, err := retrieveCandidates(ctx, bookID, []string{quote}, int32(limit), pgtype.Int4{}, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matches []rag.QuoteMatch
+	var passageIDs []int64
+	for _, result := range results {
+		// Passages ingested before spans were recorded can't be located
+		if !result.StartRune.Valid || !result.EndRune.Valid {
+			continue
+		}
+		matches = append(matches, rag.QuoteMatch{
+			Method:     rag.QuoteMethodSemantic,
+			Confidence: max(0, float64(result.Similarity)) * rag.SemanticQuoteWeight,
+			StartRune:  int(result.StartRune.Int32),
+			EndRune:    int(result.EndRune.Int32),
+		})
+		passageIDs = append(passageIDs, result.ID)
+	}
+	return matches, passageIDs, nil
+}
+
+// HandleFindQuote locates a quote in the book text. Exact, normalized and
+// fuzzy matching are tried first, the most similar passages are returned if
+// none of them finds the quote.
+func HandleFindQuote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload FindQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	quote := strings.TrimSpace(payload.Quote)
+	if quote == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "quote is required"})
+		return
+	}
+	if utf8.RuneCountInString(quote) > MaxSpanLength {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "quote is too long"})
+		return
+	}
+
+	// Optional number of matches (default 5, max 20)
+	limit := DefaultQuoteMatches
+	if payload.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "limit must be a positive integer"})
+		return
+	}
+	if payload.Limit > 0 {
+		limit = min(payload.Limit, MaxQuoteMatches)
+	}
+
+	// Optional context around each match (default 200 runes, max 2000)
+	contextRunes := DefaultQuoteContext
+	if payload.Context < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "context must be a non-negative integer"})
+		return
+	}
+	if payload.Context > 0 {
+		contextRunes = min(payload.Context, MaxQuoteContext)
+	}
+
+	text, err := db.Queries.GetBookText(r.Context(), bookID)
+	if err != nil {
+		slog.Error("Failed to get book text", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	matches := rag.FindQuote(text, quote, limit)
+	var passageIDs []int64
+	if len(matches) == 0 {
+		matches, passageIDs, err = findQuoteSemantic(r.Context(), bookID, quote, limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+			return
+		}
+	}
+
+	res := FindQuoteResponse{BookID: bookID, Quote: quote, Matches: make([]QuoteMatchItem, len(matches))}
+	runes := []rune(text)
+	for i, match := range matches {
+		res.Method = match.Method
+		res.Matches[i] = quoteMatchItem(text, runes, match, contextRunes)
+		if passageIDs != nil {
+			res.Matches[i].PassageID = passageIDs[i]
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
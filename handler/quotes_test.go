@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"testing"
+)
+
+func TestQuoteSpan(t *testing.T) {
+	text := "First line\nThe ’quote’ is\nhere."
+
+	span := quoteSpan(text, 15, 30)
+	expected := SourceSpan{StartByte: 15, EndByte: 34, StartRune: 15, EndRune: 30, StartLine: 2, EndLine: 3}
+	if span != expected {
+		t.Errorf("Expected %+v, got %+v", expected, span)
+	}
+
+	span = quoteSpan(text, 26, 31)
+	expected = SourceSpan{StartByte: 30, EndByte: 35, StartRune: 26, EndRune: 31, StartLine: 3, EndLine: 3}
+	if span != expected {
+		t.Errorf("Expected %+v up to the end of the text, got %+v", expected, span)
+	}
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/embiem/book-rag/rag"
+)
+
+const (
+	// DefaultRerankCandidates is the candidate pool size handed to the
+	// reranker and to MMR diversification
+	DefaultRerankCandidates = 50
+	// MaxRerankCandidates caps the candidate pool size
+	MaxRerankCandidates = 200
+)
+
+// rerankPassages rescores the candidates with the configured reranker and
+// sorts them by their rerank score
+func rerankPassages(ctx context.Context, query string, candidates []PassageResult) ([]PassageResult, error) {
+	if len(candidates) == 0 {
+		return candidates, nil
+	}
+
+	documents := make([]string, len(candidates))
+	for i, c := range candidates {
+		documents[i] = c.Text
+	}
+
+	scores, err := rag.NewReranker().Rerank(ctx, query, documents)
+	if err != nil {
+		slog.Error("Failed to rerank passages", "err", err)
+		return nil, err
+	}
+
+	reranked := make([]PassageResult, len(candidates))
+	copy(reranked, candidates)
+	for i := range reranked {
+		reranked[i].RerankScore = &scores[i]
+	}
+
+	sort.SliceStable(reranked, func(i, j int) bool { return *reranked[i].RerankScore > *reranked[j].RerankScore })
+
+	return reranked, nil
+}
@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+type SearchLibraryRequest struct {
+	Query          string   `json:"query"`
+	Limit          int      `json:"limit"`
+	PerBookLimit   int      `json:"per_book_limit"`
+	BookIDs        []int64  `json:"book_ids"`
+	Tags           []string `json:"tags"`
+	Author         string   `json:"author"`
+	ExcludeFlagged bool     `json:"exclude_flagged"` // Leave out passages flagged as possible prompt injections
+}
+
+type SearchLibraryResponse struct {
+	Query string             `json:"query"`
+	Limit int                `json:"limit"`
+	Books []BookSearchResult `json:"books"`
+}
+
+// BookSearchResult groups the passages found in one book
+type BookSearchResult struct {
+	BookID            int64           `json:"book_id"`
+	BookName          string          `json:"book_name"`
+	Author            string          `json:"author,omitempty"`
+	Score             float32         `json:"score"` // Best similarity of the book's passages
+	AverageSimilarity float32         `json:"average_similarity"`
+	Passages          []PassageResult `json:"results"`
+}
+
+type LibraryGenerateRequest struct {
+	SearchLibraryRequest
+	PromptPreset  string `json:"prompt_preset"`
+	ContextTokens int    `json:"context_tokens"`
+}
+
+type CitedBook struct {
+	BookID    int64  `json:"book_id"`
+	BookName  string `json:"book_name"`
+	Citations []int  `json:"citations"` // Labels of the cited passages
+}
+
+func SearchLibrary(ctx context.Context, payload SearchLibraryRequest) (*SearchLibraryResponse, error) {
+	// Optional limit parameter (default 20, max 100)
+	limit := int32(20)
+	if payload.Limit > 0 {
+		limit = min(int32(payload.Limit), 100)
+	}
+
+	// Optional per book limit (default: no limit beyond the overall one)
+	perBookLimit := limit
+	if payload.PerBookLimit > 0 {
+		perBookLimit = min(int32(payload.PerBookLimit), limit)
+	}
+
+	queryEmbedding, err := embedQuery(payload.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	bookIDs := payload.BookIDs
+	if bookIDs == nil {
+		bookIDs = []int64{}
+	}
+
+	tags := make([]string, 0, len(payload.Tags))
+	for _, tag := range payload.Tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	results, err := db.Queries.SearchLibrary(ctx, data.SearchLibraryParams{
+		Embedding:      queryEmbedding,
+		BookIds:        bookIDs,
+		Tags:           tags,
+		Author:         strings.TrimSpace(payload.Author),
+		ExcludeFlagged: payload.ExcludeFlagged,
+		PerBookLimit:   perBookLimit,
+		MaxResults:     limit,
+	})
+	if err != nil {
+		slog.Error("Failed to search library", "err", err)
+		return nil, err
+	}
+
+	return &SearchLibraryResponse{
+		Query: payload.Query,
+		Limit: int(limit),
+		Books: groupByBook(results),
+	}, nil
+}
+
+// groupByBook groups passages by their book, ranking books by their best passage
+func groupByBook(rows []data.SearchLibraryRow) []BookSearchResult {
+	books := []BookSearchResult{}
+	indexByBook := make(map[int64]int)
+
+	for _, row := range rows {
+		idx, ok := indexByBook[row.BookID]
+		if !ok {
+			idx = len(books)
+			indexByBook[row.BookID] = idx
+			books = append(books, BookSearchResult{
+				BookID:   row.BookID,
+				BookName: row.BookName,
+				Author:   row.Author,
+			})
+		}
+
+		book := &books[idx]
+		book.Passages = append(book.Passages, PassageResult{
+			ID:         row.ID,
+			Ordinal:    row.Ordinal,
+			Text:       row.PassageText,
+			Similarity: row.Similarity,
+			Span:       newSourceSpan(row.StartByte, row.EndByte, row.StartRune, row.EndRune, row.StartLine, row.EndLine),
+		})
+		book.Score = max(book.Score, row.Similarity)
+	}
+
+	for i := range books {
+		var total float32
+		for _, p := range books[i].Passages {
+			total += p.Similarity
+		}
+		books[i].AverageSimilarity = total / float32(len(books[i].Passages))
+	}
+
+	sort.SliceStable(books, func(i, j int) bool { return books[i].Score > books[j].Score })
+
+	return books
+}
+
+// LibraryPassageResult is a passage given to the LLM under a citation label
+type LibraryPassageResult struct {
+	Label    int    `json:"label"` // Number the answer cites the passage by
+	BookID   int64  `json:"book_id"`
+	BookName string `json:"book_name"`
+	Author   string `json:"author,omitempty"`
+	PassageResult
+	Cited bool `json:"cited"`
+}
+
+// PrettifyBookPassages delimits each passage and labels it with its citation
+// label and the book it was taken from
+func PrettifyBookPassages(passages []LibraryPassageResult) string {
+	pretty := ""
+
+	for _, p := range passages {
+		attributes := []string{fmt.Sprintf(`id="%d"`, p.Label), fmt.Sprintf("book=%q", p.BookName)}
+		if p.Author != "" {
+			attributes = append(attributes, fmt.Sprintf("author=%q", p.Author))
+		}
+		attributes = append(attributes, fmt.Sprintf(`relevance="%d%%"`, int(math.Round(float64(p.Similarity)*100))))
+		pretty += rag.DelimitPassage(p.Text, attributes...) + "\n\n"
+	}
+
+	return pretty
+}
+
+// buildLibraryContext packs the passages of all books, most relevant first,
+// into the token budget and numbers the included ones for citations
+func buildLibraryContext(books []BookSearchResult, budget int) (string, []LibraryPassageResult, ContextReport) {
+	model := rag.GenerationModel()
+
+	var candidates []LibraryPassageResult
+	for _, b := range books {
+		for _, p := range b.Passages {
+			candidates = append(candidates, LibraryPassageResult{BookID: b.BookID, BookName: b.BookName, Author: b.Author, PassageResult: p})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Similarity > candidates[j].Similarity })
+
+	blocks := make([]string, len(candidates))
+	for i, c := range candidates {
+		blocks[i] = c.Text
+	}
+	pack := rag.PackContext(model, blocks, budget)
+
+	report := ContextReport{
+		Model:      model,
+		Budget:     pack.Budget,
+		UsedTokens: pack.UsedTokens,
+		Included:   []ContextEntry{},
+		Cut:        []ContextEntry{},
+	}
+
+	included := []LibraryPassageResult{}
+	for _, block := range pack.Included {
+		p := candidates[block.Index]
+		p.Label = len(included) + 1
+		p.Text = block.Text
+		included = append(included, p)
+
+		entry := ContextEntry{PassageIDs: []int64{p.ID}, StartOrdinal: p.Ordinal, EndOrdinal: p.Ordinal, Tokens: block.Tokens}
+		if block.Trimmed {
+			entry.OriginalTokens = rag.CountTokens(model, blocks[block.Index])
+			entry.Trimmed = true
+		}
+		report.Included = append(report.Included, entry)
+	}
+
+	for _, i := range pack.Dropped {
+		p := candidates[i]
+		report.Cut = append(report.Cut, ContextEntry{PassageIDs: []int64{p.ID}, StartOrdinal: p.Ordinal, EndOrdinal: p.Ordinal, Tokens: rag.CountTokens(model, blocks[i])})
+	}
+
+	return PrettifyBookPassages(included), included, report
+}
+
+func HandleSearchLibrary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	var payload SearchLibraryRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid Request params"})
+		return
+	}
+
+	if strings.TrimSpace(payload.Query) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "query is required"})
+		return
+	}
+
+	res, err := SearchLibrary(r.Context(), payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
+
+// HandleLibraryGenerate answers a query using passages from several books,
+// citing the books the answer draws on
+func HandleLibraryGenerate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	var payload LibraryGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid Request params"})
+		return
+	}
+
+	if strings.TrimSpace(payload.Query) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "query is required"})
+		return
+	}
+
+	if payload.PromptPreset != "" && !rag.IsValidPromptPreset(payload.PromptPreset) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "prompt_preset must be one of " + strings.Join(rag.PromptPresets(), ", ")})
+		return
+	}
+
+	searchPayload := payload.SearchLibraryRequest
+	if searchPayload.Limit <= 0 {
+		searchPayload.Limit = 10
+	}
+
+	searchResult, err := SearchLibrary(r.Context(), searchPayload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Error searching the library"})
+		return
+	}
+
+	if len(searchResult.Books) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(ErrorResponse{Error: "No books match the given filters"})
+		return
+	}
+
+	budget := contextBudget(payload.ContextTokens)
+	retrievedContext, included, contextReport := buildLibraryContext(searchResult.Books, budget)
+
+	promptBooks := make([]rag.PromptBook, len(searchResult.Books))
+	for i, b := range searchResult.Books {
+		promptBooks[i] = rag.PromptBook{Name: b.BookName, Author: b.Author}
+	}
+	passages := make([]PassageResult, len(included))
+	for i, p := range included {
+		passages[i] = p.PassageResult
+	}
+
+	// The prompt names the books instead of a single one
+	prompt, err := buildPrompt(payload.PromptPreset, data.GetBookRow{}, passages, rag.PromptData{
+		Query:   payload.Query,
+		Books:   promptBooks,
+		Context: retrievedContext,
+	})
+	if err != nil {
+		slog.Error("Failed to render prompt", "err", err, "prompt_preset", payload.PromptPreset)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not generate response"})
+		return
+	}
+	prompt += "\n\n" + libraryCitationInstructions
+
+	response, err := rag.GenerateText(r.Context(), prompt)
+	if err != nil {
+		slog.Error("Error during LLM generation", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Could not generate response"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(map[string]interface{}{
+		"answer":            response,
+		"prompt_preset":     cmp.Or(payload.PromptPreset, rag.DefaultPromptPreset),
+		"cited_books":       citedBooks(response, included),
+		"books":             searchResult.Books,
+		"passages":          included,
+		"retrieved_chunks":  len(included),
+		"retrieved_context": retrievedContext,
+		"context":           contextReport,
+	})
+}
+
+// libraryCitationInstructions are added to library prompts, as passages
+// from several books need to be told apart in the answer
+const libraryCitationInstructions = "The passages come from several books, each is labelled with its book and numbered with its id. Whenever you use information from a passage, cite it by its id in square brackets, for example [3] or [3, 7]."
+
+// citedBooks marks the passages the answer cites by label and returns their
+// books, in the order of the passages
+func citedBooks(answer string, passages []LibraryPassageResult) []CitedBook {
+	labels := make([]int, len(passages))
+	for i, p := range passages {
+		labels[i] = p.Label
+	}
+	citations := rag.ParseCitations(answer, labels)
+
+	cited := []CitedBook{}
+	indexByBook := make(map[int64]int)
+	for i := range passages {
+		p := &passages[i]
+		if !slices.Contains(citations, p.Label) {
+			continue
+		}
+		p.Cited = true
+
+		idx, ok := indexByBook[p.BookID]
+		if !ok {
+			idx = len(cited)
+			indexByBook[p.BookID] = idx
+			cited = append(cited, CitedBook{BookID: p.BookID, BookName: p.BookName})
+		}
+		cited[idx].Citations = append(cited[idx].Citations, p.Label)
+	}
+
+	return cited
+}
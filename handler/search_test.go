@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/embiem/book-rag/data"
+)
+
+func TestGroupByBook(t *testing.T) {
+	rows := []data.SearchLibraryRow{
+		{ID: 1, BookID: 10, BookName: "Emma", Similarity: 0.5},
+		{ID: 2, BookID: 20, BookName: "Moby Dick", Author: "Herman Melville", Similarity: 0.9},
+		{ID: 3, BookID: 10, BookName: "Emma", Similarity: 0.7},
+	}
+
+	books := groupByBook(rows)
+	if len(books) != 2 || books[0].BookID != 20 || books[1].BookID != 10 {
+		t.Fatalf("Expected books ranked by their best passage, got %+v", books)
+	}
+	if books[0].Author != "Herman Melville" || len(books[1].Passages) != 2 {
+		t.Errorf("Unexpected books %+v", books)
+	}
+	if books[1].Score != 0.7 || books[1].AverageSimilarity < 0.59 || books[1].AverageSimilarity > 0.61 {
+		t.Errorf("Expected score 0.7 and average 0.6, got %v and %v", books[1].Score, books[1].AverageSimilarity)
+	}
+
+	if books := groupByBook(nil); books == nil || len(books) != 0 {
+		t.Errorf("Expected an empty list, got %#v", books)
+	}
+}
+
+func TestPrettifyBookPassages(t *testing.T) {
+	pretty := PrettifyBookPassages([]LibraryPassageResult{
+		{Label: 1, BookName: "Moby Dick", Author: "Herman Melville", PassageResult: PassageResult{Text: "Call me Ishmael.", Similarity: 0.834}},
+		{Label: 2, BookName: "Emma", PassageResult: PassageResult{Text: "Emma Woodhouse, handsome, clever, and rich", Similarity: 0.5}},
+	})
+
+	for _, expected := range []string{
+		`<passage id="1" book="Moby Dick" author="Herman Melville" relevance="83%">` + "\nCall me Ishmael.\n</passage>",
+		`<passage id="2" book="Emma" relevance="50%">`,
+	} {
+		if !strings.Contains(pretty, expected) {
+			t.Errorf("Expected %q in %q", expected, pretty)
+		}
+	}
+}
+
+func TestBuildLibraryContext(t *testing.T) {
+	books := []BookSearchResult{
+		{BookID: 10, BookName: "Emma", Passages: []PassageResult{
+			{ID: 1, Text: strings.Repeat("match ", 60), Similarity: 0.8},
+			{ID: 2, Text: strings.Repeat("marry ", 60), Similarity: 0.4},
+		}},
+		{BookID: 20, BookName: "Persuasion", Passages: []PassageResult{
+			{ID: 3, Text: strings.Repeat("navy ", 60), Similarity: 0.6},
+		}},
+	}
+
+	// Room for the two best passages, across books
+	retrievedContext, included, report := buildLibraryContext(books, 250)
+	if len(included) != 2 || included[0].ID != 1 || included[1].ID != 3 {
+		t.Fatalf("Expected the two best passages, got %+v", included)
+	}
+	if included[0].Label != 1 || included[1].Label != 2 || included[1].BookName != "Persuasion" {
+		t.Errorf("Expected labels in context order, got %+v", included)
+	}
+	if len(report.Cut) != 1 || report.Cut[0].PassageIDs[0] != 2 || report.UsedTokens > 250 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if strings.Contains(retrievedContext, "marry") || strings.Count(retrievedContext, "</passage>") != 2 {
+		t.Errorf("Expected only the included passages in the context, got %q", retrievedContext)
+	}
+}
+
+func TestCitedBooks(t *testing.T) {
+	passages := []LibraryPassageResult{
+		{Label: 1, BookID: 10, BookName: "Emma"},
+		{Label: 2, BookID: 20, BookName: "Persuasion"},
+		{Label: 3, BookID: 10, BookName: "Emma"},
+		{Label: 4, BookID: 30, BookName: "Sanditon"},
+	}
+
+	cited := citedBooks("Emma meddles [3, 1] while Anne waits [2]. Nobody cites [9] or [Sanditon].", passages)
+	expected := []CitedBook{
+		{BookID: 10, BookName: "Emma", Citations: []int{1, 3}},
+		{BookID: 20, BookName: "Persuasion", Citations: []int{2}},
+	}
+	if !reflect.DeepEqual(cited, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, cited)
+	}
+	if !passages[0].Cited || !passages[1].Cited || passages[3].Cited {
+		t.Errorf("Expected the cited passages to be marked, got %+v", passages)
+	}
+
+	if cited := citedBooks("No citations.", passages[:1]); len(cited) != 0 {
+		t.Errorf("Expected no cited books, got %+v", cited)
+	}
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/embiem/book-rag/rag"
+)
+
+// StructuredOutputErrorResponse is returned with 422 if the LLM's output
+// never validated against the requested schema
+type StructuredOutputErrorResponse struct {
+	Error            string   `json:"error"`
+	RawOutput        string   `json:"raw_output"`
+	ValidationErrors []string `json:"validation_errors"`
+}
+
+// resolveOutputSchema reads the schema field of a /rag request, either the
+// name of a built-in schema or a JSON Schema object. It returns the schema
+// name ("custom" for an object), its JSON and the parsed schema, or nil
+// without a schema.
+func resolveOutputSchema(raw json.RawMessage) (string, []byte, *rag.Schema, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil, nil
+	}
+
+	name := "custom"
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return "", nil, nil, HttpError{Msg: "schema must be a built-in schema name or a JSON Schema object", Status: http.StatusBadRequest}
+		}
+		builtin, ok := rag.BuiltinSchemas[name]
+		if !ok {
+			return "", nil, nil, HttpError{Msg: fmt.Sprintf("schema must be one of %s or a JSON Schema object", strings.Join(rag.BuiltinSchemaNames(), ", ")), Status: http.StatusBadRequest}
+		}
+		raw = []byte(builtin)
+	} else if raw[0] != '{' {
+		return "", nil, nil, HttpError{Msg: "schema must be a built-in schema name or a JSON Schema object", Status: http.StatusBadRequest}
+	}
+
+	schema, err := rag.ParseSchema(raw)
+	if err != nil {
+		return "", nil, nil, HttpError{Msg: err.Error(), Status: http.StatusBadRequest}
+	}
+	return name, raw, schema, nil
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestResolveOutputSchema(t *testing.T) {
+	name, raw, schema, err := resolveOutputSchema(nil)
+	if name != "" || raw != nil || schema != nil || err != nil {
+		t.Errorf("Expected no schema, got %q %v", name, err)
+	}
+
+	name, _, schema, err = resolveOutputSchema(json.RawMessage(`"list_of_characters"`))
+	if name != "list_of_characters" || schema == nil || err != nil {
+		t.Errorf("Expected the built-in schema, got %q %v", name, err)
+	}
+
+	name, raw, schema, err = resolveOutputSchema(json.RawMessage(` {"type": "string"}`))
+	if name != "custom" || string(raw) != `{"type": "string"}` || schema == nil || err != nil {
+		t.Errorf("Expected a custom schema, got %q %s %v", name, raw, err)
+	}
+
+	for _, invalid := range []string{`"unknown"`, `42`, `{"type": 1}`} {
+		_, _, _, err := resolveOutputSchema(json.RawMessage(invalid))
+		if httpErr, ok := err.(HttpError); !ok || httpErr.Status != http.StatusBadRequest {
+			t.Errorf("Expected a 400 for %s, got %v", invalid, err)
+		}
+	}
+}
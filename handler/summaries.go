@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+const (
+	SummaryScopeChapter = "chapter"
+	SummaryScopeSection = "section" // SectionSize passages, for books without chapters
+	SummaryScopeBook    = "book"
+)
+
+type SummariesRequest struct {
+	Length  string   `json:"length"` // short (default) or detailed
+	Focus   []string `json:"focus"`
+	Refresh bool     `json:"refresh"` // Regenerate cached summaries
+}
+
+type SectionSummary struct {
+	Scope        string `json:"scope"` // chapter or section
+	Ordinal      int32  `json:"ordinal"`
+	Title        string `json:"title"`
+	StartOrdinal int32  `json:"start_ordinal"` // Passage ordinals covered by the summary
+	EndOrdinal   int32  `json:"end_ordinal"`
+	Summary      string `json:"summary"`
+	Cached       bool   `json:"cached"`
+}
+
+type SummariesResponse struct {
+	BookID      int64            `json:"book_id"`
+	Length      string           `json:"length"`
+	Focus       []string         `json:"focus"`
+	BookSummary string           `json:"book_summary"`
+	Cached      bool             `json:"cached"` // Whether the book summary came from the cache
+	Sections    []SectionSummary `json:"sections"`
+}
+
+// summaryUnit is a part of a book that is summarized on its own
+type summaryUnit struct {
+	scope    string
+	ordinal  int32
+	title    string
+	passages []data.GetPassagesInRangeRow
+}
+
+func (u summaryUnit) startOrdinal() int32 { return u.passages[0].Ordinal }
+func (u summaryUnit) endOrdinal() int32   { return u.passages[len(u.passages)-1].Ordinal }
+
+func (u summaryUnit) text() string {
+	texts := make([]string, len(u.passages))
+	for i, p := range u.passages {
+		texts[i] = p.PassageText
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// summaryUnits splits a book into its chapters, or into sections of
+// SectionSize passages if no chapters were detected
+func summaryUnits(ctx context.Context, bookID int64) ([]summaryUnit, error) {
+	chapters, err := db.Queries.GetBookChapters(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+
+	passages, err := db.Queries.GetPassagesInRange(ctx, data.GetPassagesInRangeParams{
+		BookID:       bookID,
+		StartOrdinal: 0,
+		EndOrdinal:   math.MaxInt32,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var units []summaryUnit
+	for _, chapter := range chapters {
+		unit := summaryUnit{scope: SummaryScopeChapter, ordinal: chapter.Ordinal, title: chapter.Title}
+		for _, p := range passages {
+			if p.StartRune.Valid && p.StartRune.Int32 >= chapter.StartRune && p.StartRune.Int32 < chapter.EndRune {
+				unit.passages = append(unit.passages, p)
+			}
+		}
+		if len(unit.passages) > 0 {
+			units = append(units, unit)
+		}
+	}
+	if len(units) > 0 {
+		return units, nil
+	}
+
+	for start := 0; start < len(passages); start += SectionSize {
+		section := passages[start:min(start+SectionSize, len(passages))]
+		units = append(units, summaryUnit{
+			scope:    SummaryScopeSection,
+			ordinal:  int32(len(units) + 1),
+			title:    fmt.Sprintf("Passages %d to %d", section[0].Ordinal, section[len(section)-1].Ordinal),
+			passages: section,
+		})
+	}
+	return units, nil
+}
+
+func summaryKey(scope string, ordinal int32) string {
+	return fmt.Sprintf("%s/%d", scope, ordinal)
+}
+
+// summarizeBook summarizes every chapter (map) and combines the chapter
+// summaries into a book summary (reduce). Cached summaries are reused unless
+// refresh is set.
+func summarizeBook(ctx context.Context, book data.GetBookRow, length string, focus []string, refresh bool) (*SummariesResponse, error) {
+	units, err := summaryUnits(ctx, book.ID)
+	if err != nil {
+		slog.Error("Failed to split book for summaries", "err", err, "book_id", book.ID)
+		return nil, err
+	}
+	if len(units) == 0 {
+		return nil, HttpError{Msg: "Book has no passages to summarize", Status: http.StatusUnprocessableEntity}
+	}
+
+	focusKey := strings.Join(focus, ", ")
+	cachedSummaries, err := db.Queries.GetSummaries(ctx, data.GetSummariesParams{
+		BookID: book.ID,
+		Length: length,
+		Focus:  focusKey,
+	})
+	if err != nil {
+		slog.Error("Failed to get cached summaries", "err", err, "book_id", book.ID)
+		return nil, err
+	}
+
+	cached := make(map[string]data.RagSummary, len(cachedSummaries))
+	for _, s := range cachedSummaries {
+		cached[summaryKey(s.Scope, s.UnitOrdinal)] = s
+	}
+
+	res := &SummariesResponse{
+		BookID:   book.ID,
+		Length:   length,
+		Focus:    focus,
+		Sections: make([]SectionSummary, len(units)),
+	}
+
+	var missing []int
+	var sections []rag.SummarySection
+	for i, unit := range units {
+		res.Sections[i] = SectionSummary{
+			Scope:        unit.scope,
+			Ordinal:      unit.ordinal,
+			Title:        unit.title,
+			StartOrdinal: unit.startOrdinal(),
+			EndOrdinal:   unit.endOrdinal(),
+		}
+
+		if s, ok := cached[summaryKey(unit.scope, unit.ordinal)]; ok && !refresh {
+			res.Sections[i].Summary = s.Summary
+			res.Sections[i].Cached = true
+			continue
+		}
+		missing = append(missing, i)
+		sections = append(sections, rag.SummarySection{Title: unit.title, Text: unit.text()})
+	}
+
+	generator := rag.NewGenerator()
+
+	summaries, err := generator.SummarizeSections(ctx, sections, length, focus)
+	if err != nil {
+		slog.Error("Failed to summarize sections", "err", err, "book_id", book.ID)
+		return nil, err
+	}
+
+	for j, i := range missing {
+		res.Sections[i].Summary = summaries[j]
+		if err := storeSummary(ctx, book.ID, res.Sections[i], length, focusKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if s, ok := cached[summaryKey(SummaryScopeBook, 0)]; ok && !refresh && len(missing) == 0 {
+		res.BookSummary = s.Summary
+		res.Cached = true
+		return res, nil
+	}
+
+	sectionSummaries := make([]string, len(res.Sections))
+	for i, s := range res.Sections {
+		sectionSummaries[i] = fmt.Sprintf("%s: %s", s.Title, s.Summary)
+	}
+
+	res.BookSummary, err = generator.CombineSummaries(ctx, book.BookName, sectionSummaries, length, focus)
+	if err != nil {
+		slog.Error("Failed to combine summaries", "err", err, "book_id", book.ID)
+		return nil, err
+	}
+
+	if err := storeSummary(ctx, book.ID, SectionSummary{
+		Scope:        SummaryScopeBook,
+		Title:        book.BookName,
+		StartOrdinal: res.Sections[0].StartOrdinal,
+		EndOrdinal:   res.Sections[len(res.Sections)-1].EndOrdinal,
+		Summary:      res.BookSummary,
+	}, length, focusKey); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func storeSummary(ctx context.Context, bookID int64, s SectionSummary, length, focus string) error {
+	_, err := db.Queries.UpsertSummary(ctx, data.UpsertSummaryParams{
+		BookID:       bookID,
+		Scope:        s.Scope,
+		UnitOrdinal:  s.Ordinal,
+		Title:        s.Title,
+		StartOrdinal: s.StartOrdinal,
+		EndOrdinal:   s.EndOrdinal,
+		Length:       length,
+		Focus:        focus,
+		Summary:      s.Summary,
+	})
+	if err != nil {
+		slog.Error("Failed to store summary", "err", err, "book_id", bookID, "scope", s.Scope, "ordinal", s.Ordinal)
+	}
+	return err
+}
+
+// delimitSummary wraps a summary in <passage> tags like the passages it was
+// written from, as it can repeat instructions hidden in the book's text
+func delimitSummary(title, summary string) string {
+	return rag.DelimitPassage(summary, fmt.Sprintf("summary=%q", rag.SanitizePassage(title)))
+}
+
+// summaryContext formats the cached general summaries relevant to the
+// retrieved passages: the book summary and the summaries of the chapters the
+// passages are from. With a reading position, the book summary and chapters
+// past the position are left out to avoid spoilers.
+func summaryContext(ctx context.Context, bookID int64, length string, queryResult *QueryBookResponse) (string, []string, error) {
+	summaries, err := db.Queries.GetSummaries(ctx, data.GetSummariesParams{
+		BookID: bookID,
+		Length: length,
+	})
+	if err != nil {
+		slog.Error("Failed to get summaries", "err", err, "book_id", bookID)
+		return "", nil, err
+	}
+
+	var b strings.Builder
+	used := []string{}
+	for _, s := range summaries {
+		if queryResult.MaxOrdinal != nil && (s.Scope == SummaryScopeBook || s.EndOrdinal > *queryResult.MaxOrdinal) {
+			continue
+		}
+
+		relevant := s.Scope == SummaryScopeBook
+		for _, p := range queryResult.Passages {
+			if p.Ordinal >= s.StartOrdinal && p.Ordinal <= s.EndOrdinal {
+				relevant = true
+				break
+			}
+		}
+		if !relevant {
+			continue
+		}
+
+		if s.Scope == SummaryScopeBook {
+			fmt.Fprintf(&b, "%s\n\n", delimitSummary("the whole book", s.Summary))
+		} else {
+			fmt.Fprintf(&b, "%s\n\n", delimitSummary(s.Title, s.Summary))
+		}
+		used = append(used, s.Title)
+	}
+
+	return strings.TrimSpace(b.String()), used, nil
+}
+
+// HandleSummarizeBook summarizes a book chapter by chapter and as a whole
+func HandleSummarizeBook(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	var payload SummariesRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+
+	length := payload.Length
+	if length == "" {
+		length = rag.SummaryLengthShort
+	}
+	if !rag.IsValidSummaryLength(length) {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "length must be one of short or detailed"})
+		return
+	}
+
+	book, err := db.Queries.GetBook(r.Context(), bookID)
+	if err != nil {
+		slog.Error("Failed to get book", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	res, err := summarizeBook(r.Context(), book, length, rag.NormalizeFocus(payload.Focus), payload.Refresh)
+	if err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not summarize the book"})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// DefaultSpanLength is used when GET /books/{bookID}/text has no end
+	DefaultSpanLength = 2000
+	// MaxSpanLength caps how much text a single span request may return
+	MaxSpanLength = 100_000
+)
+
+// SourceSpan locates a passage in the original book text.
+// Byte and rune ends are exclusive, lines are 1-based and inclusive.
+type SourceSpan struct {
+	StartByte int32 `json:"start_byte"`
+	EndByte   int32 `json:"end_byte"`
+	StartRune int32 `json:"start_rune"`
+	EndRune   int32 `json:"end_rune"`
+	StartLine int32 `json:"start_line"`
+	EndLine   int32 `json:"end_line"`
+}
+
+type BookTextResponse struct {
+	BookID     int64  `json:"book_id"`
+	Start      int32  `json:"start"`
+	End        int32  `json:"end"`
+	TextLength int32  `json:"text_length"`
+	Text       string `json:"text"`
+}
+
+// newSourceSpan returns nil for passages ingested before spans were recorded
+func newSourceSpan(startByte, endByte, startRune, endRune, startLine, endLine pgtype.Int4) *SourceSpan {
+	if !startByte.Valid || !endByte.Valid || !startRune.Valid || !endRune.Valid || !startLine.Valid || !endLine.Valid {
+		return nil
+	}
+
+	return &SourceSpan{
+		StartByte: startByte.Int32,
+		EndByte:   endByte.Int32,
+		StartRune: startRune.Int32,
+		EndRune:   endRune.Int32,
+		StartLine: startLine.Int32,
+		EndLine:   endLine.Int32,
+	}
+}
+
+// HandleGetBookText returns the original book text between the rune offsets
+// start (inclusive) and end (exclusive)
+func HandleGetBookText(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	start := 0
+	if raw := r.URL.Query().Get("start"); raw != "" {
+		start, err = strconv.Atoi(raw)
+		if err != nil || start < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrorResponse{Error: "start must be a non-negative integer"})
+			return
+		}
+	}
+
+	end := start + DefaultSpanLength
+	if raw := r.URL.Query().Get("end"); raw != "" {
+		end, err = strconv.Atoi(raw)
+		if err != nil || end <= start {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(ErrorResponse{Error: "end must be an integer greater than start"})
+			return
+		}
+	}
+
+	if end-start > MaxSpanLength {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(ErrorResponse{Error: "Requested span is too long"})
+		return
+	}
+
+	span, err := db.Queries.GetBookTextSpan(r.Context(), data.GetBookTextSpanParams{
+		ID:         bookID,
+		StartRune:  int32(start),
+		SpanLength: int32(end - start),
+	})
+	if err != nil {
+		slog.Error("Failed to get book text span", "err", err, "book_id", bookID)
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(BookTextResponse{
+		BookID:     bookID,
+		Start:      int32(min(start, int(span.TextLength))),
+		End:        int32(min(end, int(span.TextLength))),
+		TextLength: span.TextLength,
+		Text:       span.SpanText,
+	})
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/rag"
+)
+
+type TimelineEventItem struct {
+	Position    int32       `json:"position"`
+	Scope       string      `json:"scope"` // chapter or section
+	UnitOrdinal int32       `json:"unit_ordinal"`
+	UnitTitle   string      `json:"unit_title"`
+	Description string      `json:"description"`
+	PassageIDs  []int64     `json:"passage_ids"`
+	Span        *SourceSpan `json:"span,omitempty"` // From the first to the last supporting passage
+}
+
+type TimelineResponse struct {
+	BookID int64               `json:"book_id"`
+	Events []TimelineEventItem `json:"events"`
+}
+
+// eventSpan covers the supporting passages of an event in the book text
+func eventSpan(passageIDs []int64, passages map[int64]data.GetPassagesByIDsRow) *SourceSpan {
+	var first, last *data.GetPassagesByIDsRow
+	for _, id := range passageIDs {
+		p, ok := passages[id]
+		if !ok {
+			continue
+		}
+		if first == nil || p.Ordinal < first.Ordinal {
+			first = &p
+		}
+		if last == nil || p.Ordinal > last.Ordinal {
+			last = &p
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	return newSourceSpan(first.StartByte, last.EndByte, first.StartRune, last.EndRune, first.StartLine, last.EndLine)
+}
+
+// loadTimeline returns the stored timeline of a book with source spans
+func loadTimeline(ctx context.Context, bookID int64) (*TimelineResponse, error) {
+	events, err := db.Queries.GetTimelineEvents(ctx, bookID)
+	if err != nil {
+		slog.Error("Failed to get timeline", "err", err, "book_id", bookID)
+		return nil, err
+	}
+
+	var ids []int64
+	for _, e := range events {
+		ids = append(ids, e.PassageIds...)
+	}
+	rows, err := db.Queries.GetPassagesByIDs(ctx, ids)
+	if err != nil {
+		slog.Error("Failed to get passages", "err", err, "book_id", bookID)
+		return nil, err
+	}
+	passages := make(map[int64]data.GetPassagesByIDsRow, len(rows))
+	for _, row := range rows {
+		passages[row.ID] = row
+	}
+
+	res := &TimelineResponse{BookID: bookID, Events: make([]TimelineEventItem, len(events))}
+	for i, e := range events {
+		res.Events[i] = TimelineEventItem{
+			Position:    e.Position,
+			Scope:       e.Scope,
+			UnitOrdinal: e.UnitOrdinal,
+			UnitTitle:   e.UnitTitle,
+			Description: e.Description,
+			PassageIDs:  e.PassageIds,
+			Span:        eventSpan(e.PassageIds, passages),
+		}
+	}
+	return res, nil
+}
+
+// createTimeline extracts the events of every chapter in order and replaces
+// the stored timeline
+func createTimeline(ctx context.Context, bookID int64) error {
+	units, err := summaryUnits(ctx, bookID)
+	if err != nil {
+		slog.Error("Failed to split book for timeline", "err", err, "book_id", bookID)
+		return err
+	}
+	if len(units) == 0 {
+		return HttpError{Msg: "Book has no passages to extract events from", Status: http.StatusUnprocessableEntity}
+	}
+
+	sections := make([]rag.TimelineSection, len(units))
+	for i, unit := range units {
+		sections[i].Title = unit.title
+		for _, p := range unit.passages {
+			sections[i].Passages = append(sections[i].Passages, rag.TimelinePassage{ID: p.ID, Text: p.PassageText})
+		}
+	}
+
+	events, err := rag.NewGenerator().ExtractTimeline(ctx, sections)
+	if err != nil {
+		slog.Error("Failed to extract timeline", "err", err, "book_id", bookID)
+		return err
+	}
+
+	params := make([]data.CreateTimelineEventsParams, len(events))
+	for i, e := range events {
+		unit := units[e.Section]
+		params[i] = data.CreateTimelineEventsParams{
+			BookID:      bookID,
+			Position:    int32(i + 1),
+			Scope:       unit.scope,
+			UnitOrdinal: unit.ordinal,
+			UnitTitle:   unit.title,
+			Description: e.Description,
+			PassageIds:  e.PassageIDs,
+		}
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	qtx := db.Queries.WithTx(tx)
+	if err := qtx.DeleteTimelineEvents(ctx, bookID); err != nil {
+		slog.Error("Failed to delete timeline", "err", err, "book_id", bookID)
+		return err
+	}
+
+	var batchErr error
+	qtx.CreateTimelineEvents(ctx, params).Exec(func(i int, err error) {
+		if err != nil {
+			slog.Error("Failed to insert timeline event", "index", i, "err", err)
+			batchErr = err
+		}
+	})
+	if batchErr != nil {
+		return batchErr
+	}
+
+	return tx.Commit(ctx)
+}
+
+// HandleCreateTimeline extracts and stores the timeline of a book
+func HandleCreateTimeline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	if err := createTimeline(r.Context(), bookID); err != nil {
+		if httpErr, ok := err.(HttpError); ok {
+			w.WriteHeader(httpErr.Status)
+			enc.Encode(ErrorResponse{Error: httpErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Could not create the timeline"})
+		}
+		return
+	}
+
+	res, err := loadTimeline(r.Context(), bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
+
+// HandleGetTimeline returns the stored timeline of a book
+func HandleGetTimeline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+
+	bookID, err := EnsureBookExists(r)
+	if err != nil {
+		if bookErr, ok := err.(HttpError); ok {
+			w.WriteHeader(bookErr.Status)
+			enc.Encode(ErrorResponse{Error: bookErr.Msg})
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		}
+		return
+	}
+
+	res, err := loadTimeline(r.Context(), bookID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(ErrorResponse{Error: "Internal Server Error"})
+		return
+	}
+	if len(res.Events) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(ErrorResponse{Error: fmt.Sprintf("No timeline yet, create it with POST /books/%d/timeline", bookID)})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	enc.Encode(res)
+}
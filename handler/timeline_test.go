@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/embiem/book-rag/data"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func spanPassage(id int64, ordinal, start, end int32) data.GetPassagesByIDsRow {
+	return data.GetPassagesByIDsRow{
+		ID:        id,
+		Ordinal:   ordinal,
+		StartByte: pgtype.Int4{Int32: start, Valid: true},
+		EndByte:   pgtype.Int4{Int32: end, Valid: true},
+		StartRune: pgtype.Int4{Int32: start, Valid: true},
+		EndRune:   pgtype.Int4{Int32: end, Valid: true},
+		StartLine: pgtype.Int4{Int32: start / 10, Valid: true},
+		EndLine:   pgtype.Int4{Int32: end / 10, Valid: true},
+	}
+}
+
+func TestEventSpan(t *testing.T) {
+	passages := map[int64]data.GetPassagesByIDsRow{
+		10: spanPassage(10, 3, 300, 400),
+		11: spanPassage(11, 4, 400, 500),
+		12: spanPassage(12, 6, 600, 700),
+	}
+
+	span := eventSpan([]int64{12, 10, 99}, passages)
+	expected := &SourceSpan{StartByte: 300, EndByte: 700, StartRune: 300, EndRune: 700, StartLine: 30, EndLine: 70}
+	if !reflect.DeepEqual(span, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, span)
+	}
+
+	if span := eventSpan([]int64{99}, passages); span != nil {
+		t.Errorf("Expected no span for unknown passages, got %+v", span)
+	}
+}
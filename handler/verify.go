@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/embiem/book-rag/rag"
+)
+
+// VerificationReport lists how well the passages support each claim of an
+// answer
+type VerificationReport struct {
+	Mode        string      `json:"mode"` // flag or remove
+	Claims      []rag.Claim `json:"claims"`
+	Supported   int         `json:"supported"`
+	Partial     int         `json:"partially_supported"`
+	Unsupported int         `json:"unsupported"` // Flagged or removed
+}
+
+// verifyAnswer checks the claims of an answer against the context blocks it
+// was generated from and flags or removes the unsupported ones
+func verifyAnswer(ctx context.Context, query, answer, mode string, grounding []rag.GroundingPassage) (string, *VerificationReport, error) {
+	claims, err := rag.NewGenerator().VerifyClaims(ctx, query, rag.SplitClaims(answer), grounding)
+	if err != nil {
+		slog.Error("Failed to verify answer", "err", err)
+		return "", nil, err
+	}
+
+	report := &VerificationReport{Mode: mode, Claims: claims}
+	for _, c := range claims {
+		switch c.Label {
+		case rag.ClaimSupported:
+			report.Supported++
+		case rag.ClaimPartial:
+			report.Partial++
+		case rag.ClaimUnsupported:
+			report.Unsupported++
+		}
+	}
+	if report.Claims == nil {
+		report.Claims = []rag.Claim{}
+	}
+
+	return rag.ApplyVerification(answer, claims, mode), report, nil
+}
@@ -1,20 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/embiem/book-rag/config"
 	"github.com/embiem/book-rag/db"
+	"github.com/embiem/book-rag/eval"
 	"github.com/embiem/book-rag/handler"
+	"github.com/embiem/book-rag/rag"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
 func main() {
-	initialize()
-	defer teardown()
+	configPath := flag.String("config", "", "Path to a JSON config file (default: $CONFIG_FILE)")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if args := flag.Args(); len(args) > 0 {
+		runCommand(cfg, err, args)
+		return
+	}
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	initialize(*cfg)
 
 	r := chi.NewRouter()
 	r.Use(middleware.CleanPath)
@@ -27,12 +50,56 @@ func main() {
 
 Available endpoints:
 - GET /books - List available books for querying
-- POST /books - Ingest a new book into the vector database (upload .txt file)
+- POST /books - Ingest a new book into the vector database (upload .txt file, optional author, comma separated tags, prompt_preset & entities (rules (default), llm or none))
 - POST /books/{bookID}/query - Query for snippets from a specific book
-  Body: {"query": "search text", "limit": 20}
-  query (required), limit (optional, default: 20, max: 100)
+  Body: {"query": "search text", "limit": 20, "window": 1}
+  query (required), limit (optional, default: 20, max: 100), window (optional, neighbors per hit, max: 5)
+  rerank (optional, rescore candidates with a reranker), rerank_candidates (optional, default: 50, max: 200)
+  mmr (optional, diversify results with maximal marginal relevance), lambda (optional, default: 0.5, 1 = relevance only)
+  min_similarity (optional, drop passages below this similarity, default depends on the embedding model)
+  query_strategy (optional, raw (default), rewrite, hyde or multi)
+  reading_position (optional, {"chapter": 3} or {"offset": 120000}, only retrieve passages before it to avoid spoilers)
+  entities (optional, ["Lizzy", "Mr. Darcy"], only retrieve passages mentioning one of these entities)
+  exclude_flagged (optional, leave out passages flagged as possible prompt injections, also for /rag, /compare, /search and conversations)
+  mode (optional, single (default) or agent to let the LLM search the book with tools), max_steps & max_tokens (optional, agent budget)
 - POST /books/{bookID}/rag - Provide a prompt and receive a LLM generated answer enriched with relevant passages from the book
-  Body: {"query": "your question about the book"}
+  Body: {"query": "your question about the book", "window": 1, "rerank": true, "prompt_preset": "student"}
+  limit (optional, passages to retrieve, default: 20), context_tokens (optional, token budget for the passages given to the LLM)
+  summaries (optional, add cached summaries of the book and the chapters of the retrieved passages), summary_length (optional, short or detailed)
+  schema (optional, list_of_characters, yes_no_with_evidence, list_of_events or a JSON Schema object for a validated JSON answer)
+  verify (optional, flag or remove to check each claim of the answer against the passages and mark or drop unsupported ones)
+- PUT /books/{bookID}/prompt_preset - Set the prompt preset used for a book when requests don't select one
+  Body: {"prompt_preset": "literary-analysis"}
+- GET /prompts - List available prompt presets
+- GET /books/{bookID}/chapters - List the chapters detected in a book
+- GET /books/{bookID}/entities?kind=character - List the characters, places and organizations mentioned in a book
+- POST /books/{bookID}/entities - Extract the entities of a book again, replacing the stored ones
+  Body: {"method": "llm"}
+- GET /books/{bookID}/graph?format=json - Character co-occurrence graph of a book as json, graphml or dot
+  kind (optional, default: character, all for every kind), min_weight (optional, default: 2), max_nodes (optional, default: 50), labels (optional, true to let the LLM label relationships)
+- GET /books/{bookID}/injections - List the passages flagged as possible prompt injections at ingest
+- POST /books/{bookID}/injections - Scan the passages of a book for prompt injections again
+- POST /books/{bookID}/timeline - Extract the key events of a book chapter by chapter with their passages and store them
+- GET /books/{bookID}/timeline - Get the stored timeline of a book
+- POST /books/{bookID}/summaries - Summarize a book chapter by chapter and as a whole, summaries are cached
+  Body: {"length": "short", "focus": ["themes"], "refresh": false}
+- POST /books/{bookID}/quiz - Generate multiple-choice and short-answer questions per chapter with citations, as json or Anki csv
+  Body: {"type": "mixed", "questions_per_chapter": 2, "chapters": [1, 2], "critique": true, "format": "json"}
+- POST /books/{bookID}/quotes - Find where a quote appears in a book, even if misremembered
+  Body: {"quote": "call me ishmael", "limit": 5, "context": 200}
+- GET /books/{bookID}/passages/{passageID}?context=N - Get a passage with N neighboring passages on each side
+- GET /books/{bookID}/text?start=0&end=2000 - Get a span of the original book text (rune offsets, end exclusive)
+- POST /books/{bookID}/conversations - Start a conversation about a book
+- POST /conversations/{conversationID}/messages - Send a message and receive an answer that takes the conversation into account
+  Body: {"content": "and what did she do next?"}
+  Accepts the retrieval options of POST /books/{bookID}/rag, prompt_preset and context_tokens
+- GET /conversations/{conversationID} - Replay a conversation, including the passages each answer cites
+- POST /search - Query for snippets across the whole library, grouped by book
+  Body: {"query": "search text", "limit": 20, "per_book_limit": 5, "book_ids": [1, 2], "tags": ["novel"], "author": "Melville"}
+  query (required), all filters optional, exclude_flagged (optional, leave out passages flagged as possible prompt injections)
+- POST /rag - Like POST /books/{bookID}/rag, but answers from several books with citations. Accepts the filters of POST /search, prompt_preset and context_tokens
+- POST /compare - Answer a question comparing several books, with evidence and citations from each book
+  Body: {"book_ids": [1, 2], "question": "compare how marriage is portrayed", "limit": 5}
 `))
 	})
 
@@ -44,18 +111,157 @@ Available endpoints:
 
 	r.Post("/books/{bookID}/rag", handler.HandleGenerate)
 
-	slog.Info("Listening on :3000")
-	http.ListenAndServe(":3000", r)
+	r.Put("/books/{bookID}/prompt_preset", handler.HandleSetBookPromptPreset)
+
+	r.Get("/books/{bookID}/chapters", handler.HandleListChapters)
+
+	r.Get("/books/{bookID}/entities", handler.HandleListEntities)
+
+	r.Post("/books/{bookID}/entities", handler.HandleExtractEntities)
+
+	r.Get("/books/{bookID}/graph", handler.HandleGetGraph)
+
+	r.Post("/books/{bookID}/summaries", handler.HandleSummarizeBook)
+
+	r.Get("/books/{bookID}/injections", handler.HandleGetInjectionReport)
+
+	r.Post("/books/{bookID}/injections", handler.HandleScanInjections)
+
+	r.Post("/books/{bookID}/timeline", handler.HandleCreateTimeline)
+
+	r.Get("/books/{bookID}/timeline", handler.HandleGetTimeline)
+
+	r.Post("/books/{bookID}/quiz", handler.HandleCreateQuiz)
+
+	r.Post("/books/{bookID}/quotes", handler.HandleFindQuote)
+
+	r.Get("/books/{bookID}/passages/{passageID}", handler.HandleGetPassage)
+
+	r.Get("/books/{bookID}/text", handler.HandleGetBookText)
+
+	r.Post("/books/{bookID}/conversations", handler.HandleCreateConversation)
+
+	r.Post("/conversations/{conversationID}/messages", handler.HandleSendMessage)
+
+	r.Get("/conversations/{conversationID}", handler.HandleGetConversation)
+
+	r.Get("/prompts", handler.HandleListPromptPresets)
+
+	r.Post("/search", handler.HandleSearchLibrary)
+
+	r.Post("/rag", handler.HandleLibraryGenerate)
+
+	r.Post("/compare", handler.HandleCompareBooks)
+
+	err = serve(cfg.Server, r)
+	teardown()
+	if err != nil {
+		log.Fatalf("server failed: %v", err)
+	}
 }
 
-func initialize() {
-	openaiApiKey := os.Getenv("OPENAI_API_KEY")
-	if openaiApiKey == "" {
+// abortGrace is how long cancelled ingestions get to roll back before the
+// database pool is closed
+const abortGrace = 5 * time.Second
+
+// serve runs the server until SIGINT or SIGTERM, then stops accepting
+// connections and waits for running requests and ingestions. Whatever is
+// still running after the shutdown timeout is cancelled and reported as an
+// error, so the process doesn't exit as if it drained cleanly.
+func serve(cfg config.ServerConfig, h http.Handler) error {
+	// Requests and ingestions run in baseCtx, so they can be cancelled
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler.SetJobContext(baseCtx)
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Listening on " + cfg.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err // Couldn't listen, e.g. the address is in use
+	case <-signalCtx.Done():
+	}
+	stop() // A second signal kills the process right away
+
+	slog.Info("Shutting down, waiting for running requests", "timeout", time.Duration(cfg.ShutdownTimeout))
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancelShutdown()
+
+	shutdownErr := srv.Shutdown(shutdownCtx)
+	jobsErr := handler.WaitJobs(shutdownCtx)
+	if shutdownErr == nil && jobsErr == nil {
+		return nil
+	}
+
+	// Cancel what is left, ingestions roll back their transaction
+	slog.Warn("Requests didn't finish in time, cancelling them")
+	cancel()
+	srv.Close()
+	err := fmt.Errorf("requests didn't finish within the shutdown timeout and were cancelled: %w", errors.Join(shutdownErr, jobsErr))
+	abortCtx, cancelAbort := context.WithTimeout(context.Background(), abortGrace)
+	defer cancelAbort()
+	if abortErr := handler.WaitJobs(abortCtx); abortErr != nil {
+		err = errors.Join(err, fmt.Errorf("ingestions didn't stop after being cancelled: %w", abortErr))
+	}
+	return err
+}
+
+// runCommand runs a command given instead of starting the server. cfgErr is
+// the error of loading the configuration, cfg is nil if it couldn't be loaded.
+func runCommand(cfg *config.Config, cfgErr error, args []string) {
+	switch strings.Join(args, " ") {
+	case "config print":
+		// The effective configuration, e.g. to check env overrides. An invalid
+		// one is still printed to find the problems.
+		if cfg == nil {
+			log.Fatalf("invalid configuration: %v", cfgErr)
+		}
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if cfgErr != nil {
+			log.Fatalf("invalid configuration: %v", cfgErr)
+		}
+	default:
+		log.Fatalf("unknown command %q, available commands: config print", strings.Join(args, " "))
+	}
+}
+
+func initialize(cfg config.Config) {
+	rag.Configure(cfg)
+	eval.Configure(cfg) // Quizzes reuse the question generation of the evaluation
+
+	if cfg.LLM.APIKey == "" && cfg.LLM.BaseURL == "" {
 		slog.Warn("Missing OPENAI_API_KEY env var. /rag endpoint won't work.")
 	}
 
+	// Fail early on broken prompt templates
+	if err := rag.LoadPromptTemplates(); err != nil {
+		log.Fatalf("couldn't load prompt templates: %v", err)
+	}
+
 	// Setup DB
-	if err := db.Init(); err != nil {
+	if err := cfg.RequireDatabase(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	if err := db.Init(cfg.Database); err != nil {
 		log.Fatalf("couldn't init db: %v", err)
 	}
 }
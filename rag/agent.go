@@ -0,0 +1,140 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/openai/openai-go/v3"
+)
+
+const (
+	DefaultAgentMaxSteps  = 5
+	MaxAgentSteps         = 10
+	DefaultAgentMaxTokens = 50_000
+	MaxAgentTokens        = 200_000
+)
+
+// Tool is a function the LLM may call during an agent run. Run receives the
+// raw JSON arguments and returns the text handed back to the LLM.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]any // JSON Schema of the arguments
+	Run         func(ctx context.Context, arguments string) (string, error)
+}
+
+// AgentBudget bounds an agent run. A step is one LLM call, which may request
+// several tool calls at once.
+type AgentBudget struct {
+	MaxSteps  int
+	MaxTokens int64
+}
+
+// ToolCallTrace records one tool call made during an agent run
+type ToolCallTrace struct {
+	Step      int    `json:"step"`
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type AgentResult struct {
+	Answer      string          `json:"answer"`
+	Trace       []ToolCallTrace `json:"tool_calls"`
+	Steps       int             `json:"steps"`
+	TotalTokens int64           `json:"total_tokens"`
+	StopReason  string          `json:"stop_reason"` // answered, max_steps or max_tokens
+}
+
+// RunAgent lets the LLM call tools over several steps until it answers or the
+// budget runs out. When the budget runs out, the LLM is asked for a final
+// answer without tools, based on what it has gathered so far.
+func (g *Generator) RunAgent(ctx context.Context, systemPrompt, userPrompt string, tools []Tool, budget AgentBudget) (*AgentResult, error) {
+	toolsByName := make(map[string]Tool, len(tools))
+	toolParams := make([]openai.ChatCompletionToolUnionParam, len(tools))
+	for i, tool := range tools {
+		toolsByName[tool.Name] = tool
+		toolParams[i] = openai.ChatCompletionFunctionTool(openai.FunctionDefinitionParam{
+			Name:        tool.Name,
+			Description: openai.String(tool.Description),
+			Parameters:  tool.Parameters,
+		})
+	}
+
+	messages := []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage(systemPrompt),
+		openai.UserMessage(userPrompt),
+	}
+
+	result := &AgentResult{Trace: []ToolCallTrace{}}
+
+	for result.Steps < budget.MaxSteps && result.TotalTokens < budget.MaxTokens {
+		result.Steps++
+		slog.Info("Agent step", "step", result.Steps, "model", g.Model, "total_tokens", result.TotalTokens)
+
+		completion, err := g.Complete(ctx, openai.ChatCompletionNewParams{
+			Messages: messages,
+			Tools:    toolParams,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.TotalTokens += completion.Usage.TotalTokens
+
+		message := completion.Choices[0].Message
+		if len(message.ToolCalls) == 0 {
+			result.Answer = message.Content
+			result.StopReason = "answered"
+			return result, nil
+		}
+
+		messages = append(messages, message.ToParam())
+		for _, call := range message.ToolCalls {
+			trace := ToolCallTrace{
+				Step:      result.Steps,
+				Tool:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			}
+
+			output, err := runTool(ctx, toolsByName, call.Function.Name, call.Function.Arguments)
+			if err != nil {
+				// Let the LLM see the error, so it can correct its call
+				trace.Error = err.Error()
+				output = fmt.Sprintf("Error: %v", err)
+			} else {
+				trace.Result = output
+			}
+
+			result.Trace = append(result.Trace, trace)
+			messages = append(messages, openai.ToolMessage(output, call.ID))
+		}
+	}
+
+	result.StopReason = "max_steps"
+	if result.TotalTokens >= budget.MaxTokens {
+		result.StopReason = "max_tokens"
+	}
+
+	// Out of budget: ask for a final answer without offering tools
+	messages = append(messages, openai.UserMessage("You have no more tool calls left. Answer the query now with the information you gathered."))
+	completion, err := g.Complete(ctx, openai.ChatCompletionNewParams{
+		Messages: messages,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.TotalTokens += completion.Usage.TotalTokens
+	result.Answer = completion.Choices[0].Message.Content
+
+	return result, nil
+}
+
+func runTool(ctx context.Context, tools map[string]Tool, name, arguments string) (string, error) {
+	tool, ok := tools[name]
+	if !ok {
+		return "", fmt.Errorf("unknown tool %q", name)
+	}
+	return tool.Run(ctx, arguments)
+}
@@ -0,0 +1,130 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const toolCallCompletion = `{
+	"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+	"choices": [{"index": 0, "finish_reason": "tool_calls", "message": {
+		"role": "assistant", "content": null,
+		"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "search_book", "arguments": "{\"query\": \"balcony\"}"}}]
+	}}],
+	"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}
+}`
+
+const answerCompletion = `{
+	"id": "2", "object": "chat.completion", "created": 0, "model": "test",
+	"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": "Romeo climbs the orchard wall."}}],
+	"usage": {"prompt_tokens": 20, "completion_tokens": 5, "total_tokens": 25}
+}`
+
+func newTestGenerator(t *testing.T, handler http.HandlerFunc) *Generator {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	originalURL, originalKey := LLMBaseURL, LLMAPIKey
+	LLMBaseURL, LLMAPIKey = server.URL, "test"
+	t.Cleanup(func() { LLMBaseURL, LLMAPIKey = originalURL, originalKey })
+
+	return NewGenerator()
+}
+
+func TestRunAgent(t *testing.T) {
+	calls := 0
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		var body struct {
+			Messages []map[string]any `json:"messages"`
+			Tools    []map[string]any `json:"tools"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if len(body.Tools) != 1 {
+			t.Errorf("Expected 1 tool to be offered, got %d", len(body.Tools))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.Write([]byte(toolCallCompletion))
+			return
+		}
+
+		// The tool result must be handed back to the LLM
+		last := body.Messages[len(body.Messages)-1]
+		if last["role"] != "tool" || last["content"] != "passage about the balcony" {
+			t.Errorf("Expected tool result as last message, got %v", last)
+		}
+		w.Write([]byte(answerCompletion))
+	})
+
+	var gotArguments string
+	tools := []Tool{{
+		Name:        "search_book",
+		Description: "Search the book",
+		Parameters:  map[string]any{"type": "object"},
+		Run: func(ctx context.Context, arguments string) (string, error) {
+			gotArguments = arguments
+			return "passage about the balcony", nil
+		},
+	}}
+
+	result, err := generator.RunAgent(context.Background(), "system", "user", tools, AgentBudget{MaxSteps: 3, MaxTokens: 1000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if result.Answer != "Romeo climbs the orchard wall." || result.StopReason != "answered" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.Steps != 2 || result.TotalTokens != 40 {
+		t.Errorf("Expected 2 steps and 40 tokens, got %d steps and %d tokens", result.Steps, result.TotalTokens)
+	}
+	if len(result.Trace) != 1 || result.Trace[0].Tool != "search_book" || gotArguments != `{"query": "balcony"}` {
+		t.Errorf("Unexpected trace: %+v", result.Trace)
+	}
+}
+
+func TestRunAgent_StepBudget(t *testing.T) {
+	calls := 0
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		var body struct {
+			Tools []map[string]any `json:"tools"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(body.Tools) > 0 {
+			w.Write([]byte(toolCallCompletion))
+			return
+		}
+		w.Write([]byte(answerCompletion))
+	})
+
+	tools := []Tool{{
+		Name: "search_book",
+		Run: func(ctx context.Context, arguments string) (string, error) {
+			return "nothing useful", nil
+		},
+	}}
+
+	result, err := generator.RunAgent(context.Background(), "system", "user", tools, AgentBudget{MaxSteps: 2, MaxTokens: 1000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if result.StopReason != "max_steps" || len(result.Trace) != 2 || calls != 3 {
+		t.Errorf("Expected 2 tool steps and a final answer, got %+v after %d calls", result, calls)
+	}
+	if result.Answer == "" {
+		t.Errorf("Expected a final answer once the budget ran out")
+	}
+}
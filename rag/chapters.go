@@ -0,0 +1,92 @@
+package rag
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chapter is a chapter detected in a book's text
+type Chapter struct {
+	Ordinal   int // 1-based
+	Title     string
+	StartRune int // Start of the heading
+	EndRune   int // Start of the next chapter or end of the text, exclusive
+}
+
+// chapterKeywords are tried in order, the first one found at least twice wins.
+// That way chapters are preferred over acts or staves if a book has both.
+var chapterKeywords = []string{"chapter", "stave", "act"}
+
+const chapterNumeral = `(?:[0-9]+|[ivxlcdm]+|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|thirteen|fourteen|fifteen|sixteen|seventeen|eighteen|nineteen|(?:twenty|thirty|forty|fifty|sixty|seventy|eighty|ninety)(?:-[a-z]+)?)`
+
+var chapterHeadingRes = func() map[string]*regexp.Regexp {
+	res := make(map[string]*regexp.Regexp, len(chapterKeywords))
+	for _, keyword := range chapterKeywords {
+		res[keyword] = regexp.MustCompile(`(?im)^[ \t]*(` + keyword + `[ \t]+` + chapterNumeral + `)\b[^\n]*$`)
+	}
+	return res
+}()
+
+// MaxHeadingLength skips lines that start like a heading but are prose
+const MaxHeadingLength = 100
+
+// DetectChapters finds chapter headings like "CHAPTER 1. Loomings.",
+// "Chapter IV" or "STAVE ONE" at the start of a line. Tables of contents are
+// skipped: if a heading appears several times, only its last occurrence is
+// used.
+func DetectChapters(text string) []Chapter {
+	type heading struct {
+		label string
+		title string
+		start int // Byte offset
+	}
+
+	var headings []heading
+	for _, keyword := range chapterKeywords {
+		matches := chapterHeadingRes[keyword].FindAllStringSubmatchIndex(text, -1)
+		if len(matches) < 2 {
+			continue
+		}
+
+		lastByLabel := make(map[string]int)
+		for _, m := range matches {
+			line := strings.TrimSpace(text[m[0]:m[1]])
+			if utf8.RuneCountInString(line) > MaxHeadingLength {
+				continue
+			}
+
+			label := strings.ToLower(strings.Join(strings.Fields(text[m[2]:m[3]]), " "))
+			h := heading{label: label, title: strings.TrimSpace(strings.Trim(line, "[]")), start: m[2]}
+			if i, ok := lastByLabel[label]; ok {
+				headings[i].label = "" // Earlier occurrence, e.g. in the table of contents
+			}
+			lastByLabel[label] = len(headings)
+			headings = append(headings, h)
+		}
+		break
+	}
+
+	var chapters []Chapter
+	lastByte, lastRune := 0, 0
+	for _, h := range headings {
+		if h.label == "" {
+			continue
+		}
+		start := lastRune + utf8.RuneCountInString(text[lastByte:h.start])
+		lastByte, lastRune = h.start, start
+		if n := len(chapters); n > 0 {
+			chapters[n-1].EndRune = start
+		}
+		chapters = append(chapters, Chapter{
+			Ordinal:   len(chapters) + 1,
+			Title:     h.title,
+			StartRune: start,
+		})
+	}
+	if n := len(chapters); n > 0 {
+		chapters[n-1].EndRune = utf8.RuneCountInString(text)
+	}
+
+	return chapters
+}
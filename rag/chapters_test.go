@@ -0,0 +1,57 @@
+package rag
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDetectChapters(t *testing.T) {
+	text := strings.Join([]string{
+		"Contents",
+		"",
+		"CHAPTER 1. Loomings.",
+		"CHAPTER 2. The Carpet-Bag.",
+		"",
+		"CHAPTER 1. Loomings.",
+		"",
+		"Call me Ishmael. This chapter talks about chapter one of my life.",
+		"",
+		"CHAPTER 2. The Carpet-Bag.",
+		"",
+		"I stuffed a shirt or two into my old carpet-bag.",
+	}, "\n")
+
+	chapters := DetectChapters(text)
+	if len(chapters) != 2 {
+		t.Fatalf("Expected 2 chapters without the table of contents, got %+v", chapters)
+	}
+
+	runes := []rune(text)
+	for i, c := range chapters {
+		if c.Ordinal != i+1 {
+			t.Errorf("Expected ordinal %d, got %d", i+1, c.Ordinal)
+		}
+		if !strings.HasPrefix(string(runes[c.StartRune:c.EndRune]), c.Title) {
+			t.Errorf("Expected chapter %d to start with its heading, got %q", c.Ordinal, string(runes[c.StartRune:c.EndRune]))
+		}
+	}
+	if chapters[0].Title != "CHAPTER 1. Loomings." || chapters[0].EndRune != chapters[1].StartRune {
+		t.Errorf("Unexpected first chapter %+v", chapters[0])
+	}
+	if chapters[1].EndRune != utf8.RuneCountInString(text) {
+		t.Errorf("Expected the last chapter to end with the text, got %d", chapters[1].EndRune)
+	}
+}
+
+func TestDetectChapters_Keywords(t *testing.T) {
+	text := "STAVE ONE\n\nMarley was dead.\n\nSTAVE TWO\n\nWhen Scrooge awoke.\n\nAct one of his life."
+	chapters := DetectChapters(text)
+	if len(chapters) != 2 || chapters[1].Title != "STAVE TWO" {
+		t.Errorf("Expected 2 staves, got %+v", chapters)
+	}
+
+	if chapters := DetectChapters("Just some text.\nChapter and verse."); len(chapters) != 0 {
+		t.Errorf("Expected no chapters, got %+v", chapters)
+	}
+}
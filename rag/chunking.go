@@ -2,54 +2,123 @@ package rag
 
 import (
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/embiem/book-rag/config"
 )
 
 // Chunks get filled with paragraphs up to this amount of chars
-const TargetChunkSize = 1000
+var TargetChunkSize = config.Default().RAG.ChunkSize
+
+// Chunk is a piece of text together with its span in the original text.
+// Byte and rune ends are exclusive, lines are 1-based and inclusive.
+type Chunk struct {
+	Text      string
+	StartByte int
+	EndByte   int
+	StartRune int
+	EndRune   int
+	StartLine int
+	EndLine   int
+}
 
 func ChunkText(text string) []string {
+	chunks := ChunkTextWithSpans(text)
+
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+
+	return texts
+}
+
+// ChunkTextWithSpans splits text like ChunkText, but also records where each
+// chunk starts and ends in the original text
+func ChunkTextWithSpans(text string) []Chunk {
 	if strings.TrimSpace(text) == "" {
-		return []string{}
+		return []Chunk{}
 	}
 
-	// Split by paragraph boundaries (assumes double newlines)
-	paragraphs := strings.Split(text, "\n\n")
+	// Split by paragraph boundaries (assumes double newlines), keeping track of
+	// where each trimmed paragraph sits in the original text
+	type paragraph struct {
+		text  string
+		start int
+		end   int
+	}
 
-	// Filter and trim paragraphs
-	var cleanParagraphs []string
-	for _, p := range paragraphs {
+	var cleanParagraphs []paragraph
+	offset := 0
+	for _, p := range strings.Split(text, "\n\n") {
 		trimmed := strings.TrimSpace(p)
 		if trimmed != "" {
-			cleanParagraphs = append(cleanParagraphs, trimmed)
+			start := offset + len(p) - len(strings.TrimLeftFunc(p, unicode.IsSpace))
+			cleanParagraphs = append(cleanParagraphs, paragraph{
+				text:  trimmed,
+				start: start,
+				end:   start + len(trimmed),
+			})
 		}
+		offset += len(p) + 2 // +2 for "\n\n"
 	}
 
 	// Accumulate paragraphs into chunks up to TargetChunkSize
-	var chunks []string
+	var chunks []Chunk
 	var currentChunk strings.Builder
+	var currentStart, currentEnd int
 
 	for _, para := range cleanParagraphs {
 		// If this is the first paragraph in the chunk, add it
 		if currentChunk.Len() == 0 {
-			currentChunk.WriteString(para)
+			currentChunk.WriteString(para.text)
+			currentStart = para.start
 		} else {
 			// Check if adding this paragraph would exceed the target size
-			potentialLength := currentChunk.Len() + 2 + len(para) // +2 for "\n\n"
+			potentialLength := currentChunk.Len() + 2 + len(para.text) // +2 for "\n\n"
 			if potentialLength <= TargetChunkSize {
 				currentChunk.WriteString("\n\n")
-				currentChunk.WriteString(para)
+				currentChunk.WriteString(para.text)
 			} else {
 				// Finalize current chunk and start a new one
-				chunks = append(chunks, currentChunk.String())
+				chunks = append(chunks, Chunk{Text: currentChunk.String(), StartByte: currentStart, EndByte: currentEnd})
 				currentChunk.Reset()
-				currentChunk.WriteString(para)
+				currentChunk.WriteString(para.text)
+				currentStart = para.start
 			}
 		}
+		currentEnd = para.end
 	}
 
 	if currentChunk.Len() > 0 {
-		chunks = append(chunks, currentChunk.String())
+		chunks = append(chunks, Chunk{Text: currentChunk.String(), StartByte: currentStart, EndByte: currentEnd})
 	}
 
+	fillRunesAndLines(text, chunks)
+
 	return chunks
 }
+
+// fillRunesAndLines derives rune offsets and line numbers from the byte spans.
+// Chunks are in text order, so a single forward pass over the text suffices.
+func fillRunesAndLines(text string, chunks []Chunk) {
+	pos, runes, lines := 0, 0, 1
+
+	advance := func(to int) {
+		runes += utf8.RuneCountInString(text[pos:to])
+		lines += strings.Count(text[pos:to], "\n")
+		pos = to
+	}
+
+	for i := range chunks {
+		advance(chunks[i].StartByte)
+		chunks[i].StartRune = runes
+		chunks[i].StartLine = lines
+
+		// Chunks are trimmed, so the last byte is never a newline
+		advance(chunks[i].EndByte)
+		chunks[i].EndRune = runes
+		chunks[i].EndLine = lines
+	}
+}
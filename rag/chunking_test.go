@@ -106,3 +106,44 @@ func TestChunkingAccumulation(t *testing.T) {
 		}
 	})
 }
+
+func TestChunkTextWithSpans(t *testing.T) {
+	t.Run("spans point into the original text", func(t *testing.T) {
+		input := "\n  Título\n\n\nFirst paragraph.\nStill first.  \n\n" + strings.Repeat("Long paragraph. ", 70)
+		chunks := ChunkTextWithSpans(input)
+
+		if len(chunks) != 2 {
+			t.Fatalf("Expected 2 chunks, got %d", len(chunks))
+		}
+
+		first := chunks[0]
+		if first.Text != "Título\n\nFirst paragraph.\nStill first." {
+			t.Errorf("Unexpected first chunk text: %q", first.Text)
+		}
+		if !strings.HasPrefix(input[first.StartByte:first.EndByte], "Título") ||
+			!strings.HasSuffix(input[first.StartByte:first.EndByte], "Still first.") {
+			t.Errorf("Byte span %d-%d does not match chunk: %q", first.StartByte, first.EndByte, input[first.StartByte:first.EndByte])
+		}
+		if first.StartRune != 3 || first.StartLine != 2 || first.EndLine != 6 {
+			t.Errorf("Unexpected rune/line span: %+v", first)
+		}
+
+		second := chunks[1]
+		if input[second.StartByte:second.EndByte] != second.Text {
+			t.Errorf("Expected second chunk to match its byte span exactly")
+		}
+		runes := []rune(input)
+		if string(runes[second.StartRune:second.EndRune]) != second.Text {
+			t.Errorf("Expected second chunk to match its rune span exactly")
+		}
+		if second.StartLine != 8 || second.EndLine != 8 {
+			t.Errorf("Expected second chunk on line 8, got %d-%d", second.StartLine, second.EndLine)
+		}
+	})
+
+	t.Run("empty text has no chunks", func(t *testing.T) {
+		if chunks := ChunkTextWithSpans("  \n\n "); len(chunks) != 0 {
+			t.Errorf("Expected no chunks, got %d", len(chunks))
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ComparePassage is a passage given to the LLM under a citation label
+type ComparePassage struct {
+	Label int
+	Text  string
+}
+
+// CompareBook is the evidence retrieved from one book
+type CompareBook struct {
+	Name     string
+	Author   string
+	Passages []ComparePassage
+}
+
+// ComparisonSection is a part of a comparative answer, e.g. the view of one
+// book or the differences
+type ComparisonSection struct {
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	Citations []int  `json:"citations"` // Labels of the cited passages
+}
+
+func (b CompareBook) title() string {
+	if b.Author != "" {
+		return fmt.Sprintf("%s (by %s)", b.Name, b.Author)
+	}
+	return b.Name
+}
+
+// CompareBooks answers a comparative question from the evidence of each
+// book. Passages are numbered across books so the answer can cite them, and
+// the answer is structured into one section per book followed by the
+// similarities, the differences and a conclusion.
+func (g *Generator) CompareBooks(ctx context.Context, question string, books []CompareBook) (string, error) {
+	var evidence, sections strings.Builder
+	for _, book := range books {
+		fmt.Fprintf(&evidence, "## %s\n\n", book.title())
+		if len(book.Passages) == 0 {
+			evidence.WriteString("No relevant passages were found in this book.\n\n")
+		}
+		for _, p := range book.Passages {
+			fmt.Fprintf(&evidence, "%s\n\n", DelimitPassage(p.Text, fmt.Sprintf(`id="%d"`, p.Label)))
+		}
+		fmt.Fprintf(&sections, "## %s\n", book.Name)
+	}
+
+	return g.GenerateText(ctx, fmt.Sprintf(`You are helping a literature class compare several books. Answer the following question:
+"%s"
+
+Here are passages from each book, each with its number as id. %s
+
+%s
+Give each book equal weight and base what you say about a book only on its passages. Cite the passages you use by their numbers in square brackets, e.g. [3] or [3, 7].
+If the passages of a book don't cover the question, say so in its section instead of guessing.
+Structure the answer in Markdown with exactly these sections:
+%s## Similarities
+## Differences
+## Conclusion`, question, UntrustedPassagesNotice, evidence.String(), sections.String()))
+}
+
+var comparisonHeadingRegex = regexp.MustCompile(`(?m)^#{1,3}\s+(.+?)\s*#*\s*$`)
+
+var citationRegex = regexp.MustCompile(`\[(\d+(?:\s*,\s*\d+)*)\]`)
+
+// ParseCitations returns the passage labels cited in text in order of first
+// appearance, ignoring labels that were never given to the LLM
+func ParseCitations(text string, validLabels []int) []int {
+	citations := []int{}
+	for _, m := range citationRegex.FindAllStringSubmatch(text, -1) {
+		for _, raw := range strings.Split(m[1], ",") {
+			label, err := strconv.Atoi(strings.TrimSpace(raw))
+			if err == nil && slices.Contains(validLabels, label) && !slices.Contains(citations, label) {
+				citations = append(citations, label)
+			}
+		}
+	}
+	return citations
+}
+
+// ParseComparison splits a comparative answer into its Markdown sections.
+// Text before the first heading becomes an untitled section.
+func ParseComparison(answer string, validLabels []int) []ComparisonSection {
+	sections := []ComparisonSection{}
+	add := func(title, text string) {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			return
+		}
+		sections = append(sections, ComparisonSection{
+			Title:     strings.Trim(title, "* "),
+			Text:      text,
+			Citations: ParseCitations(text, validLabels),
+		})
+	}
+
+	headings := comparisonHeadingRegex.FindAllStringSubmatchIndex(answer, -1)
+	if len(headings) == 0 {
+		add("", answer)
+		return sections
+	}
+
+	add("", answer[:headings[0][0]])
+	for i, h := range headings {
+		end := len(answer)
+		if i+1 < len(headings) {
+			end = headings[i+1][0]
+		}
+		add(answer[h[2]:h[3]], answer[h[1]:end])
+	}
+	return sections
+}
@@ -0,0 +1,50 @@
+package rag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCitations(t *testing.T) {
+	citations := ParseCitations("Marriage is a bargain [3] but also love [1, 3,7]. See [12] and [x].", []int{1, 3, 7})
+
+	expected := []int{3, 1, 7}
+	if !reflect.DeepEqual(citations, expected) {
+		t.Errorf("Expected %v, got %v", expected, citations)
+	}
+}
+
+func TestParseComparison(t *testing.T) {
+	answer := `Both books treat marriage seriously.
+
+## Pride and Prejudice
+Marriage is a question of money and rank [1, 2].
+
+## **Romeo and Juliet**
+Marriage defies the families [3].
+
+### Similarities ###
+Love wins in both [1][3].
+
+## Differences
+
+## Conclusion
+Austen is more hopeful.`
+
+	sections := ParseComparison(answer, []int{1, 2, 3})
+
+	expected := []ComparisonSection{
+		{Title: "", Text: "Both books treat marriage seriously.", Citations: []int{}},
+		{Title: "Pride and Prejudice", Text: "Marriage is a question of money and rank [1, 2].", Citations: []int{1, 2}},
+		{Title: "Romeo and Juliet", Text: "Marriage defies the families [3].", Citations: []int{3}},
+		{Title: "Similarities", Text: "Love wins in both [1][3].", Citations: []int{1, 3}},
+		{Title: "Conclusion", Text: "Austen is more hopeful.", Citations: []int{}},
+	}
+	if !reflect.DeepEqual(sections, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, sections)
+	}
+
+	if sections := ParseComparison("No headings [2].", []int{2}); len(sections) != 1 || sections[0].Title != "" || sections[0].Citations[0] != 2 {
+		t.Errorf("Expected a single untitled section, got %+v", sections)
+	}
+}
@@ -0,0 +1,29 @@
+package rag
+
+import (
+	"time"
+
+	"github.com/embiem/book-rag/config"
+)
+
+// Configure applies the configuration to the package's settings. Call it once
+// on startup, before anything is embedded or generated.
+func Configure(cfg config.Config) {
+	LLMBaseURL = cfg.LLM.BaseURL
+	LLMModel = cfg.LLM.Model
+	LLMAPIKey = cfg.LLM.APIKey
+
+	OllamaBaseURL = cfg.Embedding.BaseURL
+	EmbeddingModel = cfg.Embedding.Model
+	BatchSize = cfg.Embedding.BatchSize
+	HTTPTimeout = time.Duration(cfg.Embedding.Timeout)
+
+	RerankBaseURL = cfg.Rerank.BaseURL
+	RerankModel = cfg.Rerank.Model
+	RerankAPIKey = cfg.Rerank.APIKey
+
+	ContextTokens = cfg.RAG.ContextTokens
+	TargetChunkSize = cfg.RAG.ChunkSize
+	PromptTemplatesDir = cfg.RAG.PromptTemplatesDir
+	MinSimilarity = cfg.RAG.MinSimilarity
+}
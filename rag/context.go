@@ -0,0 +1,167 @@
+package rag
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultContextTokens is the default token budget for retrieved context
+const DefaultContextTokens = 8000
+
+// MinTrimTokens is the smallest budget left worth filling with a trimmed passage
+const MinTrimTokens = 100
+
+// ContextTokens overrides DefaultContextTokens
+var ContextTokens int = DefaultContextTokens
+
+// contextWindowByModel holds the context window of known generation models,
+// matched by prefix
+var contextWindowByModel = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-5", 400000},
+	{"gpt-4.1", 1000000},
+	{"gpt-4o", 128000},
+	{"o3", 200000},
+	{"o4", 200000},
+	{"llama3", 128000},
+	{"qwen", 32768},
+	{"mistral", 32768},
+	{"gemma3", 128000},
+}
+
+// DefaultContextWindow is assumed for unknown models
+const DefaultContextWindow = 8192
+
+// ContextWindow returns the context window of a generation model in tokens
+func ContextWindow(model string) int {
+	model = strings.ToLower(model)
+	for _, m := range contextWindowByModel {
+		if strings.HasPrefix(model, m.prefix) {
+			return m.tokens
+		}
+	}
+	return DefaultContextWindow
+}
+
+// ContextBudget returns the requested token budget for retrieved context, or
+// ContextTokens, capped at half the model's context window to leave room for
+// the prompt and the answer
+func ContextBudget(model string, requested int) int {
+	budget := ContextTokens
+	if requested > 0 {
+		budget = requested
+	}
+	return min(budget, ContextWindow(model)/2)
+}
+
+// charsPerToken returns how many characters a token of the model's tokenizer
+// covers on average for English prose. Open models tend to use smaller
+// vocabularies than OpenAI's.
+func charsPerToken(model string) float64 {
+	model = strings.ToLower(model)
+	if strings.HasPrefix(model, "gpt") || strings.HasPrefix(model, "o3") || strings.HasPrefix(model, "o4") {
+		return 4
+	}
+	return 3.5
+}
+
+// CountTokens estimates the number of tokens text uses for a model. It takes
+// the larger of a character and a word based estimate, so it doesn't
+// undercount text with many short words or punctuation.
+func CountTokens(model, text string) int {
+	if text == "" {
+		return 0
+	}
+
+	byChars := float64(utf8.RuneCountInString(text)) / charsPerToken(model)
+
+	words := 0
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) {
+		words += 1 + utf8.RuneCountInString(field)/10 // Long words take several tokens
+	}
+	punct := 0
+	for _, r := range text {
+		if unicode.IsPunct(r) {
+			punct++
+		}
+	}
+	byWords := float64(words) + float64(punct)
+
+	return int(math.Ceil(max(byChars, byWords)))
+}
+
+// TrimToTokens shortens text to about tokens tokens, cutting at a word boundary
+func TrimToTokens(model, text string, tokens int) string {
+	if CountTokens(model, text) <= tokens {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := min(int(float64(tokens)*charsPerToken(model)), len(runes))
+	for cut > 0 && CountTokens(model, string(runes[:cut])+" …") > tokens {
+		cut = cut * 9 / 10
+	}
+
+	trimmed := string(runes[:cut])
+	if i := strings.LastIndexFunc(trimmed, unicode.IsSpace); i > 0 {
+		trimmed = trimmed[:i]
+	}
+	return strings.TrimSpace(trimmed) + " …"
+}
+
+// PackedBlock is a block of context that was kept by PackContext
+type PackedBlock struct {
+	Index   int // Position in the input
+	Text    string
+	Tokens  int
+	Trimmed bool
+}
+
+// ContextPack is the result of fitting ranked blocks of context into a budget
+type ContextPack struct {
+	Budget     int
+	UsedTokens int
+	Included   []PackedBlock
+	Dropped    []int // Positions in the input that didn't fit
+}
+
+// PackContext fits blocks, ordered from most to least relevant, into a token
+// budget. A block that doesn't fit is trimmed to the remaining budget if
+// that's at least MinTrimTokens, otherwise it is dropped and smaller blocks
+// further down are tried. No single block may use more than half the budget,
+// so one oversized paragraph can't crowd out everything else.
+func PackContext(model string, blocks []string, budget int) ContextPack {
+	pack := ContextPack{Budget: budget}
+
+	blockLimit := budget
+	if len(blocks) > 1 {
+		blockLimit = budget / 2
+	}
+
+	for i, text := range blocks {
+		remaining := budget - pack.UsedTokens
+		tokens := CountTokens(model, text)
+
+		block := PackedBlock{Index: i, Text: text, Tokens: tokens}
+		if limit := min(remaining, blockLimit); tokens > limit {
+			if remaining < MinTrimTokens {
+				pack.Dropped = append(pack.Dropped, i)
+				continue
+			}
+			block.Text = TrimToTokens(model, text, limit)
+			block.Tokens = CountTokens(model, block.Text)
+			block.Trimmed = true
+		}
+
+		pack.Included = append(pack.Included, block)
+		pack.UsedTokens += block.Tokens
+	}
+
+	return pack
+}
@@ -0,0 +1,67 @@
+package rag
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountTokens(t *testing.T) {
+	if got := CountTokens("gpt-5-mini", ""); got != 0 {
+		t.Errorf("Expected 0 tokens for empty text, got %d", got)
+	}
+
+	// "Hello, world." is 4 tokens for OpenAI's tokenizers
+	if got := CountTokens("gpt-5-mini", "Hello, world."); got != 4 {
+		t.Errorf("Expected 4 tokens, got %d", got)
+	}
+
+	text := strings.Repeat("The whale surfaced near the ship. ", 100)
+	gpt, llama := CountTokens("gpt-5-mini", text), CountTokens("llama3.2", text)
+	if gpt < 700 || gpt > 900 {
+		t.Errorf("Expected roughly 800 tokens, got %d", gpt)
+	}
+	if llama < gpt {
+		t.Errorf("Expected at least as many tokens for llama3.2 (%d) as for gpt-5-mini (%d)", llama, gpt)
+	}
+}
+
+func TestTrimToTokens(t *testing.T) {
+	text := strings.Repeat("Call me Ishmael. ", 200)
+
+	trimmed := TrimToTokens("gpt-5-mini", text, 50)
+	if tokens := CountTokens("gpt-5-mini", trimmed); tokens > 50 || tokens < 30 {
+		t.Errorf("Expected about 50 tokens, got %d: %q", tokens, trimmed)
+	}
+	if !strings.HasSuffix(trimmed, " …") || !strings.HasPrefix(text, strings.TrimSuffix(trimmed, " …")) {
+		t.Errorf("Expected a marked prefix of the text, got %q", trimmed)
+	}
+
+	if got := TrimToTokens("gpt-5-mini", "short", 50); got != "short" {
+		t.Errorf("Expected text within budget to be unchanged, got %q", got)
+	}
+}
+
+func TestPackContext(t *testing.T) {
+	small := strings.Repeat("word ", 80) // 100 tokens
+	huge := strings.Repeat("word ", 5000)
+
+	pack := PackContext("gpt-5-mini", []string{small, huge, small, small, small, small}, 600)
+
+	if pack.UsedTokens > 600 {
+		t.Fatalf("Expected the budget to be kept, used %d tokens", pack.UsedTokens)
+	}
+
+	// The huge block is trimmed to half the budget, two more small blocks fit
+	// after it and the rest is dropped
+	if len(pack.Included) != 4 || len(pack.Dropped) != 2 || pack.Dropped[0] != 4 {
+		t.Fatalf("Unexpected pack: %d included, dropped %v", len(pack.Included), pack.Dropped)
+	}
+	if !pack.Included[1].Trimmed || pack.Included[1].Tokens > 300 {
+		t.Errorf("Expected the huge block to be trimmed to at most 300 tokens, got %+v", pack.Included[1].Tokens)
+	}
+	for i, block := range pack.Included {
+		if i != 1 && block.Trimmed {
+			t.Errorf("Expected block %d to be included as is", block.Index)
+		}
+	}
+}
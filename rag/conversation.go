@@ -0,0 +1,56 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ChatTurn is one message of a conversation
+type ChatTurn struct {
+	Role    string // user or assistant
+	Content string
+}
+
+// FormatHistory renders conversation turns as a plain text transcript
+func FormatHistory(history []ChatTurn) string {
+	var b strings.Builder
+	for _, turn := range history {
+		role := "User"
+		if turn.Role == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&b, "%s: %s\n\n", role, strings.TrimSpace(turn.Content))
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// CondenseQuery rewrites a follow-up question into a standalone question, so
+// it can be used for retrieval without the conversation history
+func CondenseQuery(ctx context.Context, history []ChatTurn, question string) (string, error) {
+	if len(history) == 0 {
+		return question, nil
+	}
+
+	prompt := fmt.Sprintf(`Given the following conversation about a book and a follow-up question, rephrase the follow-up question to be a standalone question.
+Resolve pronouns and references like "she" or "that scene" using the conversation, but don't answer the question.
+
+Conversation:
+
+%s
+
+Follow-up question: %s
+
+Output only the standalone question.`, FormatHistory(history), question)
+
+	condensed, err := GenerateText(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	condensed = strings.Trim(strings.TrimSpace(condensed), `"`)
+	if condensed == "" {
+		return question, nil
+	}
+	return condensed, nil
+}
@@ -0,0 +1,46 @@
+package rag
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFormatHistory(t *testing.T) {
+	history := []ChatTurn{
+		{Role: "user", Content: "Who is Juliet? "},
+		{Role: "assistant", Content: "A Capulet."},
+	}
+
+	expected := "User: Who is Juliet?\n\nAssistant: A Capulet."
+	if got := FormatHistory(history); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestCondenseQuery(t *testing.T) {
+	calls := 0
+	newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": "\"What did Juliet do after the ball?\""}}]
+		}`))
+	})
+
+	// Without history the question is used as is
+	condensed, err := CondenseQuery(context.Background(), nil, "Who is Juliet?")
+	if err != nil || condensed != "Who is Juliet?" || calls != 0 {
+		t.Errorf("Expected the question without an LLM call, got %q (%v) after %d calls", condensed, err, calls)
+	}
+
+	history := []ChatTurn{{Role: "user", Content: "Who is Juliet?"}, {Role: "assistant", Content: "A Capulet."}}
+	condensed, err = CondenseQuery(context.Background(), history, "What did she do after the ball?")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if condensed != "What did Juliet do after the ball?" {
+		t.Errorf("Unexpected standalone query %q", condensed)
+	}
+}
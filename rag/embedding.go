@@ -9,8 +9,9 @@ import (
 	"log/slog"
 	"math"
 	"net/http"
-	"os"
 	"time"
+
+	"github.com/embiem/book-rag/config"
 )
 
 type OllamaPayload struct {
@@ -22,13 +23,39 @@ type OllamaResponseEmbeddings struct {
 	Embeddings [][]float32 `json:"embeddings"`
 }
 
-const (
-	EmbeddingModel string = "embeddinggemma"
-)
+// EmbeddingModel is the Ollama model passages and queries are embedded with
+var EmbeddingModel = config.Default().Embedding.Model
+
+// minSimilarityByModel holds the similarity below which passages are
+// considered irrelevant. Scores aren't comparable across embedding models,
+// so every model needs its own threshold.
+var minSimilarityByModel = map[string]float32{
+	"embeddinggemma":    0.3,
+	"nomic-embed-text":  0.4,
+	"mxbai-embed-large": 0.5,
+	"all-minilm":        0.25,
+}
+
+// MinSimilarity overrides the per-model thresholds if set
+var MinSimilarity *float32
+
+// DefaultMinSimilarity returns the default relevance threshold for an
+// embedding model: MinSimilarity if set, otherwise the model's threshold or 0
+// (no threshold) for unknown models
+func DefaultMinSimilarity(model string) float32 {
+	if MinSimilarity != nil {
+		return *MinSimilarity
+	}
+	return minSimilarityByModel[model]
+}
+
+var OllamaBaseURL string = config.Default().Embedding.BaseURL
 
-var OllamaBaseURL string = os.Getenv("OLLAMA_BASE_URL")
+// BatchSize is the number of texts embedded per request
+var BatchSize = config.Default().Embedding.BatchSize
 
-const BatchSize = 20
+// HTTPTimeout limits requests to the embedding and rerank endpoints
+var HTTPTimeout = time.Duration(config.Default().Embedding.Timeout)
 
 func callOllama(payload OllamaPayload) (*OllamaResponseEmbeddings, error) {
 	reqData, err := json.Marshal(payload)
@@ -42,7 +69,7 @@ func callOllama(payload OllamaPayload) (*OllamaResponseEmbeddings, error) {
 	}
 
 	req.Header.Add("Content-Type", "application/json")
-	httpClient := http.Client{Timeout: 30 * time.Second}
+	httpClient := http.Client{Timeout: HTTPTimeout}
 
 	res, err := httpClient.Do(req)
 	if err != nil {
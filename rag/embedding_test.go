@@ -106,3 +106,23 @@ func TestGenerateEmbedding_InvalidJSON(t *testing.T) {
 		t.Fatal("Expected an error, got nil")
 	}
 }
+
+func TestDefaultMinSimilarity(t *testing.T) {
+	if got := DefaultMinSimilarity("embeddinggemma"); got != 0.3 {
+		t.Errorf("Expected 0.3 for embeddinggemma, got %v", got)
+	}
+	if got := DefaultMinSimilarity("unknown-model"); got != 0 {
+		t.Errorf("Expected no threshold for unknown models, got %v", got)
+	}
+
+	// A configured threshold applies to every model
+	configured := float32(0.1)
+	MinSimilarity = &configured
+	defer func() { MinSimilarity = nil }()
+	if got := DefaultMinSimilarity("embeddinggemma"); got != 0.1 {
+		t.Errorf("Expected the configured threshold, got %v", got)
+	}
+	if got := DefaultMinSimilarity("unknown-model"); got != 0.1 {
+		t.Errorf("Expected the configured threshold for unknown models, got %v", got)
+	}
+}
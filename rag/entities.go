@@ -0,0 +1,536 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kinds of entities mentioned in a book
+const (
+	EntityKindCharacter    = "character"
+	EntityKindPlace        = "place"
+	EntityKindOrganization = "organization"
+	EntityKindOther        = "other"
+)
+
+// Entity extraction methods
+const (
+	EntityMethodRules = "rules" // Capitalized names, no LLM needed (default)
+	EntityMethodLLM   = "llm"   // Ask the LLM for the entities in every passage
+	EntityMethodNone  = "none"  // Skip extraction
+)
+
+// MinEntityMentions drops rule-based entities mentioned less often, which are
+// mostly capitalized words that aren't names
+const MinEntityMentions = 2
+
+// EntityConcurrency is the number of passages sent to the LLM in parallel
+const EntityConcurrency = 4
+
+func IsValidEntityKind(kind string) bool {
+	switch kind {
+	case EntityKindCharacter, EntityKindPlace, EntityKindOrganization, EntityKindOther:
+		return true
+	}
+	return false
+}
+
+func IsValidEntityMethod(method string) bool {
+	return method == EntityMethodRules || method == EntityMethodLLM || method == EntityMethodNone
+}
+
+// Entity is a character, place or organization with all names it goes by
+type Entity struct {
+	Name     string // Canonical name, usually the longest one
+	Kind     string
+	Aliases  []string    // Other names that refer to the entity, sorted
+	Passages map[int]int // Passage index to number of mentions
+}
+
+// Mentions returns the number of mentions across all passages
+func (e Entity) Mentions() int {
+	mentions := 0
+	for _, n := range e.Passages {
+		mentions += n
+	}
+	return mentions
+}
+
+// nameMentions collects the mentions of one name across passages
+type nameMentions struct {
+	name     string
+	kinds    map[string]int // Votes for the entity kind
+	passages map[int]int
+	midText  bool // Seen other than at the start of a sentence
+}
+
+func (m *nameMentions) add(passage int, kind string, midText bool) {
+	m.passages[passage]++
+	if kind != "" {
+		m.kinds[kind]++
+	}
+	m.midText = m.midText || midText
+}
+
+type mentionIndex map[string]*nameMentions
+
+func (idx mentionIndex) get(name string) *nameMentions {
+	m, ok := idx[name]
+	if !ok {
+		m = &nameMentions{name: name, kinds: make(map[string]int), passages: make(map[int]int)}
+		idx[name] = m
+	}
+	return m
+}
+
+// nameTitles are honorifics that may start a name. They mark characters and
+// keep "Mr. Bennet" and "Mrs. Bennet" apart.
+var nameTitles = map[string]string{
+	"mr": "mr", "mister": "mr", "mrs": "mrs", "miss": "miss", "ms": "ms",
+	"dr": "dr", "doctor": "dr", "lady": "lady", "lord": "lord", "sir": "sir",
+	"captain": "captain", "colonel": "colonel", "aunt": "aunt", "uncle": "uncle",
+	"king": "king", "queen": "queen", "prince": "prince", "princess": "princess",
+	"father": "father", "mother": "mother", "friar": "friar", "saint": "st", "st": "st",
+}
+
+// nicknames maps common short forms to the first names they stand for
+var nicknames = map[string]string{
+	"lizzy": "elizabeth", "lizzie": "elizabeth", "eliza": "elizabeth", "beth": "elizabeth",
+	"kitty": "catherine", "kate": "catherine", "katie": "catherine",
+	"jack": "john", "johnny": "john", "bill": "william", "will": "william",
+	"bob": "robert", "rob": "robert", "dick": "richard", "tom": "thomas",
+	"ned": "edward", "ted": "edward", "jim": "james", "jem": "james",
+	"meg": "margaret", "maggie": "margaret", "peggy": "margaret", "polly": "mary",
+	"sally": "sarah", "nan": "anne", "annie": "anne", "harry": "henry",
+	"fanny": "frances", "nell": "eleanor", "becky": "rebecca", "charley": "charles",
+	"charlie": "charles", "fred": "frederick", "teddy": "theodore",
+}
+
+// entityStopwords are capitalized words that aren't names, mostly because
+// they start a sentence
+var entityStopwords = func() map[string]bool {
+	words := strings.Fields(`a about after again all also although an and another any are as at
+		be because been before both but by can could did do does each even every for from had
+		has have he her here hers him his how however i if in indeed into is it its just let
+		many may me might more most much must my neither never no nor not now o of oh on once
+		one only or other our perhaps she should since so some still such than that the their
+		them then there these they this those though thus till to too under unless until upon
+		us very was we well were what whatever when where whether which while who whom whose
+		why will with without would yes yet you your ah alas chapter book part volume stave act
+		scene enter exit exeunt dear good poor old young god heaven illustration ladyship
+		lordship majesty highness honour madam aye ay nay thou thee thy ye tis twas shall
+		monday tuesday wednesday thursday friday saturday sunday january february march april
+		june july august september october november december christmas`)
+	stopwords := make(map[string]bool, len(words))
+	for _, w := range words {
+		stopwords[w] = true
+	}
+	return stopwords
+}()
+
+var (
+	placeSuffixes        = []string{"street", "hall", "park", "house", "island", "river", "square", "road", "lane", "court", "castle", "abbey", "town", "city", "county", "sea", "ocean", "lake", "mountain", "hill", "bay", "cape", "inn", "place"}
+	organizationSuffixes = []string{"company", "society", "regiment", "church", "bank", "college", "university", "school", "club", "army", "navy", "parliament", "court"}
+	placePrepositions    = []string{"in", "at", "from", "near", "into", "through", "towards"}
+	speechVerbs          = []string{"said", "replied", "cried", "asked", "answered", "thought", "exclaimed", "whispered", "returned", "continued"}
+)
+
+// nameRegex matches runs of capitalized words, optionally starting with an
+// abbreviated title and joined by "of" or "de" as in "Duke of Wellington"
+var nameRegex = regexp.MustCompile(`(?:(?:Mr|Mrs|Ms|Dr|St)\.?[ \t]+)?\p{Lu}\p{Ll}[\p{L}'’-]*(?:(?:[ \t]+|[ \t]*\n[ \t]*)(?:(?:of|de|van|von|du|le|la)[ \t]+)?\p{Lu}\p{Ll}[\p{L}'’-]*)*`)
+
+var wordBeforeRegex = regexp.MustCompile(`([\p{L}]+)[ \t\n]*$`)
+var wordAfterRegex = regexp.MustCompile(`^[,]?[ \t\n]*([\p{L}]+)`)
+
+// ExtractEntitiesRules finds names as runs of capitalized words, without an
+// LLM. Single words only seen at the start of sentences and entities mentioned less
+// than MinEntityMentions times are dropped. The kind is guessed from titles,
+// speech verbs, prepositions and suffixes like "Street" or "Company".
+func ExtractEntitiesRules(passages []string) []Entity {
+	idx := make(mentionIndex)
+
+	for i, text := range passages {
+		for _, loc := range nameRegex.FindAllStringIndex(text, -1) {
+			words := strings.Fields(cleanEntityName(text[loc[0]:loc[1]]))
+			sentenceStart := isSentenceStart(text[:loc[0]])
+
+			// Leading stopwords are words like "When" or "The" starting a sentence
+			for len(words) > 0 && isEntityStopword(words[0]) {
+				words = words[1:]
+				sentenceStart = false
+			}
+			for len(words) > 0 && isEntityStopword(words[len(words)-1]) {
+				words = words[:len(words)-1]
+			}
+			if len(words) == 0 {
+				continue
+			}
+
+			name := strings.Join(words, " ")
+			title, key := splitTitle(name)
+			if _, ok := nameTitles[strings.ToLower(strings.TrimSuffix(key[len(key)-1], "."))]; ok {
+				continue // Just a title, e.g. "Sir"
+			}
+
+			kind := guessEntityKind(title, key, text[max(0, loc[0]-40):loc[0]], text[loc[1]:min(len(text), loc[1]+40)])
+			// Sentence starters are single words, "Elizabeth Bennet" is a name anywhere
+			idx.get(name).add(i, kind, !sentenceStart || len(words) > 1)
+		}
+	}
+
+	var names []*nameMentions
+	for _, m := range idx {
+		if m.midText {
+			names = append(names, m)
+		}
+	}
+
+	var entities []Entity
+	for _, e := range buildEntities(names, resolveAliasesRules(names)) {
+		if e.Mentions() >= MinEntityMentions {
+			entities = append(entities, e)
+		}
+	}
+	return entities
+}
+
+var contractionRegex = regexp.MustCompile(`['’](?:s|ll|d|re|ve|m|t)$`)
+
+// isEntityStopword also catches contractions like "It's"
+func isEntityStopword(word string) bool {
+	word = contractionRegex.ReplaceAllString(strings.ToLower(strings.TrimSuffix(word, ".")), "")
+	return entityStopwords[word]
+}
+
+func isSentenceStart(before string) bool {
+	before = strings.TrimRight(before, " \t")
+	if before == "" || strings.HasSuffix(before, "\n\n") {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(before)
+	return strings.ContainsRune(".!?\"“‘'(—:\n", r)
+}
+
+// cleanEntityName drops possessives and collapses whitespace
+func cleanEntityName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	for _, suffix := range []string{"'s", "’s"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return strings.TrimRight(name, "'’-")
+}
+
+// splitTitle splits a name into its normalized title, if any, and the words
+// that identify the entity
+func splitTitle(name string) (string, []string) {
+	words := strings.Fields(name)
+	if len(words) > 1 {
+		if title, ok := nameTitles[strings.ToLower(strings.TrimSuffix(words[0], "."))]; ok {
+			return title, words[1:]
+		}
+	}
+	return "", words
+}
+
+func guessEntityKind(title string, key []string, before, after string) string {
+	if title != "" {
+		return EntityKindCharacter
+	}
+
+	last := strings.ToLower(key[len(key)-1])
+	if slices.Contains(organizationSuffixes, last) && len(key) > 1 {
+		return EntityKindOrganization
+	}
+	if slices.Contains(placeSuffixes, last) && len(key) > 1 {
+		return EntityKindPlace
+	}
+
+	if m := wordAfterRegex.FindStringSubmatch(after); m != nil && slices.Contains(speechVerbs, strings.ToLower(m[1])) {
+		return EntityKindCharacter
+	}
+	if m := wordBeforeRegex.FindStringSubmatch(before); m != nil {
+		word := strings.ToLower(m[1])
+		if slices.Contains(speechVerbs, word) {
+			return EntityKindCharacter
+		}
+		if slices.Contains(placePrepositions, word) {
+			return EntityKindPlace
+		}
+	}
+	return ""
+}
+
+// nameKey returns the title and the lowercased identifying words of a name.
+// full has nicknames replaced by the names they stand for.
+func nameKey(name string) (title string, key, full []string) {
+	title, words := splitTitle(name)
+	key = make([]string, len(words))
+	full = make([]string, len(words))
+	for i, word := range words {
+		key[i] = strings.ToLower(word)
+		full[i] = key[i]
+		if name, ok := nicknames[key[i]]; ok {
+			full[i] = name
+		}
+	}
+	return title, key, full
+}
+
+// resolveAliasesRules maps every name to the canonical name of its entity.
+// A name is an alias of a longer name if all its words are part of it, e.g.
+// "Elizabeth" and "Lizzy" of "Elizabeth Bennet", unless it could belong to
+// several entities like "Bennet". Names with different titles are never
+// merged, and a title with just a surname like "Mr. Bennet" only merges with
+// names that have the same title. "Darcy" stays on its own if there are both
+// "Mr. Darcy" and "Miss Darcy".
+func resolveAliasesRules(names []*nameMentions) map[string]string {
+	type candidate struct {
+		name  string
+		title string
+		key   []string
+		full  []string
+	}
+
+	candidates := make([]candidate, len(names))
+	for i, m := range names {
+		title, key, full := nameKey(m.name)
+		candidates[i] = candidate{name: m.name, title: title, key: key, full: full}
+	}
+
+	// Longer names first, so shorter ones can join the entity they belong to.
+	// Full names are preferred without title ("Elizabeth Bennet" over "Miss
+	// Elizabeth Bennet"), single names with title ("Captain Ahab" over "Ahab").
+	titledFirst := func(c candidate) bool { return (c.title != "") == (len(c.key) == 1) }
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if len(a.key) != len(b.key) {
+			return len(a.key) > len(b.key)
+		}
+		if titledFirst(a) != titledFirst(b) {
+			return titledFirst(a)
+		}
+		return a.name < b.name
+	})
+
+	canonical := make(map[string]string, len(candidates))
+	for i, c := range candidates {
+		canonical[c.name] = c.name
+
+		var roots []string
+		for _, other := range candidates[:i] {
+			if c.title != "" && other.title != c.title && (other.title != "" || len(c.key) == 1) {
+				continue
+			}
+			if len(other.key) == len(c.key) && (!titledFirst(other) || titledFirst(c)) {
+				continue
+			}
+			// Nicknames only resolve to untitled names, "Kitty" isn't "Lady Catherine"
+			key := c.key
+			if other.title == "" {
+				key = c.full
+			}
+			if !containsAll(other.key, key) {
+				continue
+			}
+			if root := canonical[other.name]; !slices.Contains(roots, root) {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) == 1 {
+			canonical[c.name] = roots[0]
+		}
+	}
+
+	return canonical
+}
+
+func containsAll(words, subset []string) bool {
+	for _, w := range subset {
+		if !slices.Contains(words, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildEntities merges the mentions of all names of an entity
+func buildEntities(names []*nameMentions, canonical map[string]string) []Entity {
+	byName := make(map[string]*Entity)
+	kindVotes := make(map[string]map[string]int)
+
+	for _, m := range names {
+		root := canonical[m.name]
+		if root == "" {
+			root = m.name
+		}
+
+		e, ok := byName[root]
+		if !ok {
+			e = &Entity{Name: root, Aliases: []string{}, Passages: make(map[int]int)}
+			byName[root] = e
+			kindVotes[root] = make(map[string]int)
+		}
+		if m.name != root {
+			e.Aliases = append(e.Aliases, m.name)
+		}
+		for passage, n := range m.passages {
+			e.Passages[passage] += n
+		}
+		for kind, n := range m.kinds {
+			kindVotes[root][kind] += n
+		}
+	}
+
+	entities := make([]Entity, 0, len(byName))
+	for root, e := range byName {
+		e.Kind = EntityKindOther
+		best := 0
+		for _, kind := range []string{EntityKindCharacter, EntityKindPlace, EntityKindOrganization, EntityKindOther} {
+			if kindVotes[root][kind] > best {
+				e.Kind, best = kind, kindVotes[root][kind]
+			}
+		}
+		sort.Strings(e.Aliases)
+		entities = append(entities, *e)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		if mi, mj := entities[i].Mentions(), entities[j].Mentions(); mi != mj {
+			return mi > mj
+		}
+		return entities[i].Name < entities[j].Name
+	})
+	return entities
+}
+
+var entityLineRegex = regexp.MustCompile(`(?i)^(character|place|organization|other)\s*:\s*(.+)$`)
+
+// ExtractEntitiesLLM asks the LLM for the characters, places and
+// organizations in every passage, then lets it group the names that refer to
+// the same entity
+func (g *Generator) ExtractEntitiesLLM(ctx context.Context, passages []string) ([]Entity, error) {
+	found := make([][][2]string, len(passages)) // Kind and name per passage
+	errs := make([]error, len(passages))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, EntityConcurrency)
+	for i, text := range passages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			found[i], errs[i] = g.passageEntities(ctx, text)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idx := make(mentionIndex)
+	for i, entities := range found {
+		for _, e := range entities {
+			// Count every occurrence, the LLM lists each name once per passage
+			n := max(1, strings.Count(passages[i], e[1]))
+			m := idx.get(e[1])
+			for range n {
+				m.add(i, e[0], true)
+			}
+		}
+	}
+
+	names := make([]*nameMentions, 0, len(idx))
+	for _, m := range idx {
+		names = append(names, m)
+	}
+	if len(names) == 0 {
+		return []Entity{}, nil
+	}
+
+	canonical, err := g.resolveAliasesLLM(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	return buildEntities(names, canonical), nil
+}
+
+func (g *Generator) passageEntities(ctx context.Context, text string) ([][2]string, error) {
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`List the named characters, places and organizations mentioned in the following passage of a book.
+Write each one on its own line as "kind: name", where kind is one of character, place, organization or other.
+Use the name exactly as written in the passage. Don't list pronouns or unnamed people like "the captain".
+If there are none, output nothing.
+%s
+
+%s`, UntrustedPassagesNotice, DelimitPassage(text)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entities [][2]string
+	for _, line := range parseQueryList(response) {
+		m := entityLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		name := cleanEntityName(strings.Trim(m[2], `"`))
+		if name != "" && strings.IndexFunc(name, unicode.IsUpper) >= 0 {
+			entities = append(entities, [2]string{strings.ToLower(m[1]), name})
+		}
+	}
+	return entities, nil
+}
+
+// resolveAliasesLLM asks the LLM which names refer to the same entity, e.g.
+// "Lizzy" and "Elizabeth Bennet". Names the LLM leaves out fall back to the
+// rule-based resolution.
+func (g *Generator) resolveAliasesLLM(ctx context.Context, names []*nameMentions) (map[string]string, error) {
+	canonical := resolveAliasesRules(names)
+
+	list := make([]string, len(names))
+	for i, m := range names {
+		list[i] = m.name
+	}
+	sort.Strings(list)
+
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`The following names were found in a book. Group the names that refer to the same character, place or organization, e.g. a nickname and the full name.
+Write one group per line as "canonical name: alias; alias", using the most complete name as the canonical name. Only use names from the list and leave out names without aliases.
+
+%s`, strings.Join(list, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range parseQueryList(response) {
+		root, aliases, ok := strings.Cut(line, ":")
+		root = strings.TrimSpace(root)
+		if !ok || !slices.Contains(list, root) {
+			continue
+		}
+		canonical[root] = root
+		for _, alias := range strings.Split(aliases, ";") {
+			if alias = strings.TrimSpace(alias); slices.Contains(list, alias) {
+				canonical[alias] = root
+			}
+		}
+	}
+
+	// Names pointing to a name that is itself an alias move to its root
+	for name, root := range canonical {
+		if next := canonical[root]; next != root {
+			canonical[name] = next
+		}
+	}
+	return canonical, nil
+}
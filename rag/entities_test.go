@@ -0,0 +1,123 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func findEntity(entities []Entity, name string) *Entity {
+	for i := range entities {
+		if entities[i].Name == name {
+			return &entities[i]
+		}
+	}
+	return nil
+}
+
+func TestExtractEntitiesRules(t *testing.T) {
+	passages := []string{
+		`It is a truth universally acknowledged. Elizabeth Bennet walked to Meryton with her sister. "Oh, Lizzy," said Jane, "Mr. Darcy is here."`,
+		`When Elizabeth saw Mr. Darcy at Netherfield, she laughed. Mrs. Bennet was in Meryton.`,
+		`"Lizzy!" cried Mrs. Bennet. Elizabeth went back to Netherfield. Then Jane wrote a letter.`,
+	}
+
+	entities := ExtractEntitiesRules(passages)
+
+	elizabeth := findEntity(entities, "Elizabeth Bennet")
+	if elizabeth == nil {
+		t.Fatalf("Expected Elizabeth Bennet to be extracted, got %+v", entities)
+	}
+	if !reflect.DeepEqual(elizabeth.Aliases, []string{"Elizabeth", "Lizzy"}) {
+		t.Errorf("Expected Elizabeth and Lizzy as aliases, got %v", elizabeth.Aliases)
+	}
+	if elizabeth.Mentions() != 5 || len(elizabeth.Passages) != 3 {
+		t.Errorf("Expected 5 mentions in 3 passages, got %d in %d", elizabeth.Mentions(), len(elizabeth.Passages))
+	}
+
+	if bennet := findEntity(entities, "Mrs. Bennet"); bennet == nil || bennet.Kind != EntityKindCharacter {
+		t.Errorf("Expected Mrs. Bennet to be a separate character, got %+v", bennet)
+	}
+	if meryton := findEntity(entities, "Meryton"); meryton == nil || meryton.Kind != EntityKindPlace {
+		t.Errorf("Expected Meryton to be a place, got %+v", meryton)
+	}
+	for _, name := range []string{"It", "When", "Then"} {
+		if findEntity(entities, name) != nil {
+			t.Errorf("Expected sentence starter %q not to be extracted", name)
+		}
+	}
+}
+
+func TestResolveAliasesRules(t *testing.T) {
+	var names []*nameMentions
+	for _, name := range []string{"Mr. Darcy", "Miss Darcy", "Darcy", "Captain Ahab", "Ahab", "Lady Catherine", "Kitty", "Jane Bennet", "Mr. Bennet"} {
+		names = append(names, &nameMentions{name: name})
+	}
+
+	canonical := resolveAliasesRules(names)
+
+	expected := map[string]string{
+		"Mr. Darcy":      "Mr. Darcy",
+		"Miss Darcy":     "Miss Darcy",
+		"Darcy":          "Darcy", // Could be either
+		"Captain Ahab":   "Captain Ahab",
+		"Ahab":           "Captain Ahab",
+		"Lady Catherine": "Lady Catherine",
+		"Kitty":          "Kitty", // Nicknames don't resolve to titled names
+		"Jane Bennet":    "Jane Bennet",
+		"Mr. Bennet":     "Mr. Bennet",
+	}
+	if !reflect.DeepEqual(canonical, expected) {
+		t.Errorf("Expected %v, got %v", expected, canonical)
+	}
+}
+
+func TestExtractEntitiesLLM(t *testing.T) {
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		prompt := body.Messages[len(body.Messages)-1].Content
+
+		var response string
+		switch {
+		case strings.Contains(prompt, "Group the names"):
+			response = "Elizabeth Bennet: Lizzy; Eliza\nMr. Darcy: Darcy"
+		case strings.Contains(prompt, "Pemberley"):
+			response = "character: Lizzy\nPlace: Pemberley\ncharacter: Darcy"
+		default:
+			response = "- character: Elizabeth Bennet\ncharacter: Mr. Darcy\nnonsense line"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		completion, _ := json.Marshal(response)
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, completion)
+	})
+
+	entities, err := generator.ExtractEntitiesLLM(context.Background(), []string{
+		"Elizabeth Bennet danced with Mr. Darcy.",
+		"Lizzy visited Pemberley, the house of Darcy.",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(entities) != 3 {
+		t.Fatalf("Expected 3 entities, got %+v", entities)
+	}
+	elizabeth := findEntity(entities, "Elizabeth Bennet")
+	if elizabeth == nil || !reflect.DeepEqual(elizabeth.Aliases, []string{"Lizzy"}) || len(elizabeth.Passages) != 2 {
+		t.Errorf("Expected Elizabeth Bennet in both passages with alias Lizzy, got %+v", elizabeth)
+	}
+	if pemberley := findEntity(entities, "Pemberley"); pemberley == nil || pemberley.Kind != EntityKindPlace {
+		t.Errorf("Expected Pemberley to be a place, got %+v", pemberley)
+	}
+}
@@ -0,0 +1,207 @@
+package rag
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Graph export formats
+const (
+	GraphFormatJSON    = "json"
+	GraphFormatGraphML = "graphml"
+	GraphFormatDOT     = "dot"
+)
+
+func IsValidGraphFormat(format string) bool {
+	return format == GraphFormatJSON || format == GraphFormatGraphML || format == GraphFormatDOT
+}
+
+// GraphNode is an entity in a co-occurrence graph
+type GraphNode struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Mentions int32  `json:"mentions"`
+}
+
+// GraphEdge connects two entities mentioned in the same passages
+type GraphEdge struct {
+	Source     int64   `json:"source"`
+	Target     int64   `json:"target"`
+	Weight     int32   `json:"weight"`          // Number of passages mentioning both
+	Label      string  `json:"label,omitempty"` // Relationship type, if labeled by the LLM
+	PassageIDs []int64 `json:"passage_ids"`
+}
+
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// RelationshipSample is a pair of entities and passages mentioning both
+type RelationshipSample struct {
+	Source   string
+	Target   string
+	Passages []string
+}
+
+// LabelRelationships asks the LLM for the type of relationship between each
+// pair of entities, e.g. "sisters" or "rivals", based on passages mentioning
+// both. The labels are returned in the order of the samples.
+func (g *Generator) LabelRelationships(ctx context.Context, samples []RelationshipSample) ([]string, error) {
+	labels := make([]string, len(samples))
+	errs := make([]error, len(samples))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, EntityConcurrency)
+	for i, sample := range samples {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			labels[i], errs[i] = g.labelRelationship(ctx, sample)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+func (g *Generator) labelRelationship(ctx context.Context, sample RelationshipSample) (string, error) {
+	var passages strings.Builder
+	for _, p := range sample.Passages {
+		fmt.Fprintf(&passages, "%s\n\n", DelimitPassage(p))
+	}
+
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`What is the relationship between %s and %s, based on the following passages of a book?
+Answer with a short label of one to three words, like "sisters", "married", "rivals", "friends", "employer and servant" or "acquaintances".
+%s
+
+%s
+
+Output only the label.`, sample.Source, sample.Target, UntrustedPassagesNotice, strings.TrimSpace(passages.String())))
+	if err != nil {
+		return "", err
+	}
+
+	label := strings.ToLower(strings.Trim(strings.TrimSpace(response), `".`))
+	if i := strings.IndexByte(label, '\n'); i >= 0 {
+		label = strings.TrimSpace(label[:i])
+	}
+	return label, nil
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLDocument struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+func graphNodeID(id int64) string {
+	return fmt.Sprintf("n%d", id)
+}
+
+// FormatGraphML renders the graph as GraphML, e.g. for Gephi or yEd
+func FormatGraphML(graph Graph) (string, error) {
+	doc := graphMLDocument{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "name", For: "node", AttrName: "name", AttrType: "string"},
+			{ID: "kind", For: "node", AttrName: "kind", AttrType: "string"},
+			{ID: "mentions", For: "node", AttrName: "mentions", AttrType: "int"},
+			{ID: "weight", For: "edge", AttrName: "weight", AttrType: "int"},
+			{ID: "label", For: "edge", AttrName: "label", AttrType: "string"},
+		},
+	}
+	doc.Graph.EdgeDefault = "undirected"
+
+	for _, n := range graph.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID: graphNodeID(n.ID),
+			Data: []graphMLData{
+				{Key: "name", Value: n.Name},
+				{Key: "kind", Value: n.Kind},
+				{Key: "mentions", Value: fmt.Sprint(n.Mentions)},
+			},
+		})
+	}
+	for _, e := range graph.Edges {
+		data := []graphMLData{{Key: "weight", Value: fmt.Sprint(e.Weight)}}
+		if e.Label != "" {
+			data = append(data, graphMLData{Key: "label", Value: e.Label})
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: graphNodeID(e.Source),
+			Target: graphNodeID(e.Target),
+			Data:   data,
+		})
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+// dotQuote quotes a string for use as a DOT ID
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", ` `).Replace(s) + `"`
+}
+
+// FormatDOT renders the graph in Graphviz DOT. Edges are drawn thicker the
+// more passages mention both entities.
+func FormatDOT(name string, graph Graph) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "graph %s {\n", dotQuote(name))
+	for _, n := range graph.Nodes {
+		fmt.Fprintf(&b, "  %s [label=%s, kind=%s, mentions=%d];\n", graphNodeID(n.ID), dotQuote(n.Name), dotQuote(n.Kind), n.Mentions)
+	}
+	for _, e := range graph.Edges {
+		fmt.Fprintf(&b, "  %s -- %s [weight=%d, penwidth=%d", graphNodeID(e.Source), graphNodeID(e.Target), e.Weight, min(1+e.Weight/5, 10))
+		if e.Label != "" {
+			fmt.Fprintf(&b, ", label=%s", dotQuote(e.Label))
+		}
+		b.WriteString("];\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testGraph = Graph{
+	Nodes: []GraphNode{
+		{ID: 1, Name: "Elizabeth Bennet", Kind: EntityKindCharacter, Mentions: 700},
+		{ID: 2, Name: `Mr. "Fitzwilliam" Darcy`, Kind: EntityKindCharacter, Mentions: 400},
+	},
+	Edges: []GraphEdge{
+		{Source: 1, Target: 2, Weight: 12, Label: "married", PassageIDs: []int64{10, 11}},
+	},
+}
+
+func TestFormatDOT(t *testing.T) {
+	dot := FormatDOT("Pride and Prejudice", testGraph)
+
+	expected := `graph "Pride and Prejudice" {
+  n1 [label="Elizabeth Bennet", kind="character", mentions=700];
+  n2 [label="Mr. \"Fitzwilliam\" Darcy", kind="character", mentions=400];
+  n1 -- n2 [weight=12, penwidth=3, label="married"];
+}
+`
+	if dot != expected {
+		t.Errorf("Expected %s, got %s", expected, dot)
+	}
+}
+
+func TestFormatGraphML(t *testing.T) {
+	out, err := FormatGraphML(testGraph)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var doc graphMLDocument
+	if err := xml.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("Expected valid XML, got %v", err)
+	}
+	if len(doc.Graph.Nodes) != 2 || doc.Graph.Nodes[1].Data[0].Value != `Mr. "Fitzwilliam" Darcy` {
+		t.Errorf("Expected 2 nodes with names, got %+v", doc.Graph.Nodes)
+	}
+	edge := doc.Graph.Edges[0]
+	expected := []graphMLData{{Key: "weight", Value: "12"}, {Key: "label", Value: "married"}}
+	if edge.Source != "n1" || edge.Target != "n2" || !reflect.DeepEqual(edge.Data, expected) {
+		t.Errorf("Expected a weighted, labeled edge from n1 to n2, got %+v", edge)
+	}
+}
+
+func TestLabelRelationships(t *testing.T) {
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		prompt := body.Messages[len(body.Messages)-1].Content
+
+		response := `"Rivals."`
+		if strings.Contains(prompt, "between Jane Bennet and Elizabeth Bennet") {
+			response = "Sisters\nThey are both daughters of Mr. Bennet."
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		completion, _ := json.Marshal(response)
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, completion)
+	})
+
+	labels, err := generator.LabelRelationships(context.Background(), []RelationshipSample{
+		{Source: "Jane Bennet", Target: "Elizabeth Bennet", Passages: []string{"Jane and Elizabeth talked."}},
+		{Source: "Elizabeth Bennet", Target: "Caroline Bingley", Passages: []string{"Miss Bingley sneered."}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []string{"sisters", "rivals"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected %v, got %v", expected, labels)
+	}
+}
@@ -0,0 +1,228 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Verification modes of an answer
+const (
+	VerifyFlag   = "flag"   // Mark unsupported claims in the answer
+	VerifyRemove = "remove" // Remove unsupported claims from the answer
+)
+
+func IsValidVerifyMode(mode string) bool {
+	return mode == VerifyFlag || mode == VerifyRemove
+}
+
+// Support labels of a claim
+const (
+	ClaimSupported   = "supported"
+	ClaimPartial     = "partially_supported"
+	ClaimUnsupported = "unsupported"
+	ClaimNoClaim     = "no_claim"   // Nothing to verify, e.g. a transition
+	ClaimUnverified  = "unverified" // The LLM didn't label it
+)
+
+// UnsupportedMarker is appended to unsupported claims in flag mode
+const UnsupportedMarker = " [unsupported]"
+
+// Claim is a sentence of an answer and how well the passages support it
+type Claim struct {
+	Text        string  `json:"text"`
+	Start       int     `json:"start"` // Byte offsets in the answer
+	End         int     `json:"end"`
+	Label       string  `json:"label"`
+	PassageIDs  []int64 `json:"passage_ids"` // Supporting passages
+	Explanation string  `json:"explanation,omitempty"`
+}
+
+// GroundingPassage is a block of context the answer was generated from,
+// either a passage or a window of neighboring passages
+type GroundingPassage struct {
+	IDs  []int64 // For windows, the hits the window was built around
+	Text string
+}
+
+// sentenceAbbreviations don't end a sentence
+var sentenceAbbreviations = []string{"mr", "mrs", "ms", "dr", "st", "mt", "capt", "col", "gen", "lt", "rev", "prof", "jr", "sr", "vs", "etc", "e.g", "i.e", "ch", "vol", "no"}
+
+var sentenceEndRegex = regexp.MustCompile(`[.!?]+["'”’)\]]*\s+`)
+
+// SplitClaims splits an answer into sentences, each of which is checked as a
+// claim. Lines are split separately, so list items and headings stay apart,
+// and list markers aren't part of a claim.
+func SplitClaims(answer string) []Claim {
+	var claims []Claim
+	add := func(start, end int) {
+		text := answer[start:end]
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		start += len(text) - len(trimmed)
+		text = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		if strings.IndexFunc(text, unicode.IsLetter) < 0 {
+			return
+		}
+		claims = append(claims, Claim{Text: text, Start: start, End: start + len(text)})
+	}
+
+	offset := 0
+	for _, line := range strings.SplitAfter(answer, "\n") {
+		lineStart := offset
+		offset += len(line)
+
+		if m := answerLineMarkerRegex.FindStringIndex(line); m != nil {
+			lineStart += m[1]
+			line = line[m[1]:]
+		}
+
+		start := 0
+		for _, m := range sentenceEndRegex.FindAllStringIndex(line, -1) {
+			word := line[:m[0]]
+			word = strings.ToLower(word[strings.LastIndexFunc(word, unicode.IsSpace)+1:])
+			word = strings.TrimLeft(word, `"'“‘(`)
+			if slices.Contains(sentenceAbbreviations, word) || (len([]rune(word)) == 1 && unicode.IsLetter([]rune(word)[0])) {
+				continue // An abbreviation or an initial
+			}
+			add(lineStart+start, lineStart+m[1])
+			start = m[1]
+		}
+		add(lineStart+start, lineStart+len(line))
+	}
+	return claims
+}
+
+// answerLineMarkerRegex matches list markers and Markdown headings
+var answerLineMarkerRegex = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)]|#{1,6})\s+`)
+
+var claimLabelRegex = regexp.MustCompile(`(?i)^\W*(\d+)\W+(supported|partially supported|partially_supported|unsupported|no claim|no_claim)\b(.*)$`)
+
+var claimPassagesRegex = regexp.MustCompile(`^\s*\[([\d,\s]*)\]`)
+
+// VerifyClaims checks every claim against the passages the answer was
+// generated from, like the faithfulness judge of the evaluation, but per
+// claim. It returns the claims with their labels and supporting passages.
+func (g *Generator) VerifyClaims(ctx context.Context, question string, claims []Claim, passages []GroundingPassage) ([]Claim, error) {
+	if len(claims) == 0 {
+		return claims, nil
+	}
+
+	var evidence, numbered strings.Builder
+	for i, p := range passages {
+		fmt.Fprintf(&evidence, "%s\n\n", DelimitPassage(p.Text, fmt.Sprintf(`id="%d"`, i+1)))
+	}
+	for i, c := range claims {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, c.Text)
+	}
+
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`An answer to the question "%s" was generated from the passages below. Check whether each sentence of the answer is grounded in the passages. A claim is only supported if it can be verified from the passages alone, not from general knowledge.
+
+Passages, each with its number as id. %s
+
+%s
+Sentences of the answer:
+%s
+For each sentence, output one line with its number, one of "supported", "partially supported", "unsupported" or "no claim" (for sentences without factual content, like a transition), the numbers of the supporting passages in brackets and a short reason, e.g.:
+1: supported [2, 3] Elizabeth refuses the proposal in passage 2.
+2: unsupported [] No passage mentions the wedding.`, question, UntrustedPassagesNotice, evidence.String(), numbered.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseClaimLabels(response, claims, passages), nil
+}
+
+// parseClaimLabels applies the labels of the LLM to the claims. Claims it
+// didn't label stay unverified.
+func parseClaimLabels(response string, claims []Claim, passages []GroundingPassage) []Claim {
+	verified := slices.Clone(claims)
+	for i := range verified {
+		verified[i].Label = ClaimUnverified
+		verified[i].PassageIDs = []int64{}
+	}
+
+	for _, line := range strings.Split(response, "\n") {
+		m := claimLabelRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 || n > len(verified) {
+			continue
+		}
+		claim := &verified[n-1]
+
+		switch strings.ReplaceAll(strings.ToLower(m[2]), " ", "_") {
+		case "supported":
+			claim.Label = ClaimSupported
+		case "partially_supported":
+			claim.Label = ClaimPartial
+		case "unsupported":
+			claim.Label = ClaimUnsupported
+		default:
+			claim.Label = ClaimNoClaim
+		}
+
+		rest := m[3]
+		if p := claimPassagesRegex.FindStringSubmatchIndex(rest); p != nil {
+			for _, raw := range strings.Split(rest[p[2]:p[3]], ",") {
+				number, err := strconv.Atoi(strings.TrimSpace(raw))
+				if err != nil || number < 1 || number > len(passages) {
+					continue
+				}
+				for _, id := range passages[number-1].IDs {
+					if !slices.Contains(claim.PassageIDs, id) {
+						claim.PassageIDs = append(claim.PassageIDs, id)
+					}
+				}
+			}
+			rest = rest[p[1]:]
+		}
+		claim.Explanation = strings.TrimSpace(strings.TrimLeft(rest, " -:–—"))
+	}
+	return verified
+}
+
+// ApplyVerification removes or flags the unsupported claims in the answer.
+// Lines left empty by removing claims are dropped.
+func ApplyVerification(answer string, claims []Claim, mode string) string {
+	var b strings.Builder
+	last := 0
+	for _, c := range claims {
+		if c.Label != ClaimUnsupported {
+			continue
+		}
+		switch mode {
+		case VerifyFlag:
+			b.WriteString(answer[last:c.End])
+			b.WriteString(UnsupportedMarker)
+		case VerifyRemove:
+			b.WriteString(answer[last:c.Start])
+		}
+		last = c.End
+	}
+	b.WriteString(answer[last:])
+	if mode != VerifyRemove {
+		return b.String()
+	}
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if strings.TrimSpace(line) != "" && answerLineMarkerRegex.ReplaceAllString(line, "") == "" {
+			continue // A list item whose claims were all removed
+		}
+		if strings.TrimSpace(line) == "" && len(lines) > 0 && lines[len(lines)-1] == "" {
+			continue
+		}
+		text := strings.TrimLeft(line, " \t")
+		indent := line[:len(line)-len(text)]
+		lines = append(lines, indent+strings.TrimRight(multipleSpacesRegex.ReplaceAllString(text, " "), " \t"))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+var multipleSpacesRegex = regexp.MustCompile(`[ \t]{2,}`)
@@ -0,0 +1,101 @@
+package rag
+
+import (
+	"reflect"
+	"testing"
+)
+
+const groundingAnswer = `Mr. Darcy proposes to Elizabeth at Hunsford. She refuses him!
+
+Reasons she gives:
+- He separated Jane and Mr. Bingley.
+- He treated Mr. Wickham badly. They later marry at Pemberley.`
+
+func claimTexts(claims []Claim) []string {
+	texts := make([]string, len(claims))
+	for i, c := range claims {
+		texts[i] = c.Text
+	}
+	return texts
+}
+
+func TestSplitClaims(t *testing.T) {
+	claims := SplitClaims(groundingAnswer)
+
+	expected := []string{
+		"Mr. Darcy proposes to Elizabeth at Hunsford.",
+		"She refuses him!",
+		"Reasons she gives:",
+		"He separated Jane and Mr. Bingley.",
+		"He treated Mr. Wickham badly.",
+		"They later marry at Pemberley.",
+	}
+	if got := claimTexts(claims); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	for _, c := range claims {
+		if groundingAnswer[c.Start:c.End] != c.Text {
+			t.Errorf("Expected offsets %d-%d to cover %q, got %q", c.Start, c.End, c.Text, groundingAnswer[c.Start:c.End])
+		}
+	}
+}
+
+func TestParseClaimLabels(t *testing.T) {
+	claims := SplitClaims(groundingAnswer)
+	passages := []GroundingPassage{{IDs: []int64{40}, Text: "proposal"}, {IDs: []int64{41}, Text: "letter"}}
+
+	response := `1: supported [1] Passage 1 describes the proposal.
+2. Supported [1, 1, 9]
+3: no claim []
+4 - partially supported [2] - Only Jane is mentioned.
+**6**: unsupported [] No passage mentions a wedding.`
+
+	verified := parseClaimLabels(response, claims, passages)
+
+	labels := make([]string, len(verified))
+	for i, c := range verified {
+		labels[i] = c.Label
+	}
+	expected := []string{ClaimSupported, ClaimSupported, ClaimNoClaim, ClaimPartial, ClaimUnverified, ClaimUnsupported}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, got %v", expected, labels)
+	}
+	if !reflect.DeepEqual(verified[1].PassageIDs, []int64{40}) || !reflect.DeepEqual(verified[3].PassageIDs, []int64{41}) {
+		t.Errorf("Expected passage IDs mapped from their numbers, got %v and %v", verified[1].PassageIDs, verified[3].PassageIDs)
+	}
+	if verified[3].Explanation != "Only Jane is mentioned." || verified[5].Explanation != "No passage mentions a wedding." {
+		t.Errorf("Expected explanations, got %q and %q", verified[3].Explanation, verified[5].Explanation)
+	}
+	if claims[0].Label != "" {
+		t.Error("Expected the input claims to be left unchanged")
+	}
+}
+
+func TestApplyVerification(t *testing.T) {
+	claims := SplitClaims(groundingAnswer)
+	for i := range claims {
+		claims[i].Label = ClaimSupported
+	}
+	claims[1].Label = ClaimUnsupported
+	claims[3].Label = ClaimUnsupported
+	claims[5].Label = ClaimUnsupported
+
+	flagged := ApplyVerification(groundingAnswer, claims, VerifyFlag)
+	expected := `Mr. Darcy proposes to Elizabeth at Hunsford. She refuses him! [unsupported]
+
+Reasons she gives:
+- He separated Jane and Mr. Bingley. [unsupported]
+- He treated Mr. Wickham badly. They later marry at Pemberley. [unsupported]`
+	if flagged != expected {
+		t.Errorf("Expected %q, got %q", expected, flagged)
+	}
+
+	removed := ApplyVerification(groundingAnswer, claims, VerifyRemove)
+	expected = `Mr. Darcy proposes to Elizabeth at Hunsford.
+
+Reasons she gives:
+- He treated Mr. Wickham badly.`
+	if removed != expected {
+		t.Errorf("Expected %q, got %q", expected, removed)
+	}
+}
@@ -2,24 +2,80 @@ package rag
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 
+	"github.com/embiem/book-rag/config"
 	"github.com/openai/openai-go/v3"
+	"github.com/openai/openai-go/v3/option"
 )
 
-func GenerateText(ctx context.Context, input string) (response string, err error) {
-	client := openai.NewClient() // OPENAI_API_KEY env var should be available
+// LLMBaseURL points to an OpenAI-compatible chat completions API. Leave empty
+// for OpenAI, or set it to a local backend, e.g. http://localhost:11434/v1 for Ollama.
+var LLMBaseURL string
+
+// LLMModel is the generation model, e.g. of a local backend
+var LLMModel = config.Default().LLM.Model
+
+// LLMAPIKey overrides OPENAI_API_KEY, e.g. for other hosted backends
+var LLMAPIKey string
+
+// Generator generates text with an OpenAI-compatible chat completions API
+type Generator struct {
+	client openai.Client
+	Model  string
+}
+
+// NewGenerator returns a Generator for the configured backend and model
+func NewGenerator() *Generator {
+	var opts []option.RequestOption // OPENAI_API_KEY env var is used by default
+	if LLMBaseURL != "" {
+		opts = append(opts, option.WithBaseURL(LLMBaseURL))
+	}
+	if LLMAPIKey != "" {
+		opts = append(opts, option.WithAPIKey(LLMAPIKey))
+	}
+
+	return &Generator{
+		client: openai.NewClient(opts...),
+		Model:  GenerationModel(),
+	}
+}
 
-	slog.Info("Calling OpenAI...", "prompt", input, "model", openai.ChatModelGPT5Mini)
+// GenerationModel returns the configured generation model
+func GenerationModel() string {
+	return LLMModel
+}
 
-	chatCompletion, err := client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+// Complete sends a chat completion request using the generator's model
+func (g *Generator) Complete(ctx context.Context, params openai.ChatCompletionNewParams) (*openai.ChatCompletion, error) {
+	params.Model = g.Model
+
+	completion, err := g.client.Chat.Completions.New(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(completion.Choices) == 0 {
+		return nil, errors.New("LLM returned no choices")
+	}
+
+	return completion, nil
+}
+
+func (g *Generator) GenerateText(ctx context.Context, input string) (response string, err error) {
+	slog.Info("Calling LLM...", "prompt", input, "model", g.Model)
+
+	chatCompletion, err := g.Complete(ctx, openai.ChatCompletionNewParams{
 		Messages: []openai.ChatCompletionMessageParamUnion{
 			openai.UserMessage(input),
 		},
-		Model: openai.ChatModelGPT5Mini,
 	})
 	if err != nil {
 		return "", err
 	}
 	return chatCompletion.Choices[0].Message.Content, nil
 }
+
+func GenerateText(ctx context.Context, input string) (response string, err error) {
+	return NewGenerator().GenerateText(ctx, input)
+}
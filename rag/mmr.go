@@ -0,0 +1,65 @@
+package rag
+
+import "math"
+
+// DefaultMMRLambda weighs relevance and diversity equally
+const DefaultMMRLambda = 0.5
+
+// CosineSimilarity returns the cosine similarity of two vectors, or 0 if
+// either of them has no magnitude
+func CosineSimilarity(a, b []float32) float32 {
+	var dot, normA, normB float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+// MaximalMarginalRelevance greedily selects up to k candidates, each time
+// picking the one that maximizes
+//
+//	lambda * relevance - (1 - lambda) * max similarity to already selected
+//
+// relevance holds each candidate's similarity to the query. A lambda of 1
+// ranks by relevance only, a lambda of 0 by diversity only. Returns the
+// indices of the selected candidates in selection order.
+func MaximalMarginalRelevance(relevance []float32, embeddings [][]float32, k int, lambda float32) []int {
+	k = min(k, len(relevance), len(embeddings))
+	selected := make([]int, 0, k)
+	used := make([]bool, len(relevance))
+
+	// Highest similarity of each candidate to any selected candidate
+	redundancy := make([]float32, len(relevance))
+
+	for len(selected) < k {
+		best := -1
+		var bestScore float32
+		for i := range relevance {
+			if used[i] {
+				continue
+			}
+			score := lambda*relevance[i] - (1-lambda)*redundancy[i]
+			if best == -1 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+
+		used[best] = true
+		selected = append(selected, best)
+
+		for i := range relevance {
+			if !used[i] {
+				redundancy[i] = max(redundancy[i], CosineSimilarity(embeddings[i], embeddings[best]))
+			}
+		}
+	}
+
+	return selected
+}
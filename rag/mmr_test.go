@@ -0,0 +1,59 @@
+package rag
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     []float32
+		expected float32
+	}{
+		{name: "Identical", a: []float32{1, 2, 3}, b: []float32{1, 2, 3}, expected: 1},
+		{name: "Orthogonal", a: []float32{1, 0}, b: []float32{0, 1}, expected: 0},
+		{name: "Opposite", a: []float32{1, 1}, b: []float32{-1, -1}, expected: -1},
+		{name: "Zero vector", a: []float32{0, 0}, b: []float32{1, 1}, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := CosineSimilarity(tt.a, tt.b); math.Abs(float64(actual-tt.expected)) > 1e-6 {
+				t.Errorf("Expected %f, got %f", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMaximalMarginalRelevance(t *testing.T) {
+	// Candidates 0 and 1 are near-duplicates, 2 is less relevant but different
+	relevance := []float32{0.9, 0.89, 0.7}
+	embeddings := [][]float32{
+		{1, 0},
+		{0.99, 0.01},
+		{0, 1},
+	}
+
+	t.Run("lambda 1 ranks by relevance only", func(t *testing.T) {
+		selected := MaximalMarginalRelevance(relevance, embeddings, 2, 1)
+		if !reflect.DeepEqual(selected, []int{0, 1}) {
+			t.Errorf("Expected [0 1], got %v", selected)
+		}
+	})
+
+	t.Run("default lambda skips the near-duplicate", func(t *testing.T) {
+		selected := MaximalMarginalRelevance(relevance, embeddings, 2, DefaultMMRLambda)
+		if !reflect.DeepEqual(selected, []int{0, 2}) {
+			t.Errorf("Expected [0 2], got %v", selected)
+		}
+	})
+
+	t.Run("k larger than candidates", func(t *testing.T) {
+		selected := MaximalMarginalRelevance(relevance, embeddings, 10, DefaultMMRLambda)
+		if len(selected) != 3 {
+			t.Errorf("Expected all 3 candidates, got %v", selected)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package rag
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// PromptTemplatesDir optionally points to a directory of *.tmpl files. Each
+// file is a preset named after the file, e.g. student.tmpl is "student", and
+// replaces the built-in preset of the same name.
+var PromptTemplatesDir string
+
+// DefaultPromptPreset is used when neither the request nor the book select one
+const DefaultPromptPreset = "publisher"
+
+//go:embed prompts/*.tmpl
+var builtinPrompts embed.FS
+
+// PromptBook is the book metadata available to prompt templates
+type PromptBook struct {
+	Name   string
+	Author string
+	Tags   []string
+}
+
+// PromptPassage is a retrieved passage available to prompt templates
+type PromptPassage struct {
+	ID        int64
+	Ordinal   int32
+	Relevance int // Similarity in percent
+	Text      string
+}
+
+// PromptData holds the variables prompt templates can use
+type PromptData struct {
+	Query    string
+	Book     PromptBook
+	Books    []PromptBook // Set instead of Book if the passages come from several books
+	Passages []PromptPassage
+	Context  string // Passages or passage windows in <passage> tags, formatted for the LLM
+	History  []ChatTurn
+
+	// Cached summaries of the book and the chapters the passages are from,
+	// each in <passage> tags. Empty unless the request asked for them.
+	Summaries string
+
+	// How far the reader got, e.g. "the beginning of chapter 3 (CHAPTER III.)".
+	// Empty unless the request set a reading position.
+	ReadingPosition string
+}
+
+// describeBooks names the book of a prompt, e.g. `"Emma" by Jane Austen`,
+// or lists the books if the passages come from several
+func describeBooks(data PromptData) string {
+	describe := func(b PromptBook) string {
+		if b.Author != "" {
+			return fmt.Sprintf(`"%s" by %s`, b.Name, b.Author)
+		}
+		return `"` + b.Name + `"`
+	}
+
+	if len(data.Books) == 0 {
+		return describe(data.Book)
+	}
+	names := make([]string, len(data.Books))
+	for i, b := range data.Books {
+		names[i] = describe(b)
+	}
+	return "these books: " + strings.Join(names, ", ")
+}
+
+var promptFuncs = template.FuncMap{
+	"describeBooks": describeBooks,
+	"formatHistory": FormatHistory,
+	"join":          strings.Join,
+	"passageNotice": func() string { return UntrustedPassagesNotice },
+}
+
+// samplePromptData is used to check that templates only use existing variables
+var samplePromptData = PromptData{
+	Query:           "Who is the narrator?",
+	Book:            PromptBook{Name: "Moby Dick", Author: "Herman Melville", Tags: []string{"novel"}},
+	Passages:        []PromptPassage{{ID: 1, Ordinal: 0, Relevance: 80, Text: "Call me Ishmael."}},
+	Context:         "<passage>\nRelevance: 80%\nCall me Ishmael.\n</passage>",
+	History:         []ChatTurn{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}},
+	Summaries:       "<passage summary=\"CHAPTER 1. Loomings.\">\nIshmael decides to go whaling.\n</passage>",
+	ReadingPosition: "the beginning of chapter 2 (CHAPTER 2. The Carpet-Bag.)",
+}
+
+var promptTemplates map[string]*template.Template
+
+// LoadPromptTemplates parses the built-in presets and the ones in
+// PromptTemplatesDir. Every template is rendered once with sample data, so
+// mistakes surface on startup instead of on the first request.
+func LoadPromptTemplates() error {
+	templates := make(map[string]*template.Template)
+
+	if err := parsePromptTemplates(builtinPrompts, "prompts", templates); err != nil {
+		return err
+	}
+	if PromptTemplatesDir != "" {
+		if err := parsePromptTemplates(os.DirFS(PromptTemplatesDir), ".", templates); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := templates[DefaultPromptPreset]; !ok {
+		return fmt.Errorf("missing default prompt preset %q", DefaultPromptPreset)
+	}
+
+	for name, tmpl := range templates {
+		if err := tmpl.Execute(&bytes.Buffer{}, samplePromptData); err != nil {
+			return fmt.Errorf("invalid prompt template %q: %w", name, err)
+		}
+	}
+
+	promptTemplates = templates
+	return nil
+}
+
+func parsePromptTemplates(fsys fs.FS, dir string, templates map[string]*template.Template) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(path.Base(file), ".tmpl")
+		tmpl, err := template.New(name).Funcs(promptFuncs).Parse(string(content))
+		if err != nil {
+			return fmt.Errorf("invalid prompt template %q: %w", name, err)
+		}
+		templates[name] = tmpl
+	}
+
+	return nil
+}
+
+func ensurePromptTemplates() error {
+	if promptTemplates != nil {
+		return nil
+	}
+	return LoadPromptTemplates()
+}
+
+// PromptPresets returns the names of all loaded presets
+func PromptPresets() []string {
+	if err := ensurePromptTemplates(); err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(promptTemplates))
+	for name := range promptTemplates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func IsValidPromptPreset(preset string) bool {
+	return slices.Contains(PromptPresets(), preset)
+}
+
+// RenderPrompt builds the prompt for a preset, using the default preset if
+// preset is empty
+func RenderPrompt(preset string, data PromptData) (string, error) {
+	if err := ensurePromptTemplates(); err != nil {
+		return "", err
+	}
+
+	if preset == "" {
+		preset = DefaultPromptPreset
+	}
+	tmpl, ok := promptTemplates[preset]
+	if !ok {
+		return "", fmt.Errorf("unknown prompt preset %q", preset)
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,76 @@
+package rag
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useTemplatesDir(t *testing.T, dir string) {
+	originalDir, originalTemplates := PromptTemplatesDir, promptTemplates
+	PromptTemplatesDir = dir
+	t.Cleanup(func() { PromptTemplatesDir, promptTemplates = originalDir, originalTemplates })
+}
+
+func TestRenderPrompt_BuiltinPresets(t *testing.T) {
+	useTemplatesDir(t, "")
+	if err := LoadPromptTemplates(); err != nil {
+		t.Fatalf("Expected built-in templates to load, got %v", err)
+	}
+
+	for _, preset := range []string{"publisher", "student", "literary-analysis", "spoiler-free"} {
+		prompt, err := RenderPrompt(preset, samplePromptData)
+		if err != nil {
+			t.Fatalf("Failed to render %s: %v", preset, err)
+		}
+		if strings.Count(prompt, samplePromptData.Query) != 1 {
+			t.Errorf("Expected %s to contain the query once, got:\n%s", preset, prompt)
+		}
+		if !strings.Contains(prompt, "Call me Ishmael.") || !strings.Contains(prompt, "Herman Melville") {
+			t.Errorf("Expected %s to contain passages and metadata, got:\n%s", preset, prompt)
+		}
+	}
+
+	// Library answers name every book
+	libraryData := samplePromptData
+	libraryData.Book = PromptBook{}
+	libraryData.Books = []PromptBook{{Name: "Moby Dick", Author: "Herman Melville"}, {Name: "Emma"}}
+	for _, preset := range []string{"publisher", "student", "literary-analysis", "spoiler-free"} {
+		prompt, err := RenderPrompt(preset, libraryData)
+		if err != nil {
+			t.Fatalf("Failed to render %s: %v", preset, err)
+		}
+		if !strings.Contains(prompt, `these books: "Moby Dick" by Herman Melville, "Emma"`) || strings.Contains(prompt, `""`) {
+			t.Errorf("Expected %s to name the books, got:\n%s", preset, prompt)
+		}
+	}
+
+	if _, err := RenderPrompt("unknown", samplePromptData); err == nil {
+		t.Errorf("Expected an error for an unknown preset")
+	}
+}
+
+func TestLoadPromptTemplates_Dir(t *testing.T) {
+	dir := t.TempDir()
+	useTemplatesDir(t, dir)
+
+	os.WriteFile(filepath.Join(dir, "short.tmpl"), []byte("{{.Query}} ({{len .Passages}} passages)"), 0o644)
+	if err := LoadPromptTemplates(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !IsValidPromptPreset("short") || !IsValidPromptPreset(DefaultPromptPreset) {
+		t.Errorf("Expected custom and built-in presets, got %v", PromptPresets())
+	}
+
+	prompt, err := RenderPrompt("short", samplePromptData)
+	if err != nil || prompt != "Who is the narrator? (1 passages)" {
+		t.Errorf("Unexpected prompt %q (%v)", prompt, err)
+	}
+
+	// Unknown variables are caught when loading
+	os.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{.Question}}"), 0o644)
+	if err := LoadPromptTemplates(); err == nil {
+		t.Errorf("Expected an error for a template using an unknown variable")
+	}
+}
@@ -0,0 +1,158 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Query strategies decide which texts get embedded to search for a query
+const (
+	QueryStrategyRaw     = "raw"     // Embed the query as is
+	QueryStrategyRewrite = "rewrite" // Embed a retrieval-optimized rewrite of the query
+	QueryStrategyHyDE    = "hyde"    // Embed a hypothetical passage answering the query
+	QueryStrategyMulti   = "multi"   // Embed the query and several paraphrases, then fuse the results
+)
+
+// MultiQueryCount is the number of paraphrases generated by the multi strategy
+const MultiQueryCount = 3
+
+// rrfK dampens the influence of top ranks in reciprocal rank fusion
+const rrfK = 60
+
+func IsValidQueryStrategy(strategy string) bool {
+	switch strategy {
+	case QueryStrategyRaw, QueryStrategyRewrite, QueryStrategyHyDE, QueryStrategyMulti:
+		return true
+	}
+	return false
+}
+
+// RetrievalQueries returns the texts to embed for a query with the given strategy
+func RetrievalQueries(ctx context.Context, query, strategy string) ([]string, error) {
+	switch strategy {
+	case "", QueryStrategyRaw:
+		return []string{query}, nil
+	case QueryStrategyRewrite:
+		rewritten, err := RewriteQuery(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return []string{rewritten}, nil
+	case QueryStrategyHyDE:
+		passage, err := HypotheticalPassage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return []string{passage}, nil
+	case QueryStrategyMulti:
+		paraphrases, err := ParaphraseQuery(ctx, query, MultiQueryCount)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{query}, paraphrases...), nil
+	}
+	return nil, fmt.Errorf("unknown query strategy %q", strategy)
+}
+
+// RewriteQuery asks the LLM for a version of the query that is better suited
+// for semantic search over book passages
+func RewriteQuery(ctx context.Context, query string) (string, error) {
+	prompt := fmt.Sprintf(`Rewrite the following question about a book into a search query for finding the relevant passages of the book with semantic search.
+Use full names instead of pronouns, spell out what is being asked for and add likely keywords, but don't answer the question.
+
+Question: %s
+
+Output only the search query.`, query)
+
+	response, err := GenerateText(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	rewritten := strings.Trim(strings.TrimSpace(response), `"`)
+	if rewritten == "" {
+		return query, nil
+	}
+	return rewritten, nil
+}
+
+// HypotheticalPassage asks the LLM to write a passage that could answer the
+// query (HyDE). Passages are closer to other passages in embedding space than
+// questions are, even if the made up details are wrong.
+func HypotheticalPassage(ctx context.Context, query string) (string, error) {
+	prompt := fmt.Sprintf(`Write a short passage, as it could appear in the book, that answers the following question.
+Write in the style of the book's prose and keep it to one paragraph.
+
+Question: %s
+
+Output only the passage.`, query)
+
+	response, err := GenerateText(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	passage := strings.TrimSpace(response)
+	if passage == "" {
+		return query, nil
+	}
+	return passage, nil
+}
+
+// ParaphraseQuery asks the LLM for up to count differently worded versions of the query
+func ParaphraseQuery(ctx context.Context, query string, count int) ([]string, error) {
+	prompt := fmt.Sprintf(`Write %d different paraphrases of the following question about a book.
+Each paraphrase should approach the question from a different angle or use different words, so together they find more of the relevant passages.
+
+Question: %s
+
+Output one paraphrase per line and nothing else.`, count, query)
+
+	response, err := GenerateText(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	paraphrases := parseQueryList(response)
+	return paraphrases[:min(count, len(paraphrases))], nil
+}
+
+var listMarkerRegex = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s*`)
+
+// parseQueryList reads one query per line, dropping list markers, quotes and blank lines
+func parseQueryList(response string) []string {
+	queries := []string{}
+
+	for _, line := range strings.Split(response, "\n") {
+		line = listMarkerRegex.ReplaceAllString(line, "")
+		line = strings.Trim(strings.TrimSpace(line), `"`)
+		if line != "" {
+			queries = append(queries, line)
+		}
+	}
+
+	return queries
+}
+
+// ReciprocalRankFusion merges several rankings of IDs into one. Every ranking
+// contributes 1 / (k + rank) to the score of each ID it contains.
+func ReciprocalRankFusion(rankings [][]int64) []int64 {
+	scores := make(map[int64]float64)
+	var ids []int64
+
+	for _, ranking := range rankings {
+		for rank, id := range ranking {
+			if _, ok := scores[id]; !ok {
+				ids = append(ids, id)
+			}
+			scores[id] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool { return scores[ids[i]] > scores[ids[j]] })
+
+	return ids
+}
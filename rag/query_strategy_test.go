@@ -0,0 +1,52 @@
+package rag
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQueryList(t *testing.T) {
+	response := "1. Who is Mercutio?\n\n2) What role does Mercutio play\n- \"Mercutio's death\"\n* Queen Mab speech"
+	expected := []string{
+		"Who is Mercutio?",
+		"What role does Mercutio play",
+		"Mercutio's death",
+		"Queen Mab speech",
+	}
+
+	if actual := parseQueryList(response); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestReciprocalRankFusion(t *testing.T) {
+	tests := []struct {
+		name     string
+		rankings [][]int64
+		expected []int64
+	}{
+		{
+			name:     "Single ranking keeps its order",
+			rankings: [][]int64{{3, 1, 2}},
+			expected: []int64{3, 1, 2},
+		},
+		{
+			name:     "IDs found by several rankings move up",
+			rankings: [][]int64{{1, 2, 3}, {3, 4}, {5, 3}},
+			expected: []int64{3, 1, 5, 2, 4},
+		},
+		{
+			name:     "No rankings",
+			rankings: nil,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if actual := ReciprocalRankFusion(tt.rankings); !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
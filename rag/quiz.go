@@ -0,0 +1,162 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+)
+
+// Quiz question types
+const (
+	QuizTypeMultipleChoice = "multiple_choice"
+	QuizTypeShortAnswer    = "short_answer"
+	QuizTypeMixed          = "mixed" // Alternates between both
+)
+
+func IsValidQuizType(quizType string) bool {
+	return quizType == QuizTypeMultipleChoice || quizType == QuizTypeShortAnswer || quizType == QuizTypeMixed
+}
+
+// Quiz question difficulty levels
+const (
+	QuizDifficultyEasy   = "easy"
+	QuizDifficultyMedium = "medium"
+	QuizDifficultyHard   = "hard"
+)
+
+// QuizDistractors is the number of wrong options of a multiple-choice question
+const QuizDistractors = 3
+
+// QuizCard is a question in the form it is exported to flashcards
+type QuizCard struct {
+	Type       string
+	Question   string
+	Options    []string // Multiple-choice options including the answer
+	Answer     string
+	Difficulty string
+	Source     string   // Where the answer can be found, e.g. the chapter
+	Tags       []string // Without spaces
+}
+
+// Client returns the API client of the generator, e.g. to reuse the eval
+// package's question generation with the configured backend
+func (g *Generator) Client() *openai.Client {
+	return &g.client
+}
+
+// QuizDetails rates the difficulty of a question about a passage and, if
+// requested, writes plausible but wrong answers for a multiple-choice version
+func (g *Generator) QuizDetails(ctx context.Context, question, answer, passage string, distractors bool) (string, []string, error) {
+	instructions := "Rate how difficult the question is for someone who has read the book: easy (a main plot point), medium (a detail) or hard (a minor detail or an inference)."
+	format := "Difficulty: [easy, medium or hard]"
+	if distractors {
+		instructions += fmt.Sprintf("\nThen write %d wrong answers for a multiple-choice version of the question. They must be plausible to someone who hasn't read the passage, similar in length and style to the correct answer, and clearly wrong according to the passage.", QuizDistractors)
+		for range QuizDistractors {
+			format += "\nWrong answer: [a wrong answer]"
+		}
+	}
+
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`The following question and answer are about this passage of a book.
+%s
+
+%s
+
+Question: %s
+Answer: %s
+
+%s
+
+Output format:
+%s`, UntrustedPassagesNotice, DelimitPassage(passage), question, answer, instructions, format))
+	if err != nil {
+		return "", nil, err
+	}
+
+	difficulty, wrong := parseQuizDetails(response, answer)
+	return difficulty, wrong, nil
+}
+
+// parseQuizDetails reads the difficulty (medium if missing) and the wrong
+// answers, dropping duplicates and any that repeat the correct answer
+func parseQuizDetails(response, answer string) (string, []string) {
+	difficulty := QuizDifficultyMedium
+	var distractors []string
+	for _, line := range strings.Split(response, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.Trim(strings.TrimSpace(key), "*-# "))
+		value = strings.Trim(value, ` *"`)
+
+		switch key {
+		case "difficulty":
+			level := strings.ToLower(strings.Trim(value, "."))
+			if level == QuizDifficultyEasy || level == QuizDifficultyMedium || level == QuizDifficultyHard {
+				difficulty = level
+			}
+		case "wrong answer":
+			if value == "" || strings.EqualFold(value, answer) || len(distractors) == QuizDistractors ||
+				slices.ContainsFunc(distractors, func(d string) bool { return strings.EqualFold(d, value) }) {
+				continue
+			}
+			distractors = append(distractors, value)
+		}
+	}
+	return difficulty, distractors
+}
+
+// QuizOptions mixes the answer into the distractors and returns the options
+// with the index of the answer. The order depends only on the question, so
+// the same question always gets the same options.
+func QuizOptions(question, answer string, distractors []string) ([]string, int) {
+	h := fnv.New64a()
+	h.Write([]byte(question))
+	r := rand.New(rand.NewPCG(h.Sum64(), 0))
+
+	options := append([]string{answer}, distractors...)
+	r.Shuffle(len(options), func(i, j int) { options[i], options[j] = options[j], options[i] })
+	return options, slices.Index(options, answer)
+}
+
+// FormatAnkiCSV renders the cards as CSV for importing into Anki, with the
+// question (and options) on the front, the answer and its source on the
+// back and tags in the third column
+func FormatAnkiCSV(cards []QuizCard) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("#separator:comma\n#html:true\n#tags column:3\n")
+
+	w := csv.NewWriter(&buf)
+	for _, card := range cards {
+		front := html.EscapeString(card.Question)
+		back := html.EscapeString(card.Answer)
+		if len(card.Options) > 0 {
+			front += "<br><br>"
+			for i, option := range card.Options {
+				label := string(rune('A' + i))
+				front += fmt.Sprintf("%s. %s<br>", label, html.EscapeString(option))
+				if option == card.Answer {
+					back = label + ". " + back
+				}
+			}
+		}
+		if card.Source != "" {
+			back += "<br><br><i>" + html.EscapeString(card.Source) + "</i>"
+		}
+
+		tags := append([]string{card.Type, card.Difficulty}, card.Tags...)
+		if err := w.Write([]string{front, back, strings.Join(tags, " ")}); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
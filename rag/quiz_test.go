@@ -0,0 +1,117 @@
+package rag
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseQuizDetails(t *testing.T) {
+	response := `**Difficulty:** Hard.
+Wrong answer: Mr. Bingley
+Wrong answer: "Mr. Collins"
+Wrong answer: Mr. Darcy
+wrong answer: mr. bingley
+Wrong answer: Mr. Wickham
+Wrong answer: Colonel Fitzwilliam`
+
+	difficulty, distractors := parseQuizDetails(response, "Mr. Darcy")
+	if difficulty != QuizDifficultyHard {
+		t.Errorf("Expected difficulty hard, got %q", difficulty)
+	}
+	expected := []string{"Mr. Bingley", "Mr. Collins", "Mr. Wickham"}
+	if !reflect.DeepEqual(distractors, expected) {
+		t.Errorf("Expected %v, got %v", expected, distractors)
+	}
+
+	if difficulty, _ := parseQuizDetails("Difficulty: trivial", ""); difficulty != QuizDifficultyMedium {
+		t.Errorf("Expected unknown difficulties to default to medium, got %q", difficulty)
+	}
+}
+
+func TestQuizOptions(t *testing.T) {
+	distractors := []string{"Longbourn", "Pemberley", "Rosings"}
+	options, answer := QuizOptions("Where does Mr. Bingley live?", "Netherfield", distractors)
+
+	if len(options) != 4 || options[answer] != "Netherfield" {
+		t.Fatalf("Expected the answer among 4 options, got %v (answer %d)", options, answer)
+	}
+	for _, d := range distractors {
+		if !slices.Contains(options, d) {
+			t.Errorf("Expected %q among the options, got %v", d, options)
+		}
+	}
+
+	again, _ := QuizOptions("Where does Mr. Bingley live?", "Netherfield", distractors)
+	if !reflect.DeepEqual(options, again) {
+		t.Errorf("Expected the same order for the same question, got %v and %v", options, again)
+	}
+}
+
+func TestFormatAnkiCSV(t *testing.T) {
+	out, err := FormatAnkiCSV([]QuizCard{
+		{
+			Type:       QuizTypeMultipleChoice,
+			Question:   "Who is <Lizzy>?",
+			Options:    []string{"Jane Bennet", "Elizabeth Bennet"},
+			Answer:     "Elizabeth Bennet",
+			Difficulty: QuizDifficultyEasy,
+			Source:     "Chapter 1",
+			Tags:       []string{"book_1", "chapter_1"},
+		},
+		{Type: QuizTypeShortAnswer, Question: "Who rents Netherfield, \"the\" estate?", Answer: "Mr. Bingley", Difficulty: QuizDifficultyMedium},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(out, "#separator:comma\n#html:true\n#tags column:3\n") {
+		t.Errorf("Expected Anki file headers, got %q", out)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(out[strings.Index(out, "\n#tags column:3\n")+len("\n#tags column:3\n"):])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"Who is &lt;Lizzy&gt;?<br><br>A. Jane Bennet<br>B. Elizabeth Bennet<br>", "B. Elizabeth Bennet<br><br><i>Chapter 1</i>", "multiple_choice easy book_1 chapter_1"},
+		{"Who rents Netherfield, &#34;the&#34; estate?", "Mr. Bingley", "short_answer medium"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected %q, got %q", expected, records)
+	}
+}
+
+func TestQuizDetails(t *testing.T) {
+	var prompt string
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		prompt = body.Messages[0].Content
+
+		w.Header().Set("Content-Type", "application/json")
+		content, _ := json.Marshal("Difficulty: easy\nWrong answer: Longbourn\nWrong answer: Pemberley\nWrong answer: Rosings")
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test", "choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, content)
+	})
+
+	difficulty, distractors, err := generator.QuizDetails(context.Background(), "Where does Mr. Bingley live?", "Netherfield", "Netherfield Park is let at last.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if difficulty != QuizDifficultyEasy || len(distractors) != 3 {
+		t.Errorf("Expected easy with 3 distractors, got %q %v", difficulty, distractors)
+	}
+	if !strings.Contains(prompt, "<passage>\nNetherfield Park is let at last.\n</passage>") || strings.Count(prompt, "Wrong answer:") != QuizDistractors {
+		t.Errorf("Expected the delimited passage and %d wrong answer slots in the prompt, got %q", QuizDistractors, prompt)
+	}
+}
@@ -0,0 +1,277 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ways a quote was found, from most to least precise
+const (
+	QuoteMethodExact      = "exact"      // Verbatim
+	QuoteMethodNormalized = "normalized" // Ignoring case, punctuation and archaic spelling
+	QuoteMethodFuzzy      = "fuzzy"      // Within a word-level edit distance
+	QuoteMethodSemantic   = "semantic"   // The most similar passage, see vector search
+)
+
+// NormalizedQuoteConfidence is the confidence of a normalized match. Exact
+// matches have a confidence of 1.
+const NormalizedQuoteConfidence = 0.95
+
+// MinQuoteConfidence is the lowest confidence of a fuzzy match, i.e. at
+// most 40% of the quote's words may differ
+const MinQuoteConfidence = 0.6
+
+// SemanticQuoteWeight scales the similarity of a semantic match into its
+// confidence, which keeps it below that of any fuzzy match
+const SemanticQuoteWeight = 0.5
+
+// MaxQuoteWords limits the cost of fuzzy matching
+const MaxQuoteWords = 200
+
+// archaicSpellings maps archaic and British spellings to the words people
+// tend to remember instead. Apostrophes and hyphens are removed first.
+var archaicSpellings = map[string][]string{
+	"tis": {"it", "is"}, "twas": {"it", "was"}, "twill": {"it", "will"}, "twere": {"it", "were"},
+	"oer": {"over"}, "eer": {"ever"}, "neer": {"never"}, "een": {"even"},
+	"hath": {"has"}, "doth": {"does"}, "hast": {"have"}, "dost": {"do"},
+	"wilt": {"will"}, "shalt": {"shall"}, "wouldst": {"would"}, "couldst": {"could"},
+	"thou": {"you"}, "thee": {"you"}, "ye": {"you"}, "thy": {"your"}, "thine": {"your"},
+	"whilst": {"while"}, "amongst": {"among"}, "oft": {"often"}, "ere": {"before"},
+	"shew": {"show"}, "shewn": {"shown"}, "shewed": {"showed"}, "connexion": {"connection"},
+	"colour": {"color"}, "honour": {"honor"}, "favour": {"favor"}, "humour": {"humor"},
+	"labour": {"labor"}, "neighbour": {"neighbor"}, "behaviour": {"behavior"},
+}
+
+// QuoteMatch is where a quote was found in a text, in rune offsets
+type QuoteMatch struct {
+	Method     string
+	Confidence float64
+	StartRune  int
+	EndRune    int // Exclusive
+}
+
+// quoteToken is a normalized word and the runes it was read from
+type quoteToken struct {
+	word       string
+	start, end int
+}
+
+func isQuoteJoiner(r rune) bool {
+	return r == '\'' || r == '’' || r == '-'
+}
+
+// quoteTokens splits text into normalized words. Apostrophes and hyphens
+// within words are dropped ("world's" is "worlds", "to-day" is "today") and
+// archaic spellings are replaced, which can turn one word into several.
+func quoteTokens(text string) []quoteToken {
+	runes := []rune(text)
+	isWord := func(i int) bool {
+		return i >= 0 && i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+	}
+
+	var tokens []quoteToken
+	var word strings.Builder
+	for i := 0; i < len(runes); i++ {
+		if !isWord(i) {
+			continue
+		}
+
+		start := i
+		word.Reset()
+		for ; i < len(runes); i++ {
+			if isWord(i) {
+				word.WriteRune(unicode.ToLower(runes[i]))
+			} else if !isQuoteJoiner(runes[i]) || !isWord(i-1) || !isWord(i+1) {
+				break
+			}
+		}
+
+		normalized := []string{word.String()}
+		if spelling, ok := archaicSpellings[normalized[0]]; ok {
+			normalized = spelling
+		}
+		for _, w := range normalized {
+			tokens = append(tokens, quoteToken{word: w, start: start, end: i})
+		}
+	}
+	return tokens
+}
+
+// FindQuote locates a possibly misremembered quote in text. It tries exact,
+// normalized and fuzzy matching in that order and returns the matches of the
+// first method that finds any, best first, up to limit.
+func FindQuote(text, quote string, limit int) []QuoteMatch {
+	quote = strings.TrimSpace(quote)
+	if quote == "" || limit <= 0 {
+		return nil
+	}
+
+	if matches := findExact(text, quote, limit); len(matches) > 0 {
+		return matches
+	}
+
+	textTokens := quoteTokens(text)
+	quoteWords := quoteTokens(quote)
+	if len(quoteWords) == 0 {
+		return nil
+	}
+	quoteWords = quoteWords[:min(len(quoteWords), MaxQuoteWords)]
+
+	if matches := findNormalized(textTokens, quoteWords, limit); len(matches) > 0 {
+		return matches
+	}
+	return findFuzzy(textTokens, quoteWords, limit)
+}
+
+func findExact(text, quote string, limit int) []QuoteMatch {
+	var matches []QuoteMatch
+	offset, runeOffset := 0, 0
+	for len(matches) < limit {
+		i := strings.Index(text[offset:], quote)
+		if i < 0 {
+			break
+		}
+		start := runeOffset + utf8.RuneCountInString(text[offset:offset+i])
+		end := start + utf8.RuneCountInString(quote)
+		matches = append(matches, QuoteMatch{Method: QuoteMethodExact, Confidence: 1, StartRune: start, EndRune: end})
+
+		offset += i + len(quote)
+		runeOffset = end
+	}
+	return matches
+}
+
+func findNormalized(textTokens, quoteWords []quoteToken, limit int) []QuoteMatch {
+	var matches []QuoteMatch
+	for i := 0; i+len(quoteWords) <= len(textTokens) && len(matches) < limit; i++ {
+		equal := true
+		for j, q := range quoteWords {
+			if textTokens[i+j].word != q.word {
+				equal = false
+				break
+			}
+		}
+		if !equal {
+			continue
+		}
+
+		matches = append(matches, QuoteMatch{
+			Method:     QuoteMethodNormalized,
+			Confidence: NormalizedQuoteConfidence,
+			StartRune:  textTokens[i].start,
+			EndRune:    textTokens[i+len(quoteWords)-1].end,
+		})
+		i += len(quoteWords) - 1
+	}
+	return matches
+}
+
+// wordSubstitutionCost is 0 for equal words, 0.5 for likely misspellings of
+// each other and 1 otherwise
+func wordSubstitutionCost(a, b string) float64 {
+	if a == b {
+		return 0
+	}
+	if len(a) >= 4 && len(b) >= 4 && a[0] == b[0] && editDistance(a, b) <= 1+min(len(a), len(b))/6 {
+		return 0.5
+	}
+	return 1
+}
+
+// editDistance is the Levenshtein distance of two words in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j-1]+cost, prev[j]+1, cur[j-1]+1)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// findFuzzy finds the spans of text with the smallest word-level edit
+// distance to the quote (approximate substring matching). The confidence is
+// the share of the quote's words that match.
+func findFuzzy(textTokens, quoteWords []quoteToken, limit int) []QuoteMatch {
+	n, m := len(textTokens), len(quoteWords)
+	maxDistance := float64(m) * (1 - MinQuoteConfidence)
+
+	// dist[j] is the distance of the quote's first i words to the best span
+	// of text ending before token j, which starts at token start[j]
+	dist := make([]float64, n+1)
+	start := make([]int, n+1)
+	for j := range start {
+		start[j] = j // A match may start anywhere
+	}
+	prevDist := make([]float64, n+1)
+	prevStart := make([]int, n+1)
+
+	for i := 1; i <= m; i++ {
+		copy(prevDist, dist)
+		copy(prevStart, start)
+
+		dist[0], start[0] = float64(i), 0
+		for j := 1; j <= n; j++ {
+			// Substitute, skip a quote word or skip a text word
+			dist[j], start[j] = prevDist[j-1]+wordSubstitutionCost(quoteWords[i-1].word, textTokens[j-1].word), prevStart[j-1]
+			if d := prevDist[j] + 1; d < dist[j] {
+				dist[j], start[j] = d, prevStart[j]
+			}
+			if d := dist[j-1] + 1; d < dist[j] {
+				dist[j], start[j] = d, start[j-1]
+			}
+		}
+	}
+
+	type candidate struct {
+		distance   float64
+		start, end int // Token indices, end exclusive
+	}
+	var candidates []candidate
+	for j := 1; j <= n; j++ {
+		if dist[j] <= maxDistance && start[j] < j {
+			candidates = append(candidates, candidate{distance: dist[j], start: start[j], end: j})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.distance != b.distance {
+			if a.distance < b.distance {
+				return -1
+			}
+			return 1
+		}
+		return (a.end - a.start) - (b.end - b.start) // Prefer tighter spans
+	})
+
+	var matches []QuoteMatch
+	var taken []candidate
+	for _, c := range candidates {
+		if len(matches) == limit {
+			break
+		}
+		if slices.ContainsFunc(taken, func(t candidate) bool { return c.start < t.end && t.start < c.end }) {
+			continue
+		}
+		taken = append(taken, c)
+		matches = append(matches, QuoteMatch{
+			Method:     QuoteMethodFuzzy,
+			Confidence: 1 - c.distance/float64(m),
+			StartRune:  textTokens[c.start].start,
+			EndRune:    textTokens[c.end-1].end,
+		})
+	}
+	return matches
+}
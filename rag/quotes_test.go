@@ -0,0 +1,79 @@
+package rag
+
+import (
+	"testing"
+)
+
+const quoteText = "ROMEO.\nBut soft, what light through yonder window breaks?\nIt is the east, and Juliet is the sun.\n\nJULIET.\n’Tis but thy name that is my enemy;\nThou art thyself, though not a Montague."
+
+func matchedText(text string, match QuoteMatch) string {
+	return string([]rune(text)[match.StartRune:match.EndRune])
+}
+
+func TestQuoteTokens(t *testing.T) {
+	tokens := quoteTokens("’Tis to-day, world’s end!")
+
+	expected := []string{"it", "is", "today", "worlds", "end"}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %+v", len(expected), tokens)
+	}
+	for i, token := range tokens {
+		if token.word != expected[i] {
+			t.Errorf("Expected token %d to be %q, got %q", i, expected[i], token.word)
+		}
+	}
+	if tokens[0].start != 1 || tokens[0].end != 4 || tokens[1].start != 1 {
+		t.Errorf("Expected both words of 'Tis to cover runes 1 to 4, got %+v", tokens[:2])
+	}
+}
+
+func TestFindQuoteExact(t *testing.T) {
+	matches := FindQuote(quoteText, "Juliet is the sun", 5)
+	if len(matches) != 1 || matches[0].Method != QuoteMethodExact || matches[0].Confidence != 1 {
+		t.Fatalf("Expected one exact match, got %+v", matches)
+	}
+	if got := matchedText(quoteText, matches[0]); got != "Juliet is the sun" {
+		t.Errorf("Expected the quote, got %q", got)
+	}
+
+	if matches := FindQuote(quoteText, "is", 2); len(matches) != 2 || matches[0].StartRune >= matches[1].StartRune {
+		t.Errorf("Expected the first two occurrences in order, got %+v", matches)
+	}
+}
+
+func TestFindQuoteNormalized(t *testing.T) {
+	matches := FindQuote(quoteText, "it is but your name that is my enemy", 5)
+	if len(matches) != 1 || matches[0].Method != QuoteMethodNormalized {
+		t.Fatalf("Expected one normalized match, got %+v", matches)
+	}
+	if got := matchedText(quoteText, matches[0]); got != "Tis but thy name that is my enemy" {
+		t.Errorf("Expected the original spelling, got %q", got)
+	}
+}
+
+func TestFindQuoteFuzzy(t *testing.T) {
+	matches := FindQuote(quoteText, "But soft! What light from yonder window breaks", 5)
+	if len(matches) == 0 || matches[0].Method != QuoteMethodFuzzy {
+		t.Fatalf("Expected a fuzzy match, got %+v", matches)
+	}
+	if got := matchedText(quoteText, matches[0]); got != "But soft, what light through yonder window breaks" {
+		t.Errorf("Expected the original line, got %q", got)
+	}
+	if confidence := matches[0].Confidence; confidence < MinQuoteConfidence || confidence >= NormalizedQuoteConfidence {
+		t.Errorf("Expected a confidence between %v and %v, got %v", MinQuoteConfidence, NormalizedQuoteConfidence, confidence)
+	}
+
+	// Misspelled words count half
+	matches = FindQuote(quoteText, "Juliet is the sunn and the east", 5)
+	if len(matches) != 0 {
+		t.Errorf("Expected no match for a reordered quote, got %+v", matches)
+	}
+	matches = FindQuote(quoteText, "though not a Montage", 5)
+	if len(matches) != 1 || matches[0].Confidence != 1-0.5/4 {
+		t.Errorf("Expected one match with a misspelled word, got %+v", matches)
+	}
+
+	if matches := FindQuote(quoteText, "a quote that is not in the text at all", 5); len(matches) != 0 {
+		t.Errorf("Expected no matches, got %+v", matches)
+	}
+}
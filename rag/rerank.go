@@ -0,0 +1,166 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reranker rescores documents against a query. The returned scores are in
+// the same order as the documents, higher is more relevant.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, documents []string) ([]float32, error)
+}
+
+// RerankBaseURL points to an Ollama-hosted or OpenAI-compatible server that
+// exposes a /rerank endpoint. Without it, the LLM is used as reranker.
+var RerankBaseURL string
+
+var RerankModel string
+
+var RerankAPIKey string
+
+const DefaultRerankModel = "bge-reranker-v2-m3"
+
+// NewReranker returns the configured reranker, falling back to the LLM
+func NewReranker() Reranker {
+	if RerankBaseURL == "" {
+		return LLMReranker{}
+	}
+
+	model := RerankModel
+	if model == "" {
+		model = DefaultRerankModel
+	}
+
+	return EndpointReranker{BaseURL: RerankBaseURL, Model: model, APIKey: RerankAPIKey}
+}
+
+// EndpointReranker calls a cross-encoder behind a /rerank endpoint
+type EndpointReranker struct {
+	BaseURL string
+	Model   string
+	APIKey  string
+}
+
+type RerankPayload struct {
+	Model     string   `json:"model"`
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+	TopN      int      `json:"top_n"`
+}
+
+type RerankResponse struct {
+	Results []struct {
+		Index          int     `json:"index"`
+		RelevanceScore float32 `json:"relevance_score"`
+	} `json:"results"`
+}
+
+func (e EndpointReranker) Rerank(ctx context.Context, query string, documents []string) ([]float32, error) {
+	reqData, err := json.Marshal(RerankPayload{
+		Model:     e.Model,
+		Query:     query,
+		Documents: documents,
+		TopN:      len(documents),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rerank", strings.TrimSuffix(e.BaseURL, "/")), bytes.NewReader(reqData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	if e.APIKey != "" {
+		req.Header.Add("Authorization", "Bearer "+e.APIKey)
+	}
+	httpClient := http.Client{Timeout: HTTPTimeout}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resData, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rerank API returned status %d: %s", res.StatusCode, string(resData))
+	}
+
+	var data RerankResponse
+	if err := json.Unmarshal(resData, &data); err != nil {
+		return nil, err
+	}
+
+	scores := make([]float32, len(documents))
+	for _, result := range data.Results {
+		if result.Index < 0 || result.Index >= len(documents) {
+			return nil, fmt.Errorf("rerank API returned out of range index %d", result.Index)
+		}
+		scores[result.Index] = result.RelevanceScore
+	}
+
+	return scores, nil
+}
+
+// LLMReranker asks the generation model to grade every document
+type LLMReranker struct{}
+
+func (LLMReranker) Rerank(ctx context.Context, query string, documents []string) ([]float32, error) {
+	var passages strings.Builder
+	for i, doc := range documents {
+		fmt.Fprintf(&passages, "%s\n\n", DelimitPassage(doc, fmt.Sprintf(`id="%d"`, i)))
+	}
+
+	prompt := fmt.Sprintf(`Rate how relevant each of the following passages is for answering the query.
+
+Query: %s
+
+Passages, each with its index as id. %s
+
+%s
+Score every passage from 0 (irrelevant) to 10 (answers the query directly).
+Output one line per passage in the format "[index]: score" and nothing else.`, query, UntrustedPassagesNotice, passages.String())
+
+	response, err := GenerateText(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRerankScores(response, len(documents)), nil
+}
+
+var rerankScoreRegex = regexp.MustCompile(`\[(\d+)\]\s*:\s*(\d+(?:\.\d+)?)`)
+
+// parseRerankScores reads "[index]: score" lines and normalizes the 0-10
+// scores to 0-1. Passages the model skipped get a score of 0.
+func parseRerankScores(response string, count int) []float32 {
+	scores := make([]float32, count)
+
+	for _, match := range rerankScoreRegex.FindAllStringSubmatch(response, -1) {
+		idx, err := strconv.Atoi(match[1])
+		if err != nil || idx < 0 || idx >= count {
+			continue
+		}
+		score, err := strconv.ParseFloat(match[2], 32)
+		if err != nil {
+			continue
+		}
+		scores[idx] = float32(min(score, 10) / 10)
+	}
+
+	return scores
+}
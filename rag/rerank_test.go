@@ -0,0 +1,66 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestEndpointReranker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rerank" {
+			t.Errorf("Expected path /rerank, got %s", r.URL.Path)
+		}
+
+		var payload RerankPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		if payload.Query != "balcony" || len(payload.Documents) != 2 {
+			t.Errorf("Unexpected payload: %+v", payload)
+		}
+
+		// Results come back sorted by relevance, not by input order
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results": [{"index": 1, "relevance_score": 0.9}, {"index": 0, "relevance_score": 0.2}]}`))
+	}))
+	defer server.Close()
+
+	reranker := EndpointReranker{BaseURL: server.URL, Model: "test"}
+	scores, err := reranker.Rerank(context.Background(), "balcony", []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !reflect.DeepEqual(scores, []float32{0.2, 0.9}) {
+		t.Errorf("Expected scores in document order, got %v", scores)
+	}
+}
+
+func TestEndpointReranker_ServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	reranker := EndpointReranker{BaseURL: server.URL, Model: "test"}
+	if _, err := reranker.Rerank(context.Background(), "q", []string{"a"}); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestParseRerankScores(t *testing.T) {
+	response := "[0]: 7\n[2]: 10\n[1]:3.5\n[9]: 8"
+	expected := []float32{0.7, 0.35, 1}
+
+	if scores := parseRerankScores(response, 3); !reflect.DeepEqual(scores, expected) {
+		t.Errorf("Expected %v, got %v", expected, scores)
+	}
+
+	if scores := parseRerankScores("no scores here", 2); !reflect.DeepEqual(scores, []float32{0, 0}) {
+		t.Errorf("Expected zero scores, got %v", scores)
+	}
+}
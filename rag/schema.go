@@ -0,0 +1,365 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/openai/openai-go/v3"
+)
+
+// MaxStructuredAttempts is how often the LLM may try to produce output that
+// validates against the schema
+const MaxStructuredAttempts = 3
+
+// Built-in output schemas for structured answers
+var BuiltinSchemas = map[string]string{
+	"list_of_characters": `{
+  "type": "object",
+  "properties": {
+    "characters": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "description": {"type": "string"}
+        },
+        "required": ["name", "description"],
+        "additionalProperties": false
+      }
+    }
+  },
+  "required": ["characters"],
+  "additionalProperties": false
+}`,
+	"yes_no_with_evidence": `{
+  "type": "object",
+  "properties": {
+    "answer": {"type": "string", "enum": ["yes", "no", "unknown"]},
+    "explanation": {"type": "string"},
+    "evidence": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "description": "Short quotes from the passages supporting the answer"
+    }
+  },
+  "required": ["answer", "explanation", "evidence"],
+  "additionalProperties": false
+}`,
+	"list_of_events": `{
+  "type": "object",
+  "properties": {
+    "events": {
+      "type": "array",
+      "items": {"type": "string", "minLength": 1},
+      "description": "Events in the order they happen"
+    }
+  },
+  "required": ["events"],
+  "additionalProperties": false
+}`,
+}
+
+// BuiltinSchemaNames returns the names of the built-in schemas, sorted
+func BuiltinSchemaNames() []string {
+	names := make([]string, 0, len(BuiltinSchemas))
+	for name := range BuiltinSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Schema is the subset of JSON Schema structured answers are validated
+// against. ParseSchema rejects other keywords, except annotations like
+// description, so a schema is never only partly enforced.
+type Schema struct {
+	Type                 json.RawMessage    `json:"type"` // A type name or a list of them
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"` // true or false
+	Items                *Schema            `json:"items"`
+	Enum                 []any              `json:"enum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+
+	types []string
+}
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// schemaKeywords are the keywords Validate enforces, followed by annotations
+// that don't constrain values
+var schemaKeywords = []string{
+	"type", "properties", "required", "additionalProperties", "items", "enum",
+	"minItems", "maxItems", "minLength", "maxLength", "minimum", "maximum",
+	"$schema", "title", "description", "default", "examples", "$comment",
+}
+
+// ParseSchema reads a JSON Schema and checks the keywords it supports. A
+// schema using any other keyword, like anyOf, $ref or pattern, is an error.
+func ParseSchema(raw []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := checkSchemaKeywords(raw, "$"); err != nil {
+		return nil, err
+	}
+	if err := s.prepare("$"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// checkSchemaKeywords rejects keywords Validate doesn't enforce, in the
+// schema and its properties and items
+func checkSchemaKeywords(raw json.RawMessage, path string) error {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &keywords); err != nil {
+		return fmt.Errorf("%s: schema must be an object", path)
+	}
+
+	names := make([]string, 0, len(keywords))
+	for name := range keywords {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(schemaKeywords, name) {
+			return fmt.Errorf("%s: unsupported keyword %q, supported are %s", path, name, strings.Join(schemaKeywords[:12], ", "))
+		}
+	}
+
+	if additional, ok := keywords["additionalProperties"]; ok {
+		var allowed bool
+		if err := json.Unmarshal(additional, &allowed); err != nil {
+			return fmt.Errorf("%s: additionalProperties must be true or false", path)
+		}
+	}
+
+	if rawProperties, ok := keywords["properties"]; ok {
+		var properties map[string]json.RawMessage
+		if err := json.Unmarshal(rawProperties, &properties); err != nil {
+			return fmt.Errorf("%s: properties must be an object", path)
+		}
+		for name, property := range properties {
+			if err := checkSchemaKeywords(property, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := keywords["items"]; ok {
+		return checkSchemaKeywords(items, path+"[]")
+	}
+	return nil
+}
+
+func (s *Schema) prepare(path string) error {
+	if len(s.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(s.Type, &single); err == nil {
+			s.types = []string{single}
+		} else if err := json.Unmarshal(s.Type, &s.types); err != nil {
+			return fmt.Errorf("%s: type must be a string or a list of strings", path)
+		}
+		for _, t := range s.types {
+			if !slices.Contains(schemaTypes, t) {
+				return fmt.Errorf("%s: unknown type %q", path, t)
+			}
+		}
+	}
+
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("%s.%s: schema must be an object", path, name)
+		}
+		if err := property.prepare(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.prepare(path + "[]")
+	}
+	return nil
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Validate returns a message for every part of value that doesn't match the
+// schema, with the path to it. Value is decoded JSON as by encoding/json.
+func (s *Schema) Validate(value any) []string {
+	var errs []string
+	s.validate("$", value, &errs)
+	return errs
+}
+
+func (s *Schema) validate(path string, value any, errs *[]string) {
+	actual := jsonType(value)
+	if len(s.types) > 0 && !slices.Contains(s.types, actual) && !(actual == "integer" && slices.Contains(s.types, "number")) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(s.types, " or "), actual))
+		return
+	}
+
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return jsonEqual(e, value) }) {
+		allowed, _ := json.Marshal(s.Enum)
+		*errs = append(*errs, fmt.Sprintf("%s: must be one of %s", path, allowed))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				property.validate(path+"."+name, v[name], errs)
+			} else if string(bytes.TrimSpace(s.AdditionalProperties)) == "false" {
+				*errs = append(*errs, fmt.Sprintf("%s: unexpected property %q", path, name))
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			*errs = append(*errs, fmt.Sprintf("%s: expected at least %d items, got %d", path, *s.MinItems, len(v)))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			*errs = append(*errs, fmt.Sprintf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(v)))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			*errs = append(*errs, fmt.Sprintf("%s: expected at least %d characters", path, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			*errs = append(*errs, fmt.Sprintf("%s: expected at most %d characters", path, *s.MaxLength))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			*errs = append(*errs, fmt.Sprintf("%s: must be at least %v", path, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			*errs = append(*errs, fmt.Sprintf("%s: must be at most %v", path, *s.Maximum))
+		}
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// ExtractJSON strips what LLMs tend to put around JSON, like code fences or
+// a sentence before it
+func ExtractJSON(response string) string {
+	response = strings.TrimSpace(response)
+	if fenced, ok := strings.CutPrefix(response, "```"); ok {
+		if i := strings.IndexByte(fenced, '\n'); i >= 0 {
+			fenced = fenced[i+1:] // Language tag
+		}
+		response = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(fenced), "```"))
+	}
+
+	start := strings.IndexAny(response, "{[")
+	end := strings.LastIndexAny(response, "}]")
+	if start < 0 || end < start {
+		return response
+	}
+	return response[start : end+1]
+}
+
+// StructuredOutputError is returned if the LLM never produced valid output
+type StructuredOutputError struct {
+	Raw    string   // The last output
+	Errors []string // Why it didn't validate
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("structured output did not validate: %s", strings.Join(e.Errors, "; "))
+}
+
+// parseStructured decodes the JSON in a response and validates it
+func parseStructured(response string, schema *Schema) (any, []string) {
+	var value any
+	if err := json.Unmarshal([]byte(ExtractJSON(response)), &value); err != nil {
+		return nil, []string{fmt.Sprintf("output is not valid JSON: %v", err)}
+	}
+	return value, schema.Validate(value)
+}
+
+// GenerateStructured answers the prompt with JSON matching the schema. Output
+// that doesn't validate is sent back to the LLM with the validation errors,
+// up to MaxStructuredAttempts times in total. It returns the decoded value,
+// the raw JSON and the number of attempts.
+func (g *Generator) GenerateStructured(ctx context.Context, prompt string, rawSchema []byte, schema *Schema) (any, string, int, error) {
+	messages := []openai.ChatCompletionMessageParamUnion{
+		openai.UserMessage(fmt.Sprintf(`%s
+
+Respond only with a JSON value that validates against the following JSON Schema, without any other text:
+%s`, prompt, rawSchema)),
+	}
+
+	var response string
+	var errs []string
+	for attempt := 1; attempt <= MaxStructuredAttempts; attempt++ {
+		completion, err := g.Complete(ctx, openai.ChatCompletionNewParams{Messages: messages})
+		if err != nil {
+			return nil, "", attempt, err
+		}
+		response = completion.Choices[0].Message.Content
+
+		var value any
+		value, errs = parseStructured(response, schema)
+		if len(errs) == 0 {
+			return value, ExtractJSON(response), attempt, nil
+		}
+
+		messages = append(messages,
+			openai.AssistantMessage(response),
+			openai.UserMessage(fmt.Sprintf("Your output does not validate against the schema:\n- %s\nRespond again with only the corrected JSON.", strings.Join(errs, "\n- "))),
+		)
+	}
+
+	return nil, "", MaxStructuredAttempts, &StructuredOutputError{Raw: response, Errors: errs}
+}
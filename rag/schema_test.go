@@ -0,0 +1,133 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinSchemas(t *testing.T) {
+	for _, name := range BuiltinSchemaNames() {
+		if _, err := ParseSchema([]byte(BuiltinSchemas[name])); err != nil {
+			t.Errorf("Expected built-in schema %s to parse, got %v", name, err)
+		}
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	if _, err := ParseSchema([]byte(`{"type": "object", "properties": {"a": {"type": ["string", "null"]}}}`)); err != nil {
+		t.Errorf("Expected a type list to parse, got %v", err)
+	}
+	if _, err := ParseSchema([]byte(`{"type": "object", "properties": {"a": {"type": "text"}}}`)); err == nil || !strings.Contains(err.Error(), "$.a") {
+		t.Errorf("Expected an error for an unknown type at $.a, got %v", err)
+	}
+	if _, err := ParseSchema([]byte(`[1, 2]`)); err == nil {
+		t.Error("Expected an error for a schema that isn't an object")
+	}
+
+	// Keywords that wouldn't be enforced are rejected, at any depth
+	for schema, expected := range map[string]string{
+		`{"anyOf": [{"type": "string"}, {"type": "null"}]}`:                       `$: unsupported keyword "anyOf"`,
+		`{"type": "object", "properties": {"a": {"$ref": "#/definitions/a"}}}`:    `$.a: unsupported keyword "$ref"`,
+		`{"type": "array", "items": {"type": "string", "pattern": "^[A-Z]"}}`:     `$[]: unsupported keyword "pattern"`,
+		`{"type": "object", "additionalProperties": {"type": "string"}}`:          `$: additionalProperties must be true or false`,
+		`{"type": "object", "properties": {"a": {"const": 1, "format": "date"}}}`: `$.a: unsupported keyword "const"`,
+	} {
+		if _, err := ParseSchema([]byte(schema)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %s, got %v", expected, schema, err)
+		}
+	}
+
+	// Annotations are fine
+	if _, err := ParseSchema([]byte(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "Answer", "type": "object", "additionalProperties": true}`)); err != nil {
+		t.Errorf("Expected annotations to be accepted, got %v", err)
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(BuiltinSchemas["yes_no_with_evidence"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var valid any
+	json.Unmarshal([]byte(`{"answer": "yes", "explanation": "She says so.", "evidence": ["I am happy"]}`), &valid)
+	if errs := schema.Validate(valid); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	var invalid any
+	json.Unmarshal([]byte(`{"answer": "maybe", "evidence": ["", 3], "confidence": 0.5}`), &invalid)
+	expected := []string{
+		`$: missing required property "explanation"`,
+		`$.answer: must be one of ["yes","no","unknown"]`,
+		`$: unexpected property "confidence"`,
+		`$.evidence[0]: expected at least 1 characters`,
+		`$.evidence[1]: expected string, got integer`,
+	}
+	if errs := schema.Validate(invalid); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected %q, got %q", expected, errs)
+	}
+
+	numbers, _ := ParseSchema([]byte(`{"type": "array", "items": {"type": "number", "minimum": 0}, "maxItems": 2}`))
+	if errs := numbers.Validate([]any{1.0, 2.5, -1.0}); len(errs) != 2 {
+		t.Errorf("Expected too many items and a negative number, got %v", errs)
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := map[string]string{
+		`{"a": 1}`:                              `{"a": 1}`,
+		"```json\n{\"a\": 1}\n```":              `{"a": 1}`,
+		"Here you go:\n[1, 2]\nHope this helps": `[1, 2]`,
+		"no json":                               "no json",
+	}
+	for input, expected := range tests {
+		if got := ExtractJSON(input); got != expected {
+			t.Errorf("ExtractJSON(%q): expected %q, got %q", input, expected, got)
+		}
+	}
+}
+
+func TestGenerateStructured(t *testing.T) {
+	schema, _ := ParseSchema([]byte(BuiltinSchemas["list_of_events"]))
+
+	newGenerator := func(responses ...string) (*Generator, *[]int) {
+		var messageCounts []int
+		return newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Messages []map[string]any `json:"messages"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			messageCounts = append(messageCounts, len(body.Messages))
+
+			content, _ := json.Marshal(responses[min(len(messageCounts), len(responses))-1])
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test", "choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, content)
+		}), &messageCounts
+	}
+
+	generator, calls := newGenerator(`{"events": "Ahab lost his leg"}`, "```json\n{\"events\": [\"Ahab lost his leg\"]}\n```")
+	value, raw, attempts, err := generator.GenerateStructured(context.Background(), "List the events.", []byte(BuiltinSchemas["list_of_events"]), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || !reflect.DeepEqual(*calls, []int{1, 3}) {
+		t.Errorf("Expected a retry with the validation errors, got %d attempts and message counts %v", attempts, *calls)
+	}
+	if raw != `{"events": ["Ahab lost his leg"]}` || !reflect.DeepEqual(value, map[string]any{"events": []any{"Ahab lost his leg"}}) {
+		t.Errorf("Expected the decoded events, got %v (%s)", value, raw)
+	}
+
+	generator, calls = newGenerator("I don't know.")
+	_, _, attempts, err = generator.GenerateStructured(context.Background(), "List the events.", []byte(BuiltinSchemas["list_of_events"]), schema)
+	var structuredErr *StructuredOutputError
+	if !errors.As(err, &structuredErr) || structuredErr.Raw != "I don't know." || attempts != MaxStructuredAttempts || len(*calls) != MaxStructuredAttempts {
+		t.Errorf("Expected a StructuredOutputError with the raw output after %d attempts, got %v after %d", MaxStructuredAttempts, err, attempts)
+	}
+}
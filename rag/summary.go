@@ -0,0 +1,167 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	SummaryLengthShort    = "short"    // One paragraph (default)
+	SummaryLengthDetailed = "detailed" // Several paragraphs
+)
+
+// SummaryConcurrency is the number of sections summarized in parallel
+const SummaryConcurrency = 4
+
+func IsValidSummaryLength(length string) bool {
+	return length == SummaryLengthShort || length == SummaryLengthDetailed
+}
+
+// NormalizeFocus lowercases, dedupes and sorts focus topics, so equal focus
+// lists share cached summaries
+func NormalizeFocus(focus []string) []string {
+	normalized := []string{}
+	for _, topic := range focus {
+		topic = strings.ToLower(strings.Join(strings.Fields(topic), " "))
+		if topic != "" && !slices.Contains(normalized, topic) {
+			normalized = append(normalized, topic)
+		}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
+
+func summaryInstructions(length string, focus []string) string {
+	instructions := "Write a short summary of one paragraph with the key events and the characters involved, in order."
+	if length == SummaryLengthDetailed {
+		instructions = "Write a detailed summary of several paragraphs. Cover all important events in order, the characters involved and how they develop."
+	}
+	if len(focus) > 0 {
+		instructions += fmt.Sprintf("\nFocus on: %s. Mention other events only as far as needed to follow these topics.", strings.Join(focus, ", "))
+	}
+	return instructions + "\nOutput only the summary."
+}
+
+// splitByTokens splits text at paragraph boundaries into pieces of at most
+// about budget tokens each
+func splitByTokens(model, text string, budget int) []string {
+	paragraphs := strings.Split(text, "\n\n")
+	for i, paragraph := range paragraphs {
+		paragraphs[i] = TrimToTokens(model, paragraph, budget)
+	}
+
+	var pieces []string
+	for _, group := range groupByTokens(model, paragraphs, budget) {
+		pieces = append(pieces, strings.Join(group, "\n\n"))
+	}
+	return pieces
+}
+
+// SummarizeSection summarizes one part of a book, e.g. a chapter. Text that
+// doesn't fit into the context budget is summarized piece by piece first.
+func (g *Generator) SummarizeSection(ctx context.Context, title, text, length string, focus []string) (string, error) {
+	pieces := splitByTokens(g.Model, text, ContextBudget(g.Model, 0))
+	if len(pieces) > 1 {
+		summaries := make([]string, len(pieces))
+		for i, piece := range pieces {
+			summary, err := g.SummarizeSection(ctx, fmt.Sprintf("%s, part %d of %d", title, i+1, len(pieces)), piece, length, focus)
+			if err != nil {
+				return "", err
+			}
+			summaries[i] = summary
+		}
+		return g.CombineSummaries(ctx, title, summaries, length, focus)
+	}
+
+	return g.GenerateText(ctx, fmt.Sprintf(`Summarize the following part of a book: "%s".
+%s
+%s
+
+%s`, title, summaryInstructions(length, focus), UntrustedPassagesNotice, DelimitPassage(text)))
+}
+
+// CombineSummaries reduces the summaries of consecutive parts into one
+// summary. If they don't fit into the context budget together, groups of
+// them are combined first.
+func (g *Generator) CombineSummaries(ctx context.Context, title string, summaries []string, length string, focus []string) (string, error) {
+	if len(summaries) == 1 {
+		return summaries[0], nil
+	}
+
+	groups := groupByTokens(g.Model, summaries, ContextBudget(g.Model, 0))
+	if len(groups) > 1 && len(groups) < len(summaries) {
+		combined := make([]string, len(groups))
+		for i, group := range groups {
+			summary, err := g.CombineSummaries(ctx, title, group, length, focus)
+			if err != nil {
+				return "", err
+			}
+			combined[i] = summary
+		}
+		return g.CombineSummaries(ctx, title, combined, length, focus)
+	}
+
+	delimited := make([]string, len(summaries))
+	for i, summary := range summaries {
+		delimited[i] = DelimitPassage(summary, fmt.Sprintf(`part="%d"`, i+1))
+	}
+
+	return g.GenerateText(ctx, fmt.Sprintf(`The following are summaries of consecutive parts of "%s", in order, each in <passage> tags with its part number.
+Combine them into a single summary of the whole. %s
+The summaries were written from the book's text, so the same applies to them: %s
+
+%s`, title, summaryInstructions(length, focus), UntrustedPassagesNotice, strings.Join(delimited, "\n\n")))
+}
+
+// groupByTokens groups consecutive texts so each group fits into budget tokens
+func groupByTokens(model string, texts []string, budget int) [][]string {
+	var groups [][]string
+	tokens := 0
+	for _, text := range texts {
+		textTokens := CountTokens(model, text)
+		if len(groups) == 0 || tokens+textTokens > budget {
+			groups = append(groups, nil)
+			tokens = 0
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], text)
+		tokens += textTokens
+	}
+	return groups
+}
+
+// SummarySection is a part of a book to summarize
+type SummarySection struct {
+	Title string
+	Text  string
+}
+
+// SummarizeSections summarizes sections in parallel (map step). The
+// summaries are returned in the order of the sections.
+func (g *Generator) SummarizeSections(ctx context.Context, sections []SummarySection, length string, focus []string) ([]string, error) {
+	summaries := make([]string, len(sections))
+	errs := make([]error, len(sections))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, SummaryConcurrency)
+	for i, section := range sections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			summaries[i], errs[i] = g.SummarizeSection(ctx, section.Title, section.Text, length, focus)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return summaries, nil
+}
@@ -0,0 +1,84 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizeFocus(t *testing.T) {
+	got := NormalizeFocus([]string{" Whaling ", "ahab's  obsession", "whaling", ""})
+	expected := []string{"ahab's obsession", "whaling"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestSplitByTokens(t *testing.T) {
+	paragraph := strings.Repeat("word ", 80) // 100 tokens
+	text := strings.Join([]string{paragraph, paragraph, paragraph}, "\n\n")
+
+	pieces := splitByTokens("gpt-5-mini", text, 250)
+	if len(pieces) != 2 || strings.Count(pieces[0], "\n\n") != 1 {
+		t.Errorf("Expected 2 pieces split at a paragraph, got %d", len(pieces))
+	}
+	if strings.Join(pieces, "\n\n") != text {
+		t.Errorf("Expected the pieces to add up to the text")
+	}
+}
+
+func TestSummarizeSections(t *testing.T) {
+	var calls atomic.Int32
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		prompt := body.Messages[len(body.Messages)-1].Content
+
+		summary := "combined summary"
+		if !strings.Contains(prompt, "Combine them") {
+			// Echo the section title, so the order can be checked
+			summary = "summary of " + strings.SplitN(prompt, `"`, 3)[1]
+		}
+		if !strings.Contains(prompt, UntrustedPassagesNotice) || !strings.Contains(prompt, "<passage") {
+			t.Errorf("Expected the text to be delimited, got %q", prompt)
+		}
+		if !strings.Contains(prompt, "Focus on: whaling.") {
+			t.Errorf("Expected the focus in the prompt, got %q", prompt)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		completion, _ := json.Marshal(summary)
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, completion)
+	})
+
+	sections := []SummarySection{{Title: "Chapter 1", Text: "Call me Ishmael."}, {Title: "Chapter 2", Text: "I stuffed a shirt."}, {Title: "Chapter 3", Text: "Entering that gable-ended Spouter-Inn."}}
+	summaries, err := generator.SummarizeSections(context.Background(), sections, SummaryLengthShort, []string{"whaling"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []string{"summary of Chapter 1", "summary of Chapter 2", "summary of Chapter 3"}
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Errorf("Expected %v, got %v", expected, summaries)
+	}
+
+	combined, err := generator.CombineSummaries(context.Background(), "Moby Dick", summaries, SummaryLengthShort, []string{"whaling"})
+	if err != nil || combined != "combined summary" {
+		t.Errorf("Expected a combined summary, got %q (%v)", combined, err)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("Expected 4 LLM calls, got %d", calls.Load())
+	}
+}
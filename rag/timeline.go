@@ -0,0 +1,220 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DedupeWindow is the number of preceding events an event is compared to
+// when removing duplicates. Duplicates come from events described in
+// several chunks, so they are close to each other.
+const DedupeWindow = 5
+
+// DuplicateEventSimilarity is the word overlap above which two events are
+// considered the same
+const DuplicateEventSimilarity = 0.6
+
+// TimelinePassage is a passage events are extracted from
+type TimelinePassage struct {
+	ID   int64
+	Text string
+}
+
+// TimelineSection is a part of a book, e.g. a chapter, with its passages in order
+type TimelineSection struct {
+	Title    string
+	Passages []TimelinePassage
+}
+
+// TimelineEvent is a key event and the passages it is described in
+type TimelineEvent struct {
+	Section     int // Index of the section it was extracted from
+	Description string
+	PassageIDs  []int64
+}
+
+// ExtractTimeline extracts the key events of every section in parallel and
+// returns them in order, with duplicates removed. Sections that don't fit
+// into the context budget are split into chunks of passages.
+func (g *Generator) ExtractTimeline(ctx context.Context, sections []TimelineSection) ([]TimelineEvent, error) {
+	events := make([][]TimelineEvent, len(sections))
+	errs := make([]error, len(sections))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, SummaryConcurrency)
+	for i, section := range sections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			events[i], errs[i] = g.sectionEvents(ctx, i, section)
+		}()
+	}
+	wg.Wait()
+
+	var timeline []TimelineEvent
+	for i, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+		timeline = append(timeline, events[i]...)
+	}
+	return DedupeEvents(timeline), nil
+}
+
+func (g *Generator) sectionEvents(ctx context.Context, index int, section TimelineSection) ([]TimelineEvent, error) {
+	budget := ContextBudget(g.Model, 0)
+
+	var events []TimelineEvent
+	for start := 0; start < len(section.Passages); {
+		// Take as many passages as fit, but at least one
+		end, tokens := start, 0
+		for end < len(section.Passages) {
+			passageTokens := CountTokens(g.Model, section.Passages[end].Text)
+			if end > start && tokens+passageTokens > budget {
+				break
+			}
+			tokens += passageTokens
+			end++
+		}
+
+		chunkEvents, err := g.chunkEvents(ctx, section.Title, section.Passages[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range chunkEvents {
+			e.Section = index
+			events = append(events, e)
+		}
+		start = end
+	}
+	return events, nil
+}
+
+func (g *Generator) chunkEvents(ctx context.Context, title string, passages []TimelinePassage) ([]TimelineEvent, error) {
+	var b strings.Builder
+	ids := make([]int64, len(passages))
+	for i, p := range passages {
+		ids[i] = p.ID
+		fmt.Fprintf(&b, "%s\n\n", DelimitPassage(p.Text, fmt.Sprintf(`id="%d"`, p.ID)))
+	}
+
+	response, err := g.GenerateText(ctx, fmt.Sprintf(`The following passages are from "%s" of a book, in order, each with its ID as id.
+%s
+List the key events of the plot in the order they happen. Skip descriptions, reflections and minor details.
+Write one event per line as a short sentence in the past tense naming the characters involved, followed by the IDs of the passages describing it in brackets, e.g.:
+Elizabeth refused Mr. Collins's proposal. [12, 13]
+
+%s`, title, UntrustedPassagesNotice, strings.TrimSpace(b.String())))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTimelineEvents(response, ids), nil
+}
+
+var eventPassagesRegex = regexp.MustCompile(`\[([\d,\s]+)\]\s*\.?$`)
+
+// parseTimelineEvents reads one event per line with its passage IDs at the
+// end. Events without a valid passage ID are dropped, so every event is
+// supported by the text.
+func parseTimelineEvents(response string, validIDs []int64) []TimelineEvent {
+	var events []TimelineEvent
+	for _, line := range parseQueryList(response) {
+		m := eventPassagesRegex.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+
+		var ids []int64
+		for _, raw := range strings.FieldsFunc(line[m[2]:m[3]], func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err == nil && slices.Contains(validIDs, id) && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+
+		description := strings.TrimSpace(line[:m[0]])
+		if len(ids) == 0 || description == "" {
+			continue
+		}
+		slices.Sort(ids)
+		events = append(events, TimelineEvent{Description: description, PassageIDs: ids})
+	}
+	return events
+}
+
+func eventWords(description string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) > 2 && !entityStopwords[w] {
+			words[w] = true
+		}
+	}
+	return words
+}
+
+// eventSimilarity is the Jaccard similarity of the events' content words
+func eventSimilarity(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for w := range a {
+		if b[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// DedupeEvents merges events that describe the same thing as one of the
+// DedupeWindow events before them, e.g. because an event spans two chunks.
+// Events sharing a passage count as duplicates at a lower word overlap.
+// The first description is kept and the passage IDs are combined.
+func DedupeEvents(events []TimelineEvent) []TimelineEvent {
+	var deduped []TimelineEvent
+	var words []map[string]bool
+
+	for _, e := range events {
+		w := eventWords(e.Description)
+
+		duplicate := -1
+		for i := len(deduped) - 1; i >= max(0, len(deduped)-DedupeWindow); i-- {
+			threshold := DuplicateEventSimilarity
+			if slices.ContainsFunc(e.PassageIDs, func(id int64) bool { return slices.Contains(deduped[i].PassageIDs, id) }) {
+				threshold = DuplicateEventSimilarity * 2 / 3
+			}
+			if eventSimilarity(w, words[i]) >= threshold {
+				duplicate = i
+				break
+			}
+		}
+
+		if duplicate < 0 {
+			deduped = append(deduped, e)
+			words = append(words, w)
+			continue
+		}
+
+		merged := &deduped[duplicate]
+		for _, id := range e.PassageIDs {
+			if !slices.Contains(merged.PassageIDs, id) {
+				merged.PassageIDs = append(merged.PassageIDs, id)
+			}
+		}
+		slices.Sort(merged.PassageIDs)
+	}
+
+	return deduped
+}
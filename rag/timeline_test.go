@@ -0,0 +1,95 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTimelineEvents(t *testing.T) {
+	response := `1. Mr. Bingley rented Netherfield. [3]
+- Elizabeth met Mr. Darcy at the ball. [4, 5, 4]
+Mr. Darcy refused to dance with Elizabeth. [99]
+An event without passages.
+
+Jane fell ill at Netherfield. [ 5 ].`
+
+	events := parseTimelineEvents(response, []int64{3, 4, 5})
+
+	expected := []TimelineEvent{
+		{Description: "Mr. Bingley rented Netherfield.", PassageIDs: []int64{3}},
+		{Description: "Elizabeth met Mr. Darcy at the ball.", PassageIDs: []int64{4, 5}},
+		{Description: "Jane fell ill at Netherfield.", PassageIDs: []int64{5}},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, events)
+	}
+}
+
+func TestDedupeEvents(t *testing.T) {
+	events := []TimelineEvent{
+		{Section: 0, Description: "Elizabeth met Mr. Darcy at the Meryton ball.", PassageIDs: []int64{4}},
+		{Section: 0, Description: "Jane fell ill at Netherfield.", PassageIDs: []int64{5}},
+		{Section: 0, Description: "Elizabeth met Darcy at the ball in Meryton.", PassageIDs: []int64{6}},
+		{Section: 1, Description: "Jane became ill while visiting Netherfield.", PassageIDs: []int64{5, 7}},
+		{Section: 1, Description: "Elizabeth walked to Netherfield.", PassageIDs: []int64{7}},
+	}
+
+	deduped := DedupeEvents(events)
+
+	expected := []TimelineEvent{
+		{Section: 0, Description: "Elizabeth met Mr. Darcy at the Meryton ball.", PassageIDs: []int64{4, 6}},
+		{Section: 0, Description: "Jane fell ill at Netherfield.", PassageIDs: []int64{5, 7}},
+		{Section: 1, Description: "Elizabeth walked to Netherfield.", PassageIDs: []int64{7}},
+	}
+	if !reflect.DeepEqual(deduped, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, deduped)
+	}
+}
+
+func TestExtractTimeline(t *testing.T) {
+	generator := newTestGenerator(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		prompt := body.Messages[len(body.Messages)-1].Content
+
+		if !strings.Contains(prompt, UntrustedPassagesNotice) || !strings.Contains(prompt, `<passage id="`) {
+			t.Errorf("Expected the passages to be delimited, got %q", prompt)
+		}
+
+		response := "Mr. Bingley rented Netherfield. [1]\nThe Bennets heard the news. [2]"
+		if strings.Contains(prompt, `"Chapter 2"`) {
+			response = "Mr. Bennet visited Mr. Bingley. [3]"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		completion, _ := json.Marshal(response)
+		fmt.Fprintf(w, `{"id": "1", "object": "chat.completion", "created": 0, "model": "test",
+			"choices": [{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": %s}}]}`, completion)
+	})
+
+	events, err := generator.ExtractTimeline(context.Background(), []TimelineSection{
+		{Title: "Chapter 1", Passages: []TimelinePassage{{ID: 1, Text: "Netherfield is let at last."}, {ID: 2, Text: "Mrs. Bennet told her husband."}}},
+		{Title: "Chapter 2", Passages: []TimelinePassage{{ID: 3, Text: "Mr. Bennet was among the earliest to wait on Mr. Bingley."}}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []TimelineEvent{
+		{Section: 0, Description: "Mr. Bingley rented Netherfield.", PassageIDs: []int64{1}},
+		{Section: 0, Description: "The Bennets heard the news.", PassageIDs: []int64{2}},
+		{Section: 1, Description: "Mr. Bennet visited Mr. Bingley.", PassageIDs: []int64{3}},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, events)
+	}
+}